@@ -0,0 +1,279 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// Admin is the user administration. It is only accessible to logged-in users
+// with the permission Config.AdminPermission (see Config.Roles and
+// RequirePermission()).
+//
+// Upon a GET request without an "email" parameter, the "admin.gohtml" template
+// is rendered with a list of users whose email addresses contain the "query"
+// parameter. The list is split into pages of Config.AdminPageSize users (see
+// the "page" parameter). Upon a GET request with an "email" parameter, the
+// "adminuser.gohtml" template is rendered with details about that user.
+//
+// Upon a POST request, the action given in the "action" field is performed on
+// the user with the provided email address:
+//
+//   - "verify": Sets the user's state to StateVerified.
+//   - "expire": Sets the user's state to StateExpired.
+//   - "suspend": Suspends the user (see Suspend()) for the reason given in the
+//     "reason" field until the date (YYYY-MM-DD) given in the "until" field or,
+//     if that field is empty, indefinitely.
+//   - "reinstate": Ends the user's suspension (see Reinstate()).
+//   - "approve": Approves a user awaiting approval (see Approve()).
+//   - "reject": Rejects and deletes a user awaiting approval (see Reject()).
+//   - "reset": Sends the user a password reset email.
+//   - "logout": Logs the user out of all sessions and forgets their
+//     remembered devices.
+//   - "delete": Deletes the user (using Config.DeleteUser) after logging them
+//     out of all sessions.
+//   - "impersonate": Logs the administrator in as the user for at most
+//     Config.ImpersonationDuration, after which they are logged back in as
+//     themselves. They can also return early via StopImpersonation(). While
+//     impersonating, templates receive the administrator under the
+//     "impersonator" key, and handlers changing sensitive account information
+//     (Change(), TOTPEnroll(), TOTPDisable(), WebAuthnRegister(), and
+//     RememberedDevices()) are blocked. Other administrators cannot be
+//     impersonated.
+//
+// Administrators cannot expire, suspend, log out, delete, or impersonate
+// themselves.
+// Every action is logged and reported to Config.AdminAction.
+func Admin(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	RequirePermission(Config.AdminPermission, http.HandlerFunc(admin)).ServeHTTP(response, request)
+}
+
+// admin implements Admin() for users who passed the permission check.
+func admin(response http.ResponseWriter, request *http.Request) {
+	adminUser := UserFromContext(request.Context())
+
+	// Without an email address, we show the user list.
+	email := lookupEmail(request.FormValue("email"))
+	if email == "" {
+		if request.Method == "POST" {
+			RenderProgramError(response, request, "No email address provided for admin action", "", nil)
+			return
+		}
+		adminList(response, request, adminUser)
+		return
+	}
+
+	// Load the user.
+	user, err := Config.LoadUserByEmail(email)
+	if err != nil {
+		RenderProgramError(response, request, "Could not load user for administration: "+email, "Could not load user", err)
+		return
+	}
+	if user == nil {
+		RenderPageError(response, request, "admin.gohtml", "usernotfound", map[string]interface{}{"query": email}, adminUser)
+		return
+	}
+
+	if request.Method != "POST" {
+		RenderPage(response, request, "adminuser.gohtml", map[string]interface{}{
+			"config": Config,
+			"user":   adminUser,
+			"infos":  adminUserInfos(user),
+		})
+		return
+	}
+
+	// Perform the action.
+	action := request.PostFormValue("action")
+	switch action {
+	case "expire", "suspend", "logout", "delete", "impersonate":
+		if user.GetID() == adminUser.GetID() {
+			Config.Log.Printf("Admin %s (%s) attempted %q on themselves", adminUser.GetID(), adminUser.GetEmail(), action)
+			RenderPageError(response, request, "adminuser.gohtml", "adminself", adminUserInfos(user), adminUser)
+			return
+		}
+	}
+	if action == "impersonate" && Can(user, Config.AdminPermission) {
+		Config.Log.Printf("Admin %s (%s) attempted to impersonate admin %s (%s)", adminUser.GetID(), adminUser.GetEmail(), user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "adminuser.gohtml", "impersonationdenied", adminUserInfos(user), adminUser)
+		return
+	}
+	switch action {
+	case "verify":
+		if err = ChangeState(user, StateVerified); err == nil {
+			user.SetVerificationID("", time.Unix(0, 0))
+			err = saveAndRefreshUser(user)
+		}
+	case "expire":
+		if err = ChangeState(user, StateExpired); err == nil {
+			err = saveAndRefreshUser(user)
+		}
+	case "suspend":
+		var until time.Time
+		if value := request.PostFormValue("until"); value != "" {
+			until, err = time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				Config.Log.Printf("Admin %s (%s) provided an invalid suspension end: %s", adminUser.GetID(), adminUser.GetEmail(), value)
+				RenderPageError(response, request, "adminuser.gohtml", "invaliddate", adminUserInfos(user), adminUser)
+				return
+			}
+		}
+		err = Suspend(user, strings.TrimSpace(request.PostFormValue("reason")), until)
+	case "reinstate":
+		err = Reinstate(user)
+	case "approve":
+		err = Approve(user)
+	case "reject":
+		err = Reject(user)
+	case "reset":
+		err = sendPasswordReset(request, user)
+	case "logout":
+		forgetAllDevices(user)
+		if err = Config.UpdateUser(user); err == nil {
+			err = sessions.LogOut(user.GetID())
+		}
+	case "delete":
+		err = deleteAccount(user)
+	case "impersonate":
+		err = startImpersonation(response, request, adminUser, user)
+	default:
+		RenderProgramError(response, request, fmt.Sprintf("Unknown admin action %q", action), "Unknown action", nil)
+		return
+	}
+	if err != nil {
+		RenderProgramError(response, request, fmt.Sprintf("Admin action %q failed for user %s (%s)", action, user.GetID(), user.GetEmail()), "Action failed", err)
+		return
+	}
+	Config.Log.Printf("Admin %s (%s) performed %q on user %s (%s)", adminUser.GetID(), adminUser.GetEmail(), action, user.GetID(), user.GetEmail())
+	if Config.AdminAction != nil {
+		Config.AdminAction(adminUser, user, action)
+	}
+
+	// Show the result.
+	if action == "impersonate" {
+		http.Redirect(response, request, Config.RouteLoggedIn, 302)
+		return
+	}
+	if action == "delete" || action == "reject" {
+		http.Redirect(response, request, Config.RouteAdmin, 302)
+		return
+	}
+	http.Redirect(response, request, Config.RouteAdmin+"?email="+url.QueryEscape(user.GetEmail()), 302)
+}
+
+// adminList renders the user list of the user administration.
+func adminList(response http.ResponseWriter, request *http.Request, adminUser User) {
+	// Find users.
+	query := strings.ToLower(strings.TrimSpace(request.FormValue("query")))
+	list, err := sortedUsers(query)
+	if err != nil {
+		RenderProgramError(response, request, "Could not iterate over users for administration", "", err)
+		return
+	}
+
+	// Select the requested page.
+	pageSize := Config.AdminPageSize
+	if pageSize <= 0 {
+		pageSize = len(list) + 1
+	}
+	pages := (len(list) + pageSize - 1) / pageSize
+	page, _ := strconv.Atoi(request.FormValue("page"))
+	if page > pages {
+		page = pages
+	}
+	if page < 1 {
+		page = 1
+	}
+	start, end := (page-1)*pageSize, page*pageSize
+	if end > len(list) {
+		end = len(list)
+	}
+	if start > end {
+		start = end
+	}
+	var previous, next int // 0 if there is no such page.
+	if page > 1 {
+		previous = page - 1
+	}
+	if page < pages {
+		next = page + 1
+	}
+
+	RenderPage(response, request, "admin.gohtml", map[string]interface{}{
+		"config": Config,
+		"user":   adminUser,
+		"infos": map[string]interface{}{
+			"query":    query,
+			"users":    list[start:end],
+			"total":    len(list),
+			"page":     page,
+			"pages":    pages,
+			"previous": previous,
+			"next":     next,
+		},
+	})
+}
+
+// adminUserInfos returns the information about a user shown on the user
+// administration's details page.
+func adminUserInfos(user User) map[string]interface{} {
+	now := time.Now()
+	verificationID, idCreated := user.GetVerificationID()
+	passwordToken, tokenCreated := user.GetPasswordToken()
+	infos := map[string]interface{}{
+		"target":              user,
+		"state":               stateName(user.GetState()),
+		"verificationPending": verificationID != "" && idCreated.Add(3*24*time.Hour).After(now),
+		"resetPending":        passwordToken != "" && tokenCreated.Add(30*time.Minute).After(now),
+		"totp":                totpEnabled(user),
+		"roles":               user.GetRoles(),
+	}
+	if webAuthnUser, ok := user.(WebAuthnUser); ok {
+		infos["passkeys"] = len(webAuthnUser.GetWebAuthnCredentials())
+	}
+	if rememberUser, ok := user.(RememberUser); ok {
+		infos["devices"] = len(rememberUser.GetRememberedDevices())
+	}
+	if expiryUser, ok := user.(ExpiryUser); ok && !expiryUser.GetExpiry().IsZero() {
+		infos["expires"] = expiryUser.GetExpiry().Format("2006-01-02 15:04")
+	}
+	if suspensionUser, ok := user.(SuspensionUser); ok && user.GetState() == StateSuspended {
+		reason, until := suspensionUser.GetSuspension()
+		infos["suspensionReason"] = reason
+		if !until.IsZero() {
+			infos["suspendedUntil"] = until.Format("2006-01-02")
+		}
+	}
+	if magicUser, ok := user.(MagicLinkUser); ok {
+		token, created := magicUser.GetLoginToken()
+		infos["loginPending"] = token != "" && created.Add(Config.MagicLinkValidity).After(now)
+	}
+	return infos
+}
+
+// sortedUsers returns all users whose email addresses contain the given
+// lowercase query, ignoring case, sorted by their email addresses.
+func sortedUsers(query string) ([]User, error) {
+	var list []User
+	if err := Config.ForEachUser(func(user User) error {
+		if strings.Contains(strings.ToLower(user.GetEmail()), query) {
+			list = append(list, user)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].GetEmail()) < strings.ToLower(list[j].GetEmail())
+	})
+	return list, nil
+}
@@ -0,0 +1,152 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// setUpAdmin prepares an administrator and a list of users and returns the
+// administrator as well as a function which restores the configuration.
+func setUpAdmin(list []*MyUser) (*MyUser, func()) {
+	Config.Roles = map[string]Role{"admin": {Permissions: []string{"users.*"}}}
+	admin := &MyUser{id: "admin", email: "admin@z", state: StateVerified, roles: []string{"admin"}}
+	all := append([]*MyUser{admin}, list...)
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		for _, user := range all {
+			if user.email == email {
+				return user, nil
+			}
+		}
+		return nil, nil
+	}
+	forEachUser := Config.ForEachUser
+	Config.ForEachUser = func(callback func(user User) error) error {
+		for _, user := range all {
+			if err := callback(user); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return admin, func() {
+		Config.Roles = nil
+		Config.ForEachUser = forEachUser
+		Config.AdminPageSize = 50
+		Config.AdminAction = nil
+	}
+}
+
+func TestAdminPermission(t *testing.T) {
+	_, restore := setUpAdmin(nil)
+	defer restore()
+	computed, _ := runRequest(&MyUser{state: StateVerified}, nil, nil, Admin)
+	assertString("HIADF", computed, t)
+	computed, _ = runRequest(nil, nil, nil, Admin)
+	assertString("redirect", computed, t)
+
+	// Expired administrators are refused and sent to the renewal page.
+	expired := &MyUser{id: "admin", email: "admin@z", state: StateExpired, roles: []string{"admin"}}
+	computed, _ = runRequest(expired, nil, nil, Admin)
+	assertString("HIADF", computed, t)
+	Config.RouteRenewal = "/renew"
+	defer func() {
+		Config.RouteRenewal = ""
+	}()
+	computed, _ = runRequest(expired, nil, nil, Admin)
+	assertString("redirect", computed, t)
+}
+
+func TestAdminList(t *testing.T) {
+	admin, restore := setUpAdmin([]*MyUser{
+		{email: "c@x"},
+		{email: "a@x"},
+		{email: "b@y"},
+	})
+	defer restore()
+	Config.AdminPageSize = 2
+	computed, _ := runRequest(admin, nil, nil, Admin)
+	assertString("HIALa@x;admin@z;>2F", computed, t)
+	computed, _ = runRequest(admin, map[string]string{"page": "2"}, nil, Admin)
+	assertString("HIALb@y;c@x;F", computed, t)
+	computed, _ = runRequest(admin, map[string]string{"query": "@X"}, nil, Admin)
+	assertString("HIALa@x;c@x;F", computed, t)
+	computed, _ = runRequest(admin, map[string]string{"email": "d@x"}, nil, Admin)
+	assertString("HIAL!UNF!F", computed, t)
+}
+
+func TestAdminUser(t *testing.T) {
+	user := &MyUser{id: "u", email: "u@x", state: StateCreated, verificationID: "vid"}
+	admin, restore := setUpAdmin([]*MyUser{user})
+	defer restore()
+	var audit []string
+	Config.AdminAction = func(admin, user User, action string) {
+		audit = append(audit, action)
+	}
+	computed, _ := runRequest(admin, map[string]string{"email": "u@x"}, nil, Admin)
+	assertString("HIAUcreatedF", computed, t)
+
+	// Verify.
+	computed, _ = runRequest(admin, nil, map[string]string{"email": "u@x", "action": "verify"}, Admin)
+	assertString("redirect", computed, t)
+	if user.state != StateVerified || user.verificationID != "" {
+		t.Error("User was not verified")
+	}
+
+	// Expire.
+	computed, _ = runRequest(admin, nil, map[string]string{"email": "u@x", "action": "expire"}, Admin)
+	assertString("redirect", computed, t)
+	if user.state != StateExpired {
+		t.Error("User was not expired")
+	}
+
+	// Password reset.
+	computed, mail := runRequest(admin, nil, map[string]string{"email": "u@x", "action": "reset"}, Admin)
+	assertString("redirect", computed, t)
+	assertString("RE", strings.TrimSpace(mail), t)
+	if user.passwordToken == "" {
+		t.Error("No password token generated")
+	}
+
+	// Log out.
+	user.devices = []RememberedDevice{{ID: "d"}}
+	computed, _ = runRequest(admin, nil, map[string]string{"email": "u@x", "action": "logout"}, Admin)
+	assertString("redirect", computed, t)
+	if len(user.devices) != 0 {
+		t.Error("Remembered devices were not forgotten")
+	}
+
+	// Delete.
+	deleteUser := Config.DeleteUser
+	defer func() {
+		Config.DeleteUser = deleteUser
+	}()
+	var deleted User
+	Config.DeleteUser = func(user User) error {
+		deleted = user
+		return nil
+	}
+	computed, _ = runRequest(admin, nil, map[string]string{"email": "u@x", "action": "delete"}, Admin)
+	assertString("redirect", computed, t)
+	if deleted != user {
+		t.Error("User was not deleted")
+	}
+	assertString("verify,expire,reset,logout,delete", strings.Join(audit, ","), t)
+
+	// Failures are not reported.
+	audit = nil
+	Config.DeleteUser = func(user User) error {
+		return errors.New("Failed")
+	}
+	runRequest(admin, nil, map[string]string{"email": "u@x", "action": "delete"}, Admin)
+	if len(audit) != 0 {
+		t.Error("Failed action was reported")
+	}
+}
+
+func TestAdminSelf(t *testing.T) {
+	admin, restore := setUpAdmin(nil)
+	defer restore()
+	computed, _ := runRequest(admin, nil, map[string]string{"email": "admin@z", "action": "delete"}, Admin)
+	assertString("HIAUverified!ASF!F", computed, t)
+}
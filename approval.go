@@ -0,0 +1,111 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ApprovalUser is an optional extension of the User interface. Users
+// implementing it remember whether they were approved (see
+// Config.SignUpApproval), so that they don't need to be approved again when
+// they verify a changed email address. Users who had access before approval
+// was required count as approved. Config.SignUpApproval requires users to
+// implement this interface.
+type ApprovalUser interface {
+	SetApproved(approved bool)
+	GetApproved() bool
+}
+
+// approvalRequired returns whether the given user, who just verified their
+// email address, needs to be approved by an administrator. This is only the
+// case for users who verify their email address for the first time.
+func approvalRequired(user User) bool {
+	if !Config.SignUpApproval {
+		return false
+	}
+	approvalUser, ok := user.(ApprovalUser)
+	return ok && !approvalUser.GetApproved()
+}
+
+// rememberApproval marks the given user as approved if they are past the
+// verification and approval stages, e.g. because they were verified before
+// Config.SignUpApproval was turned on. It is called before users are moved
+// back into StateCreated so they are not held for approval again.
+func rememberApproval(user User) {
+	if state := user.GetState(); state == StateCreated || state == StatePendingApproval {
+		return
+	}
+	if approvalUser, ok := user.(ApprovalUser); ok {
+		approvalUser.SetApproved(true)
+	}
+}
+
+// requestApproval notifies the administrators that the given user is awaiting
+// approval, by sending an email (using the "approval_requested.tmpl" mail
+// template) to Config.ApprovalEmail and by calling Config.ApprovalRequested,
+// whichever is set.
+func requestApproval(request *http.Request, user User) error {
+	Config.Log.Printf("User %s (%s) is awaiting approval", user.GetID(), user.GetEmail())
+	if Config.ApprovalEmail != "" {
+		if err := SendMail(request, Config.ApprovalEmail, "approval_requested.tmpl", map[string]interface{}{
+			"email":  user.GetEmail(),
+			"link":   Config.RouteAdmin + "?email=" + url.QueryEscape(user.GetEmail()),
+			"config": Config,
+			"user":   user,
+		}); err != nil {
+			return err
+		}
+	}
+	if Config.ApprovalRequested != nil {
+		Config.ApprovalRequested(user)
+	}
+	return nil
+}
+
+// Approve moves the given user, who must be in StatePendingApproval, into
+// StateVerified and sends them a welcome email (using the "approved.tmpl" mail
+// template).
+func Approve(user User) error {
+	if user.GetState() != StatePendingApproval {
+		return errors.New("User is not awaiting approval")
+	}
+	if err := ChangeState(user, StateVerified); err != nil {
+		return err
+	}
+	if approvalUser, ok := user.(ApprovalUser); ok {
+		approvalUser.SetApproved(true)
+	}
+	if err := saveAndRefreshUser(user); err != nil {
+		return err
+	}
+	Config.Log.Printf("User %s (%s) was approved", user.GetID(), user.GetEmail())
+	return SendMail(nil, user.GetEmail(), "approved.tmpl", map[string]interface{}{
+		"email":  user.GetEmail(),
+		"config": Config,
+		"user":   user,
+	})
+}
+
+// Reject sends the given user, who must be in StatePendingApproval, a decline
+// email (using the "rejected.tmpl" mail template) and deletes their account
+// (see Config.DeleteUserData and Config.DeleteUser). They may sign up again
+// later.
+func Reject(user User) error {
+	if user.GetState() != StatePendingApproval {
+		return errors.New("User is not awaiting approval")
+	}
+	if err := SendMail(nil, user.GetEmail(), "rejected.tmpl", map[string]interface{}{
+		"email":  user.GetEmail(),
+		"config": Config,
+		"user":   user,
+	}); err != nil {
+		return err
+	}
+	if err := deleteAccount(user); err != nil {
+		return fmt.Errorf("Could not delete rejected user: %s", err)
+	}
+	Config.Log.Printf("User %s (%s) was rejected", user.GetID(), user.GetEmail())
+	return nil
+}
@@ -0,0 +1,129 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignUpApproval(t *testing.T) {
+	Config.SignUpApproval = true
+	Config.ApprovalEmail = "staff@x"
+	var requested User
+	Config.ApprovalRequested = func(user User) {
+		requested = user
+	}
+	defer func() {
+		Config.SignUpApproval = false
+		Config.ApprovalEmail = ""
+		Config.ApprovalRequested = nil
+	}()
+	user := &MyUser{
+		id:             "u",
+		email:          "u@x",
+		state:          StateCreated,
+		passwordHash:   []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		verificationID: "12345",
+		vidCreated:     time.Now().Add(-time.Minute),
+	}
+	loadUser := Config.LoadUserByVerificationID
+	defer func() {
+		Config.LoadUserByVerificationID = loadUser
+	}()
+	Config.LoadUserByVerificationID = func(id string) (User, error) {
+		return user, nil
+	}
+
+	// Verification leads to the pending state.
+	computed, mail := runRequest(nil, nil, map[string]string{"id": "12345"}, Verify)
+	assertString("HOAAF", computed, t)
+	assertString("APRu@x", mail, t)
+	if user.state != StatePendingApproval || requested != user {
+		t.Fatalf("User is not awaiting approval, state is %d", user.state)
+	}
+
+	// Pending users cannot log in.
+	admin, restore := setUpAdmin([]*MyUser{user})
+	defer restore()
+	computed, _ = runRequest(nil, nil, map[string]string{"email": "u@x", "password": "12345"}, LogIn)
+	assertString("HOAAF", computed, t)
+
+	// Approve.
+	computed, _ = runRequest(admin, map[string]string{"email": "u@x"}, nil, Admin)
+	assertString("HIAUpendingapprovalF", computed, t)
+	computed, mail = runRequest(admin, nil, map[string]string{"email": "u@x", "action": "approve"}, Admin)
+	assertString("redirect", computed, t)
+	assertString("APP", strings.TrimSpace(mail), t)
+	if user.state != StateVerified || !user.approved {
+		t.Fatalf("User was not approved, state is %d", user.state)
+	}
+	computed, _ = runRequest(admin, nil, map[string]string{"email": "u@x", "action": "approve"}, Admin)
+	if computed == "redirect" {
+		t.Error("Verified user was approved again")
+	}
+
+	// Approved users who change their email address don't need approval again.
+	user.state = StateCreated
+	user.verificationID = "12345"
+	user.vidCreated = time.Now()
+	computed, _ = runRequest(nil, nil, map[string]string{"id": "12345"}, Verify)
+	assertString("HOVF", computed, t)
+}
+
+func TestSignUpReject(t *testing.T) {
+	user := &MyUser{id: "u", email: "u@x", state: StatePendingApproval}
+	admin, restore := setUpAdmin([]*MyUser{user})
+	defer restore()
+	deleteUser := Config.DeleteUser
+	defer func() {
+		Config.DeleteUser = deleteUser
+	}()
+	var deleted User
+	Config.DeleteUser = func(user User) error {
+		deleted = user
+		return nil
+	}
+	computed, mail := runRequest(admin, nil, map[string]string{"email": "u@x", "action": "reject"}, Admin)
+	assertString("redirect", computed, t)
+	assertString("REJ", strings.TrimSpace(mail), t)
+	if deleted != user {
+		t.Error("Rejected user was not deleted")
+	}
+}
+
+func TestChangeEmailApproval(t *testing.T) {
+	Config.SignUpApproval = true
+	defer func() {
+		Config.SignUpApproval = false
+	}()
+
+	// A user verified before approval was required changes their email address.
+	user := &MyUser{
+		id:           "u",
+		email:        "u@x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+	}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return nil, nil
+	}
+	computed, _ := runRequest(user, nil, map[string]string{"email": "v@x", "currentpassword": "12345"}, Change)
+	assertString("HOICF", computed, t)
+	if user.state != StateCreated || user.verificationID == "" {
+		t.Fatalf("Email change was not started, state is %d", user.state)
+	}
+
+	// Verifying the new address does not require approval.
+	loadUser := Config.LoadUserByVerificationID
+	defer func() {
+		Config.LoadUserByVerificationID = loadUser
+	}()
+	Config.LoadUserByVerificationID = func(id string) (User, error) {
+		return user, nil
+	}
+	computed, _ = runRequest(nil, nil, map[string]string{"id": user.verificationID}, Verify)
+	assertString("HOVF", computed, t)
+	if user.state != StateVerified || !user.approved {
+		t.Errorf("User was held for approval, state is %d", user.state)
+	}
+}
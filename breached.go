@@ -0,0 +1,134 @@
+package users
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// PasswordBreached is the PasswordViolation reason for a password which was
+// found in a corpus of breached passwords.
+const PasswordBreached = "breached"
+
+// BreachedPasswords checks passwords against a locally stored corpus of
+// breached passwords. No network calls are made. The corpus is a text file in
+// the format of the Pwned Passwords list ordered by hash
+// (https://haveibeenpwned.com/Passwords): One uppercase hexadecimal SHA-1 hash
+// per line, optionally followed by a colon and the number of times the
+// password was seen in breaches. Lines must be sorted by hash. The file is
+// searched with a binary search so it is never loaded into memory.
+type BreachedPasswords struct {
+	// The name of the corpus file.
+	File string
+
+	// Passwords which were seen in fewer breaches than this number are
+	// ignored. Lines without a count are assumed to have a count of 1.
+	MinCount int
+}
+
+// Contains returns whether the given password is found in the breached
+// password corpus.
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	hash := sha1.Sum([]byte(password))
+	return b.containsHash(bytes.ToUpper([]byte(hex.EncodeToString(hash[:]))))
+}
+
+// containsHash returns whether the given uppercase hexadecimal SHA-1 hash is
+// found in the breached password corpus.
+func (b *BreachedPasswords) containsHash(target []byte) (bool, error) {
+	file, err := os.Open(b.File)
+	if err != nil {
+		return false, fmt.Errorf("Could not open breached passwords file: %s", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("Could not access breached passwords file: %s", err)
+	}
+
+	// Binary search. "lo" is always at the start of a line. The target line, if
+	// it exists, starts in [lo, hi).
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, err := lineStart(file, mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		line, err := readLine(file, start)
+		if err != nil {
+			return false, err
+		}
+		lineHash := bytes.TrimRight(line, "\r")
+		if colon := bytes.IndexByte(line, ':'); colon >= 0 {
+			lineHash = line[:colon]
+		}
+		switch bytes.Compare(bytes.ToUpper(lineHash), target) {
+		case -1:
+			lo = start + int64(len(line)) + 1
+		case 1:
+			hi = start
+		default:
+			count := 1
+			if colon := bytes.IndexByte(line, ':'); colon >= 0 {
+				count, err = strconv.Atoi(string(bytes.TrimSpace(line[colon+1:])))
+				if err != nil {
+					return false, fmt.Errorf("Invalid count in breached passwords file: %s", err)
+				}
+			}
+			return count >= b.MinCount, nil
+		}
+	}
+
+	return false, nil
+}
+
+// lineStart returns the offset of the first line which starts at or after the
+// given offset. If there is no such line, the file size is returned.
+func lineStart(file *os.File, offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+	buffer := make([]byte, 128)
+	for position := offset - 1; ; position += int64(len(buffer)) {
+		n, err := file.ReadAt(buffer, position)
+		if index := bytes.IndexByte(buffer[:n], '\n'); index >= 0 {
+			return position + int64(index) + 1, nil
+		}
+		if err == io.EOF {
+			return position + int64(n), nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Could not read breached passwords file: %s", err)
+		}
+	}
+}
+
+// readLine reads the line starting at the given offset. The returned line
+// contains all characters up to but excluding the newline character, i.e.
+// any carriage return is included.
+func readLine(file *os.File, offset int64) ([]byte, error) {
+	var line []byte
+	buffer := make([]byte, 128)
+	for position := offset; ; position += int64(len(buffer)) {
+		n, err := file.ReadAt(buffer, position)
+		if index := bytes.IndexByte(buffer[:n], '\n'); index >= 0 {
+			return append(line, buffer[:index]...), nil
+		}
+		line = append(line, buffer[:n]...)
+		if err == io.EOF {
+			return line, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read breached passwords file: %s", err)
+		}
+	}
+}
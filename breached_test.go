@@ -0,0 +1,60 @@
+package users
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestBreachedPasswords(t *testing.T) {
+	breached := &BreachedPasswords{File: "test/breachedpasswords.txt"}
+	for password, expected := range map[string]bool{
+		"12345":                     true,
+		"correcthorsebatterystaple": true,
+		"trustno1trustno1":          true,
+		"seenonlyonce":              true,
+		"lakjshfaksjhf":             false,
+		"":                          false,
+	} {
+		contains, err := breached.Contains(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contains != expected {
+			t.Errorf(`Expected %t for "%s" but got %t`, expected, password, contains)
+		}
+	}
+
+	// Every hash in the file must be found.
+	corpus, err := ioutil.ReadFile(breached.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Fields(string(corpus)) {
+		contains, err := breached.containsHash([]byte(line[:40]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !contains {
+			t.Errorf("Hash %s was not found", line[:40])
+		}
+	}
+}
+
+func TestBreachedPasswordsMinCount(t *testing.T) {
+	breached := &BreachedPasswords{File: "test/breachedpasswords.txt", MinCount: 2}
+	contains, err := breached.Contains("seenonlyonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains {
+		t.Error("Password below minimum count was reported as breached")
+	}
+}
+
+func TestBreachedPasswordsMissingFile(t *testing.T) {
+	breached := &BreachedPasswords{File: "test/doesnotexist.txt"}
+	if _, err := breached.Contains("12345"); err == nil {
+		t.Error("No error for missing breached passwords file")
+	}
+}
@@ -0,0 +1,138 @@
+package users
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// cborMaxDepth is the maximum nesting depth of CBOR data items we accept.
+const cborMaxDepth = 16
+
+// cborDecode decodes the first CBOR data item (RFC 8949) found in the given
+// data and returns it along with the remaining bytes. Only the subset of CBOR
+// needed for WebAuthn is supported: Integers are returned as int64, byte
+// strings as []byte, text strings as string, arrays as []interface{}, maps as
+// map[interface{}]interface{}, and the simple values false, true, and null as
+// bool and nil. Indefinite lengths, tags, and floating point numbers are not
+// supported.
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeItem(data, 0)
+}
+
+// cborDecodeItem decodes one CBOR data item at the given nesting depth.
+func cborDecodeItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("CBOR data is nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, errors.New("Unexpected end of CBOR data")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	// Simple values.
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("Unsupported CBOR simple value %d", info)
+	}
+
+	// Determine the argument.
+	var argument uint64
+	switch {
+	case info < 24:
+		argument = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		switch size {
+		case 1:
+			argument = uint64(data[0])
+		case 2:
+			argument = uint64(binary.BigEndian.Uint16(data))
+		case 4:
+			argument = uint64(binary.BigEndian.Uint32(data))
+		case 8:
+			argument = binary.BigEndian.Uint64(data)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("Unsupported CBOR additional information %d", info)
+	}
+
+	switch major {
+	case 0: // Unsigned integer.
+		if argument > 1<<63-1 {
+			return nil, nil, errors.New("CBOR integer overflow")
+		}
+		return int64(argument), data, nil
+	case 1: // Negative integer.
+		if argument > 1<<63-1 {
+			return nil, nil, errors.New("CBOR integer overflow")
+		}
+		return -1 - int64(argument), data, nil
+	case 2, 3: // Byte string, text string.
+		if argument > uint64(len(data)) {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		value := data[:argument]
+		if major == 3 {
+			return string(value), data[argument:], nil
+		}
+		return append([]byte{}, value...), data[argument:], nil
+	case 4: // Array.
+		if argument > uint64(len(data)) {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		array := make([]interface{}, 0, argument)
+		for index := uint64(0); index < argument; index++ {
+			var (
+				element interface{}
+				err     error
+			)
+			element, data, err = cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			array = append(array, element)
+		}
+		return array, data, nil
+	case 5: // Map.
+		if argument > uint64(len(data)) {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		m := make(map[interface{}]interface{}, argument)
+		for index := uint64(0); index < argument; index++ {
+			var (
+				key, value interface{}
+				err        error
+			)
+			key, data, err = cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("Unsupported CBOR map key type %T", key)
+			}
+			value, data, err = cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, data, nil
+	}
+
+	return nil, nil, fmt.Errorf("Unsupported CBOR major type %d", major)
+}
@@ -0,0 +1,60 @@
+package users
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestCBORDecode(t *testing.T) {
+	// Examples from RFC 8949, Appendix A.
+	for hexData, expected := range map[string]interface{}{
+		"00":                 int64(0),
+		"17":                 int64(23),
+		"1903e8":             int64(1000),
+		"1a000f4240":         int64(1000000),
+		"1b000000e8d4a51000": int64(1000000000000),
+		"20":                 int64(-1),
+		"3863":               int64(-100),
+		"f4":                 false,
+		"f5":                 true,
+		"f6":                 nil,
+		"4401020304":         []byte{1, 2, 3, 4},
+		"6449455446":         "IETF",
+		"83010203":           []interface{}{int64(1), int64(2), int64(3)},
+		"a201020304":         map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)},
+		"a26161016162820203": map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}},
+	} {
+		data, _ := hex.DecodeString(hexData)
+		value, rest, err := cborDecode(append(data, 0xff))
+		if err != nil {
+			t.Errorf("Decoding %s failed: %s", hexData, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, expected) {
+			t.Errorf("Decoding %s: expected %#v, got %#v", hexData, expected, value)
+		}
+		if len(rest) != 1 || rest[0] != 0xff {
+			t.Errorf("Decoding %s: wrong remaining bytes %x", hexData, rest)
+		}
+	}
+}
+
+func TestCBORDecodeInvalid(t *testing.T) {
+	for _, hexData := range []string{
+		"",                                     // Empty.
+		"19",                                   // Truncated argument.
+		"4401",                                 // Truncated byte string.
+		"830102",                               // Truncated array.
+		"f93c00",                               // Floating point number.
+		"5f42010243030405ff",                   // Indefinite length.
+		"c11a514b67b0",                         // Tag.
+		"a1f500",                               // Unsupported map key.
+		"818181818181818181818181818181818181", // Nested too deeply.
+	} {
+		data, _ := hex.DecodeString(hexData)
+		if _, _, err := cborDecode(data); err == nil {
+			t.Errorf("Decoding %s should have failed", hexData)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package users
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -16,12 +17,20 @@ import (
 // The "infoschanged.gohtml" template will be used for confirmation.
 //
 // Any of this only works if a user is currently logged in (checked with
-// IsLoggedIn()).
+// IsLoggedIn()). Administrators impersonating a user (see Admin()) cannot use
+// this page.
 //
 // If there are more user attributes that need to be changed than just email and
 // password, it makes sense to make a copy of this function and extend it to
 // your needs.
 func Change(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	if blockImpersonation(response, request) {
+		return
+	}
+
 	// This page only works if the user is logged in.
 	user, session, _ := IsLoggedIn(response, request)
 	if user == nil {
@@ -36,11 +45,11 @@ func Change(response http.ResponseWriter, request *http.Request) {
 	}
 
 	// Get form input.
-	email := strings.ToLower(request.PostFormValue("email"))
+	email := strings.TrimSpace(request.PostFormValue("email"))
 	currentPassword := request.PostFormValue("currentpassword")
 	password := request.PostFormValue("password")
 	passwordConfirm := request.PostFormValue("passwordconfirm")
-	emailChanged := email != user.GetEmail()
+	emailChanged := lookupEmail(email) != lookupEmail(user.GetEmail())
 	passwordChanged := password != ""
 
 	// Some more variables that will hold the new values.
@@ -80,14 +89,25 @@ func Change(response http.ResponseWriter, request *http.Request) {
 		}
 
 		// Check password integrity.
-		if result := sessions.ReasonablePassword(password, append(Config.PasswordNames, user.GetEmail())); result != sessions.PasswordOK {
-			Config.Log.Printf("Changed password was rejected for %s (%s), reason: %d", user.GetID(), user.GetEmail(), result)
-			RenderPageError(response, request, "changeinfos.gohtml", "invalidpassword", map[string]interface{}{"issue": result, "email": email}, user)
+		violations, err := validatePassword(password, user.GetEmail())
+		if err != nil {
+			RenderProgramError(response, request, "Could not check changed password", "", err)
+			return
+		}
+		if len(violations) > 0 {
+			Config.Log.Printf("Changed password was rejected for %s (%s), reasons: %v", user.GetID(), user.GetEmail(), violations)
+			RenderPageError(response, request, "changeinfos.gohtml", "invalidpassword", map[string]interface{}{"violations": violations, "email": email}, user)
+			return
+		}
+
+		// Check password history.
+		if passwordReused(user, password) {
+			Config.Log.Printf("Changed password for %s (%s) was used before", user.GetID(), user.GetEmail())
+			RenderPageError(response, request, "changeinfos.gohtml", "passwordreused", map[string]interface{}{"history": Config.PasswordHistory, "email": email}, user)
 			return
 		}
 
 		// Generate password hash.
-		var err error
 		hash, err = bcrypt.GenerateFromPassword([]byte(password), 0)
 		if err != nil {
 			RenderProgramError(response, request, "Could not generate changed password hash", "", err)
@@ -99,15 +119,29 @@ func Change(response http.ResponseWriter, request *http.Request) {
 
 	// Does the user want to change their email address?
 	if emailChanged {
-		// Perform a very basic email check. We'll send a validation email anyway.
-		if !strings.Contains(email, "@") {
-			Config.Log.Printf("User %s (%s) tried to make changes, new email invalid: %s", user.GetID(), user.GetEmail(), email)
+		// Check the email address syntax. We'll send a validation email anyway.
+		normalized, err := NormalizeEmail(email)
+		if err != nil {
+			Config.Log.Printf("User %s (%s) tried to make changes, new email invalid: %s (%s)", user.GetID(), user.GetEmail(), email, err)
 			RenderPageError(response, request, "changeinfos.gohtml", "invalidemail", map[string]string{"email": email}, user)
 			return
 		}
+		email = normalized
+
+		// Check the email domain.
+		reason, err := checkEmailDomain(email)
+		if err != nil {
+			RenderProgramError(response, request, "Could not check email domain", "", err)
+			return
+		}
+		if reason != "" {
+			Config.Log.Printf("User %s (%s) tried to make changes, new email domain %s: %s", user.GetID(), user.GetEmail(), reason, email)
+			RenderPageError(response, request, "changeinfos.gohtml", "emaildomain", map[string]string{"email": email, "reason": reason}, user)
+			return
+		}
 
 		// Check if there is a user with the new email address?
-		existingUser, err := Config.LoadUserByEmail(email)
+		existingUser, err := Config.LoadUserByEmail(lookupEmail(email))
 		if err != nil {
 			RenderProgramError(response, request, "Could not check email validity", "", err)
 			return
@@ -121,8 +155,10 @@ func Change(response http.ResponseWriter, request *http.Request) {
 		template := "verification_changed.tmpl"
 		if existingUser != nil {
 			// We already have this user in our database. We won't change the email
-			// address but the user will be set back to unverified.
+			// address but the user will be set back to unverified. The notification
+			// goes to the registered address.
 			emailExists = true
+			email = existingUser.GetEmail()
 			template = "verification_existing.tmpl"
 			Config.Log.Printf("Sending verification notification for existing account upon email change: %s (%s)", existingUser.GetID(), email)
 		} else {
@@ -145,6 +181,7 @@ func Change(response http.ResponseWriter, request *http.Request) {
 			"ip":           request.RemoteAddr,
 			"agent":        request.UserAgent(),
 			"verification": verificationID,
+			"code":         emailCode(verificationID),
 			"validity":     idCreated.Add(3 * 24 * time.Hour).Format("Monday, Jan 2, 2006, 15:04:05"),
 			"config":       Config,
 			"user":         user,
@@ -158,15 +195,23 @@ func Change(response http.ResponseWriter, request *http.Request) {
 	}
 
 	// All checks were successful. Modify and save the new user.
-	if passwordChanged {
-		user.SetPasswordHash(hash)
-	}
 	if emailChanged {
+		rememberApproval(user)
+		if err := ChangeState(user, StateCreated); err != nil {
+			RenderProgramError(response, request, fmt.Sprintf("Could not change state of user %s (%s)", user.GetID(), user.GetEmail()), "Could not change email address", err)
+			return
+		}
 		if !emailExists {
 			user.SetEmail(email)
 		}
-		user.SetState(StateCreated)
 		user.SetVerificationID(verificationID, idCreated)
+		forgetAllDevices(user)
+	}
+	if passwordChanged {
+		setPasswordHash(user, hash)
+		if changeUser, ok := user.(PasswordChangeUser); ok {
+			changeUser.SetPasswordChangeRequired(false)
+		}
 	}
 	if err := Config.UpdateUser(user); err != nil {
 		RenderProgramError(response, request, "Could not save user with changes", "", err)
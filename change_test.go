@@ -72,7 +72,7 @@ func TestChangeInvalidPassword(t *testing.T) {
 		"password":        "abc",
 		"passwordconfirm": "abc",
 	}, Change)
-	assertString("HIC!a3!ExF", computed, t)
+	assertString("HIC!tooshort8;sequence;3!ExF", computed, t)
 }
 
 func TestChangePasswordChange(t *testing.T) {
@@ -116,7 +116,7 @@ func TestChangeEmailExists(t *testing.T) {
 		return user, nil
 	}
 	html, mail := runRequest(user, nil, map[string]string{
-		"email":           "@",
+		"email":           "y@x",
 		"currentpassword": "12345",
 	}, Change)
 	assertString("HOICF", html, t)
@@ -133,9 +133,26 @@ func TestChangeEmail(t *testing.T) {
 		return nil, nil
 	}
 	html, mail := runRequest(user, nil, map[string]string{
-		"email":           "@",
+		"email":           "y@x",
 		"currentpassword": "12345",
 	}, Change)
 	assertString("HOICF", html, t)
 	assertString("VC", mail, t)
 }
+
+func TestChangePasswordReused(t *testing.T) {
+	Config.PasswordHistory = 3
+	defer func() { Config.PasswordHistory = 0 }()
+	computed, _ := runRequest(&MyUser{
+		email:        "x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		history:      [][]byte{[]byte("$2a$04$BEDCx4UozOoAWHWvy7qEnOQhG/6SstHzz1MHJe3/NUo.Gh/vQ2v6e")},
+	}, nil, map[string]string{
+		"email":           "x",
+		"currentpassword": "12345",
+		"password":        "lkasflkhasf",
+		"passwordconfirm": "lkasflkhasf",
+	}, Change)
+	assertString("HIC!PRU!ExF", computed, t)
+}
@@ -0,0 +1,44 @@
+// Command users is a template for a command-line tool which manages the users
+// of an application built with the github.com/rivo/users package. It is not
+// usable as is: built unchanged, it always exits with an error. Copy it into
+// your own project, set up users.Config (in particular the functions accessing
+// your user database), and set "configured" to true. The resulting tool
+// provides these commands:
+//
+//	users create [-password=...] [-verified] [-base=https://example.com] <email>
+//	users verify <email>
+//	users expire <email>
+//	users suspend [-reason=...] [-until=YYYY-MM-DD] <email>
+//	users reinstate <email>
+//	users reset [-base=https://example.com] <email>
+//	users delete <email>
+//	users list [-query=...]
+//	users export [-format=csv|json] > users.csv
+//	users import [-format=csv|json] < users.csv
+//
+// The check exists because the package's default in-memory store does not
+// survive the program's exit, so any changes would be lost.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rivo/users"
+)
+
+// configured must be set to true once users.Config has been set up below.
+const configured = false
+
+func main() {
+	// Set up users.Config here.
+
+	if !configured {
+		fmt.Fprintln(os.Stderr, "users.Config is not set up, changes would be lost on exit")
+		os.Exit(1)
+	}
+	if err := users.Command(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
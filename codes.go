@@ -0,0 +1,101 @@
+package users
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// codeAttempt records the failed attempts for one email code.
+type codeAttempt struct {
+	failures int       // The number of wrong codes entered.
+	expires  time.Time // The time after which the code's token is invalid.
+}
+
+var (
+	// The failed attempts per email code, keyed by the token from which the
+	// code was derived. Entries are only removed when their token was used,
+	// invalidated, or has expired.
+	codeAttempts      = make(map[string]*codeAttempt)
+	codeAttemptsMutex sync.Mutex
+)
+
+// emailCode returns the numeric code which may be entered instead of clicking
+// on a link containing the given token (a verification ID or a password
+// token). The code has Config.EmailCodeDigits digits. If codes are turned off
+// or the token is empty, an empty string is returned.
+func emailCode(token string) string {
+	if Config.EmailCodeDigits <= 0 || token == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte("users_emailcode:" + token))
+	modulo := uint64(1)
+	for index := 0; index < Config.EmailCodeDigits; index++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", Config.EmailCodeDigits, binary.BigEndian.Uint64(hash[:8])%modulo)
+}
+
+// loadUserByEmailCode loads the user with the given email address and checks
+// the given code against the code derived from their token, as returned by
+// the "token" function together with the time at which the token expires. If
+// the user is not found or the code is wrong, nil is returned. After
+// Config.EmailCodeAttempts failed attempts, the token is invalidated using the
+// "invalidate" function, the user is saved, and "exhausted" is set to true.
+func loadUserByEmailCode(email, code string, token func(User) (string, time.Time), invalidate func(User)) (user User, exhausted bool, err error) {
+	user, err = Config.LoadUserByEmail(lookupEmail(email))
+	if err != nil || user == nil {
+		return nil, false, err
+	}
+	t, expires := token(user)
+	expected := emailCode(t)
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if expected != "" && subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+		codeAttemptsMutex.Lock()
+		delete(codeAttempts, t)
+		codeAttemptsMutex.Unlock()
+		return user, false, nil
+	}
+	if t == "" {
+		return nil, false, nil
+	}
+
+	// Count the failed attempt.
+	codeAttemptsMutex.Lock()
+	now := time.Now()
+	if len(codeAttempts) >= 1000 {
+		// Remove the counters of expired tokens. Counters of live tokens must
+		// be kept or their codes could be guessed indefinitely.
+		for key, attempt := range codeAttempts {
+			if attempt.expires.Before(now) {
+				delete(codeAttempts, key)
+			}
+		}
+	}
+	attempt, ok := codeAttempts[t]
+	if !ok {
+		attempt = &codeAttempt{expires: expires}
+		codeAttempts[t] = attempt
+	}
+	attempt.failures++
+	attempts := attempt.failures
+	if attempts >= Config.EmailCodeAttempts {
+		delete(codeAttempts, t)
+	}
+	codeAttemptsMutex.Unlock()
+	if attempts < Config.EmailCodeAttempts {
+		return nil, false, nil
+	}
+
+	// Too many failed attempts. This code can't be used anymore.
+	invalidate(user)
+	if err := Config.UpdateUser(user); err != nil {
+		return nil, true, err
+	}
+	Config.Log.Printf("Too many wrong email codes entered for user %s (%s), token invalidated", user.GetID(), user.GetEmail())
+	return nil, true, nil
+}
@@ -0,0 +1,149 @@
+package users
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// enableEmailCodes turns on six-digit email codes without throttling and
+// returns a function which restores the previous configuration.
+func enableEmailCodes() func() {
+	throttle := Config.ThrottleVerification
+	Config.EmailCodeDigits = 6
+	Config.ThrottleVerification = nil
+	return func() {
+		Config.EmailCodeDigits = 0
+		Config.ThrottleVerification = throttle
+	}
+}
+
+func TestEmailCode(t *testing.T) {
+	assertString("", emailCode("abc"), t)
+	defer enableEmailCodes()()
+	code := emailCode("abc")
+	if len(code) != 6 || code != emailCode("abc") {
+		t.Errorf("Invalid code %q", code)
+	}
+	if code == emailCode("abd") {
+		t.Error("Different tokens yield the same code")
+	}
+	assertString("", emailCode(""), t)
+}
+
+func TestForgottenPasswordCode(t *testing.T) {
+	defer enableEmailCodes()()
+	user := &MyUser{email: "@", state: StateVerified}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	_, mail := runRequest(nil, nil, map[string]string{"email": "@"}, ForgottenPassword)
+	assertString("RE#"+emailCode(user.passwordToken), mail, t)
+}
+
+func TestVerifyCode(t *testing.T) {
+	defer enableEmailCodes()()
+	user := &MyUser{email: "a@b", state: StateCreated, verificationID: "vid", vidCreated: time.Now()}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+
+	// The code entry page.
+	computed, _ := runRequest(nil, map[string]string{"email": "a@b"}, nil, Verify)
+	assertString("HOECa@bF", computed, t)
+
+	// A wrong code.
+	computed, _ = runRequest(nil, nil, map[string]string{"email": "a@b", "code": "x"}, Verify)
+	assertString("HOECa@b!CI!F", computed, t)
+	if user.state != StateCreated {
+		t.Error("User was verified with a wrong code")
+	}
+
+	// Codes must be posted.
+	computed, _ = runRequest(nil, map[string]string{"email": "a@b", "code": emailCode("vid")}, nil, Verify)
+	assertString("HOECa@bF", computed, t)
+
+	// The correct code.
+	computed, _ = runRequest(nil, nil, map[string]string{"email": "a@b", "code": emailCode("vid")}, Verify)
+	assertString("HOVF", computed, t)
+	if user.state != StateVerified || user.verificationID != "" {
+		t.Error("User was not verified with the correct code")
+	}
+}
+
+func TestVerifyCodeAttempts(t *testing.T) {
+	defer enableEmailCodes()()
+	user := &MyUser{email: "a@b", state: StateCreated, verificationID: "vid2", vidCreated: time.Now()}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	wrong := "000000"
+	if emailCode("vid2") == wrong {
+		wrong = "000001"
+	}
+	for attempt := 1; attempt < Config.EmailCodeAttempts; attempt++ {
+		computed, _ := runRequest(nil, nil, map[string]string{"email": "a@b", "code": wrong}, Verify)
+		assertString("HOECa@b!CI!F", computed, t)
+	}
+	computed, _ := runRequest(nil, nil, map[string]string{"email": "a@b", "code": wrong}, Verify)
+	assertString("HOECa@b!CX!F", computed, t)
+	if user.verificationID != "" {
+		t.Error("Verification ID was not invalidated")
+	}
+
+	// Even the correct code doesn't work anymore.
+	computed, _ = runRequest(nil, nil, map[string]string{"email": "a@b", "code": emailCode("vid2")}, Verify)
+	assertString("HOECa@b!CI!F", computed, t)
+	if user.state != StateCreated {
+		t.Error("User was verified with an invalidated code")
+	}
+}
+
+func TestResetPasswordCode(t *testing.T) {
+	defer enableEmailCodes()()
+	user := &MyUser{email: "a@b", state: StateVerified, passwordToken: "tok", tokenCreated: time.Now()}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	computed, _ := runRequest(nil, map[string]string{"email": "a@b"}, nil, ResetPassword)
+	assertString("HOECa@bF", computed, t)
+	computed, _ = runRequest(nil, nil, map[string]string{"email": "a@b", "code": "x"}, ResetPassword)
+	assertString("HOECa@b!CI!F", computed, t)
+	computed, _ = runRequest(nil, nil, map[string]string{"email": "a@b", "code": emailCode("tok")}, ResetPassword)
+	assertString("HORPtokF", computed, t)
+}
+
+func TestEmailCodeAttemptsEviction(t *testing.T) {
+	defer enableEmailCodes()()
+	defer func() {
+		codeAttempts = make(map[string]*codeAttempt)
+	}()
+	user := &MyUser{email: "a@b", state: StateCreated, verificationID: "vid3", vidCreated: time.Now()}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	wrong := "000000"
+	if emailCode("vid3") == wrong {
+		wrong = "000001"
+	}
+	for attempt := 1; attempt < Config.EmailCodeAttempts; attempt++ {
+		runRequest(nil, nil, map[string]string{"email": "a@b", "code": wrong}, Verify)
+	}
+
+	// Filling the counters with other live tokens must not reset ours.
+	for index := 0; index < 1000; index++ {
+		codeAttempts[fmt.Sprintf("live%d", index)] = &codeAttempt{failures: 1, expires: time.Now().Add(time.Hour)}
+	}
+	codeAttempts["expired"] = &codeAttempt{failures: 1, expires: time.Now().Add(-time.Hour)}
+	computed, _ := runRequest(nil, nil, map[string]string{"email": "a@b", "code": wrong}, Verify)
+	assertString("HOECa@b!CX!F", computed, t)
+	if user.verificationID != "" {
+		t.Error("Verification ID was not invalidated")
+	}
+	if _, ok := codeAttempts["expired"]; ok {
+		t.Error("Expired counter was not removed")
+	}
+	if _, ok := codeAttempts["live0"]; !ok {
+		t.Error("Live counter was removed")
+	}
+}
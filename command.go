@@ -0,0 +1,336 @@
+package users
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rivo/sessions"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ExportedUser is the representation of a user in the files written by the
+// "export" command and read by the "import" command (see Command()).
+type ExportedUser struct {
+	ID           string   `json:"id"`
+	Email        string   `json:"email"`
+	State        string   `json:"state"`        // The name of a state registered in Config.States, e.g. "verified".
+	PasswordHash string   `json:"passwordHash"` // A bcrypt hash, empty for users without a password.
+	Roles        []string `json:"roles,omitempty"`
+}
+
+// Command runs a user management command on the store configured in Config.
+// It is meant to be called from a command-line tool which sets up Config
+// (e.g. the functions accessing your database) and then passes its arguments
+// (without the program name) to this function. See the "cmd/users" directory
+// for an example. The following commands are available:
+//
+//	create [-password=...] [-verified] [-base=https://example.com] <email>
+//	verify <email>
+//	expire <email>
+//	suspend [-reason=...] [-until=YYYY-MM-DD] <email>
+//	reinstate <email>
+//	reset [-base=https://example.com] <email>
+//	delete <email>
+//	list [-query=...]
+//	export [-format=csv|json]
+//	import [-format=csv|json]
+//
+// "create" creates a new user and writes their ID to "output". If no password
+// is provided, it is read from the first line of "input". The password must
+// satisfy Config.PasswordPolicy. New users are in StateCreated and their
+// verification link, which must be passed on to them, is written to "output",
+// too, unless "-verified" is given. "suspend" and "reinstate" call Suspend()
+// and Reinstate(), respectively. "reset" generates a password reset token and
+// writes the reset link to "output". "export" writes all users to "output",
+// "import" reads users from "input" and creates all users who don't exist
+// yet. Password hashes are preserved. CSV files have the columns "id",
+// "email", "state", "passwordhash", and "roles" (separated by spaces).
+// Imported users receive new IDs.
+func Command(args []string, input io.Reader, output io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("No command provided")
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(output)
+	var (
+		password = flags.String("password", "", "the new user's password")
+		verified = flags.Bool("verified", false, "create the user in the verified state")
+		base     = flags.String("base", "https://example.com", "the base URL of reset and verification links")
+		query    = flags.String("query", "", "only list users whose email address contains this string")
+		format   = flags.String("format", "csv", "the file format, csv or json")
+		reason   = flags.String("reason", "", "the reason for the suspension")
+		until    = flags.String("until", "", "the date (YYYY-MM-DD) on which the suspension ends")
+	)
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	// Commands without a user.
+	switch args[0] {
+	case "list":
+		return commandList(output, strings.ToLower(*query))
+	case "export":
+		return commandExport(output, *format)
+	case "import":
+		return commandImport(input, output, *format)
+	case "create":
+		if flags.NArg() != 1 {
+			return errors.New("Usage: create [-password=...] [-verified] [-base=https://example.com] <email>")
+		}
+		return commandCreate(input, output, flags.Arg(0), *password, *verified, *base)
+	case "verify", "expire", "suspend", "reinstate", "reset", "delete":
+	default:
+		return fmt.Errorf("Unknown command: %s", args[0])
+	}
+
+	// Commands on an existing user.
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: %s <email>", args[0])
+	}
+	email := lookupEmail(flags.Arg(0))
+	user, err := Config.LoadUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("User not found: %s", email)
+	}
+	switch args[0] {
+	case "verify":
+		if err = ChangeState(user, StateVerified); err == nil {
+			user.SetVerificationID("", time.Unix(0, 0))
+			err = saveAndRefreshUser(user)
+		}
+	case "expire":
+		if err = ChangeState(user, StateExpired); err == nil {
+			err = saveAndRefreshUser(user)
+		}
+	case "suspend":
+		var end time.Time
+		if *until != "" {
+			if end, err = time.ParseInLocation("2006-01-02", *until, time.Local); err != nil {
+				return fmt.Errorf("Invalid suspension end: %s", err)
+			}
+		}
+		err = Suspend(user, *reason, end)
+	case "reinstate":
+		err = Reinstate(user)
+	case "reset":
+		var token string
+		token, err = sessions.RandomID(22)
+		if err != nil {
+			return err
+		}
+		user.SetPasswordToken(token, time.Now())
+		if err = Config.UpdateUser(user); err == nil {
+			fmt.Fprintf(output, "%s%s?token=%s\n", strings.TrimSuffix(*base, "/"), Config.RouteResetPassword, url.QueryEscape(token))
+		}
+	case "delete":
+		err = deleteAccount(user)
+	}
+	if err != nil {
+		return err
+	}
+	Config.Log.Printf("Command %q performed on user %s (%s)", args[0], user.GetID(), user.GetEmail())
+	return nil
+}
+
+// commandCreate creates a new user with the given password, reading it from
+// the input if it is empty. Unverified users receive a verification ID whose
+// link (starting with the given base URL) is written to the output.
+func commandCreate(input io.Reader, output io.Writer, address, password string, verified bool, base string) error {
+	email, err := NormalizeEmail(address)
+	if err != nil {
+		return fmt.Errorf("Invalid email address %s: %s", address, err)
+	}
+	if password == "" {
+		line, err := bufio.NewReader(input).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	violations, err := validatePassword(password, email)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		reasons := make([]string, 0, len(violations))
+		for _, violation := range violations {
+			reasons = append(reasons, violation.Reason)
+		}
+		return fmt.Errorf("Password rejected: %s", strings.Join(reasons, ", "))
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+	if err != nil {
+		return err
+	}
+	state := StateCreated
+	if verified {
+		state = StateVerified
+	}
+	user, err := newImportedUser(ExportedUser{Email: email, PasswordHash: string(hash)}, state)
+	if err != nil {
+		return err
+	}
+	var verificationID string
+	if !verified {
+		verificationID, err = sessions.RandomID(22)
+		if err != nil {
+			return err
+		}
+		user.SetVerificationID(verificationID, time.Now())
+	}
+	existingUser, err := Config.SaveNewUserAtomic(user)
+	if err != nil {
+		return err
+	}
+	if existingUser != nil {
+		return fmt.Errorf("User already exists: %s", email)
+	}
+	Config.Log.Printf("Command %q performed on user %s (%s)", "create", user.GetID(), user.GetEmail())
+	fmt.Fprintf(output, "%v\n", user.GetID())
+	if verificationID != "" {
+		fmt.Fprintf(output, "%s%s?id=%s\n", strings.TrimSuffix(base, "/"), Config.RouteVerify, url.QueryEscape(verificationID))
+	}
+	return nil
+}
+
+// commandList writes the users whose email addresses contain the given query
+// to the output.
+func commandList(output io.Writer, query string) error {
+	list, err := sortedUsers(query)
+	if err != nil {
+		return err
+	}
+	for _, user := range list {
+		fmt.Fprintf(output, "%s\t%s\t%v\n", user.GetEmail(), stateName(user.GetState()), user.GetID())
+	}
+	return nil
+}
+
+// commandExport writes all users to the output in the given format.
+func commandExport(output io.Writer, format string) error {
+	list, err := sortedUsers("")
+	if err != nil {
+		return err
+	}
+	exported := make([]ExportedUser, 0, len(list))
+	for _, user := range list {
+		exported = append(exported, ExportedUser{
+			ID:           fmt.Sprint(user.GetID()),
+			Email:        user.GetEmail(),
+			State:        stateName(user.GetState()),
+			PasswordHash: string(user.GetPasswordHash()),
+			Roles:        user.GetRoles(),
+		})
+	}
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(exported)
+	case "csv":
+		writer := csv.NewWriter(output)
+		writer.Write([]string{"id", "email", "state", "passwordhash", "roles"})
+		for _, user := range exported {
+			writer.Write([]string{user.ID, user.Email, user.State, user.PasswordHash, strings.Join(user.Roles, " ")})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return fmt.Errorf("Unknown format: %s", format)
+}
+
+// commandImport reads users from the input in the given format and saves all
+// users who don't exist yet.
+func commandImport(input io.Reader, output io.Writer, format string) error {
+	// Read the users.
+	var imported []ExportedUser
+	switch format {
+	case "json":
+		if err := json.NewDecoder(input).Decode(&imported); err != nil {
+			return err
+		}
+	case "csv":
+		records, err := csv.NewReader(input).ReadAll()
+		if err != nil {
+			return err
+		}
+		for index, record := range records {
+			if index == 0 && len(record) > 1 && record[1] == "email" {
+				continue // Header.
+			}
+			if len(record) < 4 {
+				return fmt.Errorf("Line %d: expected at least 4 columns", index+1)
+			}
+			user := ExportedUser{ID: record[0], Email: record[1], State: record[2], PasswordHash: record[3]}
+			if len(record) > 4 {
+				user.Roles = strings.Fields(record[4])
+			}
+			imported = append(imported, user)
+		}
+	default:
+		return fmt.Errorf("Unknown format: %s", format)
+	}
+
+	// Save them.
+	var created, skipped int
+	for index, entry := range imported {
+		state, ok := parseStateName(entry.State)
+		if !ok {
+			return fmt.Errorf("User %d (%s): unknown state %q", index+1, entry.Email, entry.State)
+		}
+		if entry.PasswordHash != "" { // Users without a password have no hash.
+			if _, err := bcrypt.Cost([]byte(entry.PasswordHash)); err != nil {
+				return fmt.Errorf("User %d (%s): invalid password hash: %s", index+1, entry.Email, err)
+			}
+		}
+		user, err := newImportedUser(entry, state)
+		if err != nil {
+			return fmt.Errorf("User %d (%s): %s", index+1, entry.Email, err)
+		}
+		existingUser, err := Config.SaveNewUserAtomic(user)
+		if err != nil {
+			return fmt.Errorf("User %d (%s): %s", index+1, entry.Email, err)
+		}
+		if existingUser != nil {
+			skipped++
+			continue
+		}
+		created++
+	}
+	Config.Log.Printf("Imported %d users, skipped %d existing users", created, skipped)
+	fmt.Fprintf(output, "%d users imported, %d existing users skipped\n", created, skipped)
+	return nil
+}
+
+// newImportedUser returns a new user (created with Config.NewUser) with the
+// fields of the given exported user and the given state.
+func newImportedUser(entry ExportedUser, state int) (User, error) {
+	if Config.NewUser == nil {
+		return nil, errors.New("NewUser is not implemented")
+	}
+	email, err := NormalizeEmail(entry.Email)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid email address %s: %s", entry.Email, err)
+	}
+	user := Config.NewUser()
+	user.SetEmail(email)
+	user.SetState(state)
+	user.SetPasswordHash([]byte(entry.PasswordHash))
+	if len(entry.Roles) > 0 {
+		if roleUser, ok := user.(RoleUser); ok {
+			roleUser.SetRoles(entry.Roles)
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,127 @@
+package users
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// runCommand runs Command() with the given input and returns its output.
+func runCommand(input string, args ...string) (string, error) {
+	var output bytes.Buffer
+	err := Command(args, strings.NewReader(input), &output)
+	return output.String(), err
+}
+
+func TestCommand(t *testing.T) {
+	backup := users
+	users = nil
+	defer func() {
+		users = backup
+	}()
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		for _, user := range users {
+			if lookupEmail(user.GetEmail()) == email {
+				return user, nil
+			}
+		}
+		return nil, nil
+	}
+
+	// Create.
+	if _, err := runCommand("", "create", "-password=12345", "a@x"); err == nil || !strings.Contains(err.Error(), PasswordTooShort) {
+		t.Errorf("Expected password rejection, got %v", err)
+	}
+	output, err := runCommand("correct horse battery\n", "create", "-base=https://x.com/", "A@x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verificationID, _ := users[0].GetVerificationID()
+	if verificationID == "" {
+		t.Fatal("Unverified user has no verification ID")
+	}
+	assertString(users[0].GetID().(string)+"\nhttps://x.com"+Config.RouteVerify+"?id="+verificationID+"\n", output, t)
+	if _, err := runCommand("", "create", "-password=correct horse battery", "-verified", "b@x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCommand("", "create", "-password=correct horse battery", "a@x"); err == nil {
+		t.Error("Expected error for existing user")
+	}
+	output, _ = runCommand("", "list")
+	assertString("A@x\tcreated\t"+users[0].GetID().(string)+"\nb@x\tverified\t"+users[1].GetID().(string)+"\n", output, t)
+
+	// State changes.
+	if _, err := runCommand("", "verify", "a@x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCommand("", "expire", "b@x"); err != nil {
+		t.Fatal(err)
+	}
+	output, _ = runCommand("", "list", "-query=b")
+	assertString("b@x\texpired\t"+users[1].GetID().(string)+"\n", output, t)
+	if _, err := runCommand("", "verify", "c@x"); err == nil {
+		t.Error("Expected error for unknown user")
+	}
+
+	// Reset link.
+	output, _ = runCommand("", "reset", "-base=https://example.org/", "a@x")
+	token, _ := users[0].GetPasswordToken()
+	assertString("https://example.org"+Config.RouteResetPassword+"?token="+token+"\n", output, t)
+
+	// Delete.
+	if _, err := runCommand("", "delete", "b@x"); err != nil {
+		t.Fatal(err)
+	}
+	output, _ = runCommand("", "list")
+	assertString("A@x\tverified\t"+users[0].GetID().(string)+"\n", output, t)
+
+	if _, err := runCommand("", "unknown"); err == nil {
+		t.Error("Expected error for unknown command")
+	}
+}
+
+func TestCommandImportExport(t *testing.T) {
+	backup := users
+	users = []User{&MyUser{id: "1", email: "a@x", state: StateVerified, passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"), roles: []string{"admin", "editor"}}}
+	defer func() {
+		users = backup
+	}()
+
+	for _, format := range []string{"csv", "json"} {
+		exported, err := runCommand("", "export", "-format="+format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = []User{&MyUser{id: "2", email: "b@x"}}
+		output, err := runCommand(exported+"\n", "import", "-format="+format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertString("1 users imported, 0 existing users skipped\n", output, t)
+		output, _ = runCommand(exported, "import", "-format="+format)
+		assertString("0 users imported, 1 existing users skipped\n", output, t)
+		if len(users) != 2 {
+			t.Fatalf("Expected 2 users, got %d", len(users))
+		}
+		user := users[1].(*MyUser)
+		assertString("a@x", user.email, t)
+		assertString("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC", string(user.passwordHash), t)
+		assertString("admin editor", strings.Join(user.roles, " "), t)
+		if user.state != StateVerified {
+			t.Errorf("Expected verified user, got state %d", user.state)
+		}
+		users = []User{user}
+	}
+
+	if _, err := runCommand("id,email,state,passwordhash\n1,c@x,created,nohash\n", "import"); err == nil {
+		t.Error("Expected error for invalid hash")
+	}
+	output, err := runCommand("id,email,state,passwordhash\n1,d@x,verified,\n", "import")
+	if err != nil {
+		t.Fatalf("Users without a password were not imported: %s", err)
+	}
+	assertString("1 users imported, 0 existing users skipped\n", output, t)
+	if _, err := runCommand("1,c@x,unknown,$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC\n", "import"); err == nil {
+		t.Error("Expected error for invalid state")
+	}
+}
@@ -1,7 +1,10 @@
 package users
 
 import (
+	"bytes"
+	"crypto/x509"
 	"log"
+	"net/http"
 	"os"
 	"sync"
 	"time"
@@ -17,10 +20,178 @@ var Config = struct {
 	// The logger to which messages produced in this package are sent.
 	Log *log.Logger
 
-	// A list of names to exclude from passwords. This is typically the name of
-	// your application, its domain name etc.
+	// The policy which new passwords must satisfy. See NISTPasswordPolicy for
+	// the default implementation.
+	PasswordPolicy PasswordPolicy
+
+	// A list of names to exclude from passwords. They are checked by
+	// NISTPasswordPolicy in addition to its ContextWords.
+	//
+	// Deprecated: Use NISTPasswordPolicy.ContextWords instead.
 	PasswordNames []string
 
+	// If set, new passwords are also checked against this corpus of breached
+	// passwords. Users who log in with a password found in the corpus are
+	// flagged for a forced password change (if they implement the
+	// PasswordChangeUser interface).
+	BreachedPasswords *BreachedPasswords
+
+	// The number of most recent passwords (including the current one) which
+	// users may not choose again when changing or resetting their password.
+	// Previous passwords are only remembered for users implementing the
+	// PasswordHistoryUser interface. A value of 0 turns this check off.
+	PasswordHistory int
+
+	// The maximum age of a password. Users whose password is older must choose
+	// a new password after logging in. Password ages are only known for users
+	// implementing the PasswordAgeUser interface. A value of 0 means that
+	// passwords never expire.
+	PasswordMaxAge time.Duration
+
+	// The time before a password expires at which a reminder email is sent. See
+	// SendPasswordExpiryReminders() for details. A value of 0 means that no
+	// reminders are sent.
+	PasswordExpiryReminder time.Duration
+
+	// The issuer name shown in authenticator apps for two-factor
+	// authentication. This is typically the name of your application.
+	TOTPIssuer string
+
+	// How long users who check the "remember" box on the login form stay
+	// logged in on their device. Devices are only remembered for users
+	// implementing the RememberUser interface. A value of 0 removes this option.
+	RememberMe time.Duration
+
+	// How long the login links sent by MagicLink() are valid, e.g. 15 minutes.
+	// Magic links are only available for users implementing the MagicLinkUser
+	// interface. A value of 0 turns magic links off.
+	MagicLinkValidity time.Duration
+
+	// How long users who must choose a new password when logging in (see
+	// ChangePassword()) may take to do so, e.g. 15 minutes. After that, they
+	// have to log in again.
+	PasswordChangeValidity time.Duration
+
+	// The number of digits of the codes included in verification and password
+	// reset emails, which users may enter instead of clicking on the link in
+	// the email. A value of 0 turns codes off. If EmailLinks is false, the
+	// emails contain only the code.
+	EmailCodeDigits int
+	EmailLinks      bool
+
+	// The number of wrong attempts after which an email code (and the
+	// corresponding link) becomes invalid.
+	EmailCodeAttempts int
+
+	// WebAuthn (passkey) settings. The relying party ID is the domain of your
+	// application, the origins are the full origins (scheme, host, and port)
+	// from which WebAuthn requests are accepted.
+	WebAuthnRPID    string
+	WebAuthnRPName  string
+	WebAuthnOrigins []string
+
+	// The attestation conveyance preference ("none", "indirect", or "direct")
+	// requested during registration, the attestation statement formats which
+	// are accepted ("none" and "packed" are supported), and an optional policy
+	// function which may reject an authenticator based on its attestation
+	// format, its AAGUID, and its attestation certificates (nil if the
+	// authenticator did not provide any).
+	WebAuthnAttestation        string
+	WebAuthnAttestationFormats []string
+	WebAuthnAttestationPolicy  func(format string, aaguid []byte, certificates []*x509.Certificate) error
+
+	// The user verification requirement ("required", "preferred", or
+	// "discouraged") for WebAuthn credentials.
+	WebAuthnUserVerification string
+
+	// If true, users may log in with a WebAuthn credential only, without
+	// entering their password. Such credentials must always verify the user.
+	WebAuthnPasswordless bool
+
+	// If true, all POST requests to this package's handlers must contain the
+	// CSRF token stored in the user's session (in the "csrf" form field or the
+	// "X-CSRF-Token" header) and must not come from another origin. Templates
+	// receive the token under the "csrf" key. Origins other than the request's
+	// own host which may post forms can be added to CSRFTrustedOrigins (full
+	// origins, e.g. "https://www.example.com").
+	CSRFProtection     bool
+	CSRFTrustedOrigins []string
+
+	// If set and returning true for a request, that request is not checked for
+	// CSRF. Use this for API clients which authenticate without cookies, e.g.
+	// with an "Authorization" header.
+	CSRFExempt func(request *http.Request) bool
+
+	// The local paths to which users may be sent back after logging in, via the
+	// "next" parameter (see LogInURL()). A "next" path must start with one of
+	// these prefixes. Other values are ignored to prevent open redirects.
+	NextPaths []string
+
+	// The states users may be in, mapped by their values (see State). Add your
+	// own states to this map.
+	States map[int]State
+
+	// The roles which may be assigned to users, mapped by their names. See Can()
+	// and RequirePermission() for permission checks.
+	Roles map[string]Role
+
+	// The permission (see Roles) required to access the user administration at
+	// RouteAdmin, and the number of users shown per page there.
+	AdminPermission string
+	AdminPageSize   int
+
+	// The maximum time an administrator may impersonate a user (see Admin()). A
+	// value of 0 turns impersonation off.
+	ImpersonationDuration time.Duration
+
+	// The time before a user's account expires (see ExpiryUser) at which a
+	// reminder email is sent. See SendAccountExpiryReminders() for details. A
+	// value of 0 means that no reminders are sent.
+	AccountExpiryReminder time.Duration
+
+	// If true, users who verified their email address after signing up are put
+	// into StatePendingApproval until an administrator approves them (see
+	// Approve() and Reject()). Administrators are notified by an email to
+	// ApprovalEmail and/or by a call to ApprovalRequested. Users must implement
+	// the ApprovalUser interface, otherwise sign-ups fail. Existing users are
+	// not held for approval when they change their email address.
+	SignUpApproval bool
+	ApprovalEmail  string
+
+	// The domains from which email addresses are accepted when signing up,
+	// changing the email address, or inviting users (administrators are
+	// exempt from the latter), including their subdomains. If empty, all
+	// domains are accepted except the ones in BlockedDomains.
+	AllowedDomains []string
+
+	// The domains (including their subdomains) from which email addresses are
+	// rejected when signing up or changing the email address.
+	BlockedDomains []string
+
+	// If true, email addresses from providers of disposable addresses are
+	// rejected when signing up or changing the email address. These are the
+	// domains in DisposableDomains as well as the ones listed in
+	// DisposableDomainsFile (one per line, lines starting with "#" are
+	// ignored). The file is read again when it was modified.
+	BlockDisposableDomains bool
+	DisposableDomainsFile  string
+
+	// If true, the public sign-up (see SignUp()) is closed and new users can
+	// only join by accepting an invitation (see Invite()).
+	InviteOnly bool
+
+	// The duration for which invitations can be accepted.
+	InvitationValidity time.Duration
+
+	// The permission required to send invitations (see Invite()). If empty,
+	// all users in a state granting access may invite others.
+	InvitePermission string
+
+	// The time between a user's request to delete their account (see
+	// DeleteAccount()) and its final deletion, during which the user may cancel
+	// the deletion. A value of 0 deletes accounts immediately.
+	DeletionGracePeriod time.Duration
+
 	// Routes.
 	RouteSignUp            string // The signup page.
 	RouteVerify            string // The page where the user verifies their email address.
@@ -31,6 +202,23 @@ var Config = struct {
 	RouteForgottenPassword string // The forgotten password page.
 	RouteResetPassword     string // The page where the user can choose a new password.
 	RouteChange            string // The page where the user can change their email address and/or password.
+	RoutePasswordChange    string // The page where users with an expired password must choose a new one.
+	RouteTOTPEnroll        string // The page where users enable two-factor authentication.
+	RouteTOTPChallenge     string // The page where users enter their second factor during login.
+	RouteTOTPDisable       string // The page where users disable two-factor authentication.
+	RouteWebAuthnRegister  string // The page where users manage their passkeys.
+	RouteWebAuthnLogIn     string // The page where users log in with a passkey.
+	RouteRememberedDevices string // The page where users view and revoke the devices on which they stay logged in.
+	RouteMagicLink         string // The page where users request a magic login link.
+	RouteMagicLogIn        string // The target of magic login links.
+	RouteAdmin             string // The administration page for managing users.
+	RouteStopImpersonation string // The page where administrators stop impersonating a user.
+	RouteDeleteAccount     string // The page where users delete their account.
+	RouteCancelDeletion    string // The target of links which cancel an account deletion.
+	RouteExportAccount     string // The page where users download their account data.
+	RouteInvite            string // The page where users invite others and manage their invitations.
+	RouteAcceptInvitation  string // The target of invitation links.
+	RouteRenewal           string // The page to which users with an expired account are redirected (provided by your application, none if empty).
 
 	// Template settings.
 	CacheTemplates       bool // If true, templates are cached after their first use.
@@ -74,7 +262,8 @@ var Config = struct {
 	// SaveNewUserAtomic saves a new user to the database. If a user with the same
 	// email address previously existed, that existing user is returned (and the
 	// new user is not saved). If no such user previously existed, they are saved
-	// and a nil interface is returned.
+	// and a nil interface is returned. Email addresses are the same if their
+	// canonical forms (see CanonicalEmail()) are equal.
 	//
 	// Checking for the existence of a user and inserting them needs to be an
 	// atomic transaction to avoid the duplication of users due to race
@@ -93,14 +282,93 @@ var Config = struct {
 	// was found, it's not an error, just nil is returned.
 	LoadUserByPasswordToken func(token string) (User, error)
 
-	// LoadUserByEmail loads a user given their email address. If no user was
-	// found, it's not an error, just nil is returned.
+	// LoadUserByLoginToken loads a user given a login token (see
+	// MagicLinkUser). If no user was found, it's not an error, just nil is
+	// returned.
+	LoadUserByLoginToken func(token string) (User, error)
+
+	// LoadUserByDeletionToken loads a user given a deletion token (see
+	// DeletionUser). If no user was found, it's not an error, just nil is
+	// returned.
+	LoadUserByDeletionToken func(token string) (User, error)
+
+	// LoadUserByEmail loads a user given the canonical form of their email
+	// address (see CanonicalEmail()), which must be compared with the canonical
+	// form of the stored addresses. If no user was found, it's not an error,
+	// just nil is returned.
 	LoadUserByEmail func(email string) (User, error)
 
+	// LoadUserByWebAuthnCredential loads the user who registered the WebAuthn
+	// credential with the given ID. If no user was found, it's not an error,
+	// just nil is returned.
+	LoadUserByWebAuthnCredential func(id []byte) (User, error)
+
+	// LoadUserByRememberedDevice loads the user who chose to stay logged in on
+	// the device with the given ID (see RememberedDevice). If no user was found,
+	// it's not an error, just nil is returned.
+	LoadUserByRememberedDevice func(id string) (User, error)
+
+	// ForEachUser calls the given function for each user in the database. If
+	// the function returns an error, the iteration is stopped and that error is
+	// returned. This is used by functions which need to be run periodically,
+	// e.g. SendPasswordExpiryReminders().
+	ForEachUser func(callback func(user User) error) error
+
+	// DeleteUser removes an existing user (identified by their user ID) from the
+	// database.
+	DeleteUser func(user User) error
+
+	// SaveInvitation saves a new invitation (see Invite()).
+	SaveInvitation func(invitation *Invitation) error
+
+	// LoadInvitation loads an invitation given its token. If no invitation was
+	// found, it's not an error, just nil is returned.
+	LoadInvitation func(token string) (*Invitation, error)
+
+	// DeleteInvitation removes an invitation (identified by its token) after
+	// it was accepted or revoked.
+	DeleteInvitation func(token string) error
+
+	// ForEachInvitation calls the given function for each pending invitation.
+	// If the function returns an error, the iteration stops and that error is
+	// returned.
+	ForEachInvitation func(callback func(invitation *Invitation) error) error
+
+	// DeleteUserData is called before a user is deleted with DeleteUser, e.g.
+	// when their account deletion was completed (see DeleteAccount()) or by an
+	// administrator. Use it to remove the user's application data. If it
+	// returns an error, the user is not deleted.
+	DeleteUserData func(user User) error
+
+	// ExportUserData returns the user's application data to be included in the
+	// export downloaded by ExportAccount(). The result is encoded as JSON.
+	ExportUserData func(user User) (interface{}, error)
+
 	// LoggedIn is called when a user was successfully logged in from a browser
 	// at the given IP address.
 	LoggedIn func(user User, ipAddress string)
 
+	// AdminAction is called after an administrator (see Admin()) performed the
+	// given action ("verify", "expire", "suspend", "reinstate", "approve",
+	// "reject", "reset", "logout", "delete", "impersonate", or
+	// "stopimpersonation") on the given user. Use it to keep an audit trail.
+	// All actions are also logged to Config.Log.
+	AdminAction func(admin, user User, action string)
+
+	// ApprovalRequested is called when a user is awaiting approval (see
+	// Config.SignUpApproval).
+	ApprovalRequested func(user User)
+
+	// ExtendExpiry is called when the account of a user implementing the
+	// ExpiryUser interface is about to expire. If it returns a time in the
+	// future, e.g. because your billing system renewed the user's subscription,
+	// the expiry is moved to that time instead.
+	ExtendExpiry func(user User) (time.Time, error)
+
+	// StateTransition is called before a user's state is changed (see
+	// ChangeState()). If it returns an error, the state is not changed.
+	StateTransition func(user User, from, to int) error
+
 	// ThrottleVerification throttles verification attempts. The default
 	// implementation simply pauses all verification requests by one second.
 	ThrottleVerification func()
@@ -111,7 +379,6 @@ var Config = struct {
 }{
 	ServerAddr:             ":5050",
 	Log:                    log.New(os.Stdout, "", log.LstdFlags),
-	PasswordNames:          []string{"example.com", "ExampleCom", "Example"},
 	RouteSignUp:            "/signup",
 	RouteVerify:            "/verify",
 	RouteLogIn:             "/login",
@@ -121,6 +388,23 @@ var Config = struct {
 	RouteForgottenPassword: "/forgottenpassword",
 	RouteResetPassword:     "/resetpassword",
 	RouteChange:            "/changeinfos",
+	RoutePasswordChange:    "/changepassword",
+	RouteTOTPEnroll:        "/totpenroll",
+	RouteTOTPChallenge:     "/totp",
+	RouteTOTPDisable:       "/totpdisable",
+	RouteWebAuthnRegister:  "/passkeys",
+	RouteWebAuthnLogIn:     "/passkeylogin",
+	RouteRememberedDevices: "/devices",
+	RouteMagicLink:         "/magiclink",
+	RouteMagicLogIn:        "/magiclogin",
+	RouteAdmin:             "/admin/users",
+	RouteStopImpersonation: "/admin/return",
+	RouteDeleteAccount:     "/deleteaccount",
+	RouteCancelDeletion:    "/canceldeletion",
+	RouteExportAccount:     "/exportaccount",
+	RouteInvite:            "/invite",
+	RouteAcceptInvitation:  "/invitation",
+	RouteRenewal:           "",
 	CacheTemplates:         false,
 	HTMLTemplateDir:        "src/github.com/rivo/sessions/users/html",
 	HTMLTemplateIncludes:   []string{"header.gohtml", "footer.gohtml"},
@@ -136,11 +420,63 @@ var Config = struct {
 	SMTPUsername:           "support@example.com",
 	SMTPPassword:           "password",
 	NewUser:                nil,
+	PasswordPolicy: &NISTPasswordPolicy{
+		MinLength:    8,
+		MaxLength:    64,
+		ContextWords: []string{"example.com", "ExampleCom", "Example"},
+	},
+	PasswordNames:              nil,
+	BreachedPasswords:          nil,
+	PasswordHistory:            0,
+	PasswordMaxAge:             0,
+	PasswordExpiryReminder:     14 * 24 * time.Hour,
+	TOTPIssuer:                 "Example.com",
+	RememberMe:                 30 * 24 * time.Hour,
+	MagicLinkValidity:          0,
+	PasswordChangeValidity:     15 * time.Minute,
+	EmailCodeDigits:            0,
+	EmailLinks:                 true,
+	EmailCodeAttempts:          5,
+	WebAuthnRPID:               "example.com",
+	WebAuthnRPName:             "Example.com",
+	WebAuthnOrigins:            []string{"https://example.com"},
+	WebAuthnAttestation:        "none",
+	WebAuthnAttestationFormats: []string{"none", "packed"},
+	WebAuthnAttestationPolicy:  nil,
+	WebAuthnUserVerification:   "preferred",
+	WebAuthnPasswordless:       false,
+	CSRFProtection:             true,
+	CSRFTrustedOrigins:         nil,
+	CSRFExempt:                 nil,
+	NextPaths:                  []string{"/"},
+	States: map[int]State{
+		StateCreated:         {Name: "created"},
+		StateVerified:        {Name: "verified", LogIn: true, Access: true},
+		StateExpired:         {Name: "expired", LogIn: true},
+		StateSuspended:       {Name: "suspended"},
+		StatePendingApproval: {Name: "pendingapproval"},
+	},
+	Roles:                  nil,
+	AdminPermission:        "users.admin",
+	AdminPageSize:          50,
+	ImpersonationDuration:  30 * time.Minute,
+	AccountExpiryReminder:  0,
+	SignUpApproval:         false,
+	ApprovalEmail:          "",
+	AllowedDomains:         nil,
+	BlockedDomains:         nil,
+	BlockDisposableDomains: true,
+	DisposableDomainsFile:  "",
+	InviteOnly:             false,
+	InvitationValidity:     7 * 24 * time.Hour,
+	InvitePermission:       "users.invite",
+	DeletionGracePeriod:    14 * 24 * time.Hour,
 	SaveNewUserAtomic: func(user User) (User, error) {
 		usersMutex.Lock()
 		defer usersMutex.Unlock()
+		email := lookupEmail(user.GetEmail())
 		for _, existingUser := range users {
-			if existingUser.GetEmail() == user.GetEmail() {
+			if lookupEmail(existingUser.GetEmail()) == email {
 				return existingUser, nil
 			}
 		}
@@ -180,17 +516,129 @@ var Config = struct {
 		}
 		return nil, nil
 	},
+	LoadUserByLoginToken: func(token string) (User, error) {
+		usersMutex.RLock()
+		defer usersMutex.RUnlock()
+		for _, user := range users {
+			if magicUser, ok := user.(MagicLinkUser); ok {
+				if t, _ := magicUser.GetLoginToken(); t == token {
+					return user, nil
+				}
+			}
+		}
+		return nil, nil
+	},
+	LoadUserByDeletionToken: func(token string) (User, error) {
+		usersMutex.RLock()
+		defer usersMutex.RUnlock()
+		for _, user := range users {
+			if deletionUser, ok := user.(DeletionUser); ok {
+				if t, _ := deletionUser.GetDeletionToken(); t == token {
+					return user, nil
+				}
+			}
+		}
+		return nil, nil
+	},
 	LoadUserByEmail: func(email string) (User, error) {
 		usersMutex.RLock()
 		defer usersMutex.RUnlock()
+		email = lookupEmail(email)
 		for _, user := range users {
-			if user.GetEmail() == email {
+			if lookupEmail(user.GetEmail()) == email {
 				return user, nil
 			}
 		}
 		return nil, nil
 	},
-	LoggedIn: nil,
+	LoadUserByWebAuthnCredential: func(id []byte) (User, error) {
+		usersMutex.RLock()
+		defer usersMutex.RUnlock()
+		for _, user := range users {
+			if webAuthnUser, ok := user.(WebAuthnUser); ok {
+				for _, credential := range webAuthnUser.GetWebAuthnCredentials() {
+					if bytes.Equal(credential.ID, id) {
+						return user, nil
+					}
+				}
+			}
+		}
+		return nil, nil
+	},
+	LoadUserByRememberedDevice: func(id string) (User, error) {
+		usersMutex.RLock()
+		defer usersMutex.RUnlock()
+		for _, user := range users {
+			if rememberUser, ok := user.(RememberUser); ok {
+				for _, device := range rememberUser.GetRememberedDevices() {
+					if device.ID == id {
+						return user, nil
+					}
+				}
+			}
+		}
+		return nil, nil
+	},
+	ForEachUser: func(callback func(user User) error) error {
+		usersMutex.RLock()
+		list := append([]User{}, users...)
+		usersMutex.RUnlock()
+		for _, user := range list {
+			if err := callback(user); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	DeleteUser: func(user User) error {
+		usersMutex.Lock()
+		defer usersMutex.Unlock()
+		for index, existingUser := range users {
+			if existingUser.GetID() == user.GetID() {
+				users = append(users[:index], users[index+1:]...)
+				return nil
+			}
+		}
+		return nil
+	},
+	SaveInvitation: func(invitation *Invitation) error {
+		invitationsMutex.Lock()
+		defer invitationsMutex.Unlock()
+		invitations[invitation.Token] = invitation
+		return nil
+	},
+	LoadInvitation: func(token string) (*Invitation, error) {
+		invitationsMutex.RLock()
+		defer invitationsMutex.RUnlock()
+		return invitations[token], nil
+	},
+	DeleteInvitation: func(token string) error {
+		invitationsMutex.Lock()
+		defer invitationsMutex.Unlock()
+		delete(invitations, token)
+		return nil
+	},
+	ForEachInvitation: func(callback func(invitation *Invitation) error) error {
+		invitationsMutex.RLock()
+		list := make([]*Invitation, 0, len(invitations))
+		for _, invitation := range invitations {
+			list = append(list, invitation)
+		}
+		invitationsMutex.RUnlock()
+		for _, invitation := range list {
+			if err := callback(invitation); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	LoggedIn:          nil,
+	AdminAction:       nil,
+	DeleteUserData:    nil,
+	ApprovalRequested: nil,
+	ExtendExpiry:      nil,
+	StateTransition:   nil,
+	ExportUserData:    nil,
 	ThrottleVerification: func() {
 		pauseMutex.Lock()
 		time.Sleep(time.Second)
@@ -0,0 +1,127 @@
+package users
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rivo/sessions"
+)
+
+// csrfToken returns the CSRF token of the current session, creating the
+// session and the token if necessary. An empty string is returned if CSRF
+// protection is turned off or if the token could not be created.
+func csrfToken(response http.ResponseWriter, request *http.Request) string {
+	if !Config.CSRFProtection {
+		return ""
+	}
+	session, err := sessions.Start(response, request, true)
+	if err != nil || session == nil {
+		Config.Log.Printf("Could not start session for CSRF token: %s", err)
+		return ""
+	}
+	if token, ok := session.Get(sessionKeyCSRF, "").(string); ok && token != "" {
+		return token
+	}
+	token, err := sessions.RandomID(32)
+	if err != nil {
+		Config.Log.Printf("Could not generate CSRF token: %s", err)
+		return ""
+	}
+	if err := session.Set(sessionKeyCSRF, token); err != nil {
+		Config.Log.Printf("Could not save CSRF token: %s", err)
+		return ""
+	}
+	return token
+}
+
+// addCSRFToken adds the CSRF token under the "csrf" key to the given template
+// data if it is a map and doesn't contain a token yet.
+func addCSRFToken(response http.ResponseWriter, request *http.Request, data interface{}) {
+	m, ok := data.(map[string]interface{})
+	if !ok || !Config.CSRFProtection {
+		return
+	}
+	if _, ok := m["csrf"]; !ok {
+		m["csrf"] = csrfToken(response, request)
+	}
+}
+
+// checkCSRF checks a state-changing request for cross-site request forgery.
+// GET, HEAD, and OPTIONS requests, requests exempted by Config.CSRFExempt, and
+// all requests when Config.CSRFProtection is false always pass. Other requests
+// must come from the same (or a trusted) origin and must provide the session's
+// CSRF token. If the check fails, the "csrfinvalid.gohtml" template is
+// rendered with a Forbidden HTTP header and false is returned.
+func checkCSRF(response http.ResponseWriter, request *http.Request) bool {
+	if !Config.CSRFProtection {
+		return true
+	}
+	switch request.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if Config.CSRFExempt != nil && Config.CSRFExempt(request) {
+		return true
+	}
+
+	// Check the origin of the request.
+	reason := ""
+	if !sameOrigin(request) {
+		reason = "cross-site origin " + request.Header.Get("Origin")
+	} else {
+		// Check the token.
+		var expected string
+		session, err := sessions.Start(response, request, false)
+		if err != nil {
+			RenderProgramError(response, request, "Could not start session for CSRF check", "", err)
+			return false
+		}
+		if session != nil {
+			expected, _ = session.Get(sessionKeyCSRF, "").(string)
+		}
+		token := request.PostFormValue("csrf")
+		if token == "" {
+			token = request.Header.Get("X-CSRF-Token")
+		}
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			reason = "invalid token"
+		}
+	}
+	if reason == "" {
+		return true
+	}
+
+	Config.Log.Printf("CSRF check failed on %s: %s", request.RequestURI, reason)
+	data := map[string]interface{}{"config": Config}
+	addCSRFToken(response, request, data)
+	response.WriteHeader(http.StatusForbidden)
+	RenderPage(response, request, "csrfinvalid.gohtml", data)
+	return false
+}
+
+// sameOrigin returns false if the browser indicated that the request was sent
+// from another site, via the "Sec-Fetch-Site" or the "Origin" header, and that
+// origin is not listed in Config.CSRFTrustedOrigins.
+func sameOrigin(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	for _, trusted := range Config.CSRFTrustedOrigins {
+		if origin != "" && strings.EqualFold(origin, trusted) {
+			return true
+		}
+	}
+	switch request.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	if origin == "" {
+		return true // Older browsers. We rely on the token.
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false // Includes the "null" origin.
+	}
+	return strings.EqualFold(u.Host, request.Host)
+}
@@ -0,0 +1,108 @@
+package users
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	Config.CSRFProtection = true
+	defer func() {
+		Config.CSRFProtection = false
+	}()
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return nil, nil
+	}
+
+	// GET requests always pass.
+	computed, _ := runRequest(nil, nil, nil, ForgottenPassword)
+	assertString("HOFPF", computed, t)
+
+	// No token.
+	computed, mail := runRequest(nil, nil, map[string]string{"email": "a@b"}, ForgottenPassword)
+	assertString("HOCSRFF", computed, t)
+	assertString("", mail, t)
+
+	// Wrong token.
+	session := map[string]interface{}{sessionKeyCSRF: "token"}
+	computed, _ = runSessionRequest(nil, session, nil, map[string]string{"email": "a@b", "csrf": "wrong"}, ForgottenPassword)
+	assertString("HOCSRFF", computed, t)
+
+	// Correct token.
+	computed, mail = runSessionRequest(nil, session, nil, map[string]string{"email": "a@b", "csrf": "token"}, ForgottenPassword)
+	assertString("HOLSa@bF", computed, t)
+	assertString("RU", mail, t)
+}
+
+func TestCSRFToken(t *testing.T) {
+	Config.CSRFProtection = true
+	defer func() {
+		Config.CSRFProtection = false
+	}()
+	request := httptest.NewRequest("GET", "/test", nil)
+	response := httptest.NewRecorder()
+	data := map[string]interface{}{}
+	addCSRFToken(response, request, data)
+	token, _ := data["csrf"].(string)
+	if token == "" {
+		t.Fatal("No CSRF token generated")
+	}
+	if response.Result().Cookies()[0].Name != "id" {
+		t.Error("No session cookie set")
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	for index, test := range []struct {
+		origin, site string
+		trusted      []string
+		result       bool
+	}{
+		{"", "", nil, true},
+		{"", "same-origin", nil, true},
+		{"", "none", nil, true},
+		{"", "cross-site", nil, false},
+		{"", "same-site", nil, false},
+		{"https://example.com", "same-origin", nil, true},
+		{"https://EXAMPLE.com", "", nil, true},
+		{"https://evil.com", "", nil, false},
+		{"null", "", nil, false},
+		{"https://www.example.com", "same-site", []string{"https://www.example.com"}, true},
+	} {
+		Config.CSRFTrustedOrigins = test.trusted
+		request := httptest.NewRequest("POST", "https://example.com/test", strings.NewReader(url.Values{}.Encode()))
+		if test.origin != "" {
+			request.Header.Set("Origin", test.origin)
+		}
+		if test.site != "" {
+			request.Header.Set("Sec-Fetch-Site", test.site)
+		}
+		if sameOrigin(request) != test.result {
+			t.Errorf("Test %d failed, expected %t", index, test.result)
+		}
+	}
+	Config.CSRFTrustedOrigins = nil
+}
+
+func TestCSRFExempt(t *testing.T) {
+	Config.CSRFProtection = true
+	Config.CSRFExempt = func(request *http.Request) bool {
+		return request.Header.Get("Authorization") != ""
+	}
+	defer func() {
+		Config.CSRFProtection = false
+		Config.CSRFExempt = nil
+	}()
+	request := httptest.NewRequest("POST", "/test", nil)
+	request.Header.Set("Origin", "https://evil.com")
+	if checkCSRF(httptest.NewRecorder(), request) {
+		t.Error("Cross-site request accepted")
+	}
+	request.Header.Set("Authorization", "Bearer 123")
+	if !checkCSRF(httptest.NewRecorder(), request) {
+		t.Error("Exempted request rejected")
+	}
+}
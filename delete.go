@@ -0,0 +1,346 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rivo/sessions"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DeletionUser is an optional extension of the User interface. Users
+// implementing it may close their account themselves (see DeleteAccount()).
+type DeletionUser interface {
+	// Deletion tokens (a 22 character long string and the time the deletion
+	// was requested) are used in the links which cancel a pending deletion. An
+	// empty token means that no deletion is pending.
+	SetDeletionToken(token string, requested time.Time)
+	GetDeletionToken() (string, time.Time)
+}
+
+// DeleteAccount lets a logged-in user close their account. Upon a GET request,
+// the "deleteaccount.gohtml" template is rendered. Upon a POST request, the
+// user's current password is checked and, if correct, the deletion is
+// requested: The user is logged out on all devices and an email containing a
+// link to cancel the deletion is sent (using the "deletion_requested.tmpl" mail
+// template). The "deletionrequested.gohtml" template is then rendered. The
+// account is deleted by DeleteRequestedAccounts() once
+// Config.DeletionGracePeriod has passed. If the grace period is 0, the account
+// is deleted immediately. Logging in again during the grace period also
+// cancels the deletion.
+//
+// This page is only available for users implementing the DeletionUser
+// interface. Administrators impersonating a user (see Admin()) cannot use it.
+func DeleteAccount(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	if blockImpersonation(response, request) {
+		return
+	}
+
+	// This page only works if the user is logged in.
+	user, session, _ := IsLoggedIn(response, request)
+	if user == nil {
+		RenderProgramError(response, request, "This page may only be accessed when you are logged in", "", nil)
+		return
+	}
+	deletionUser, ok := user.(DeletionUser)
+	if !ok {
+		RenderProgramError(response, request, "User does not implement the DeletionUser interface", "Account deletion is not available", nil)
+		return
+	}
+
+	if request.Method == "GET" {
+		RenderPageBasic(response, request, "deleteaccount.gohtml", user)
+		return
+	}
+
+	// Validate the current password.
+	currentPassword := request.PostFormValue("currentpassword")
+	if currentPassword == "" {
+		Config.Log.Printf("User %s (%s) tried to delete their account, current password not provided", user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "deleteaccount.gohtml", "currentpasswordnotprovided", nil, user)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword(user.GetPasswordHash(), []byte(currentPassword)); err != nil {
+		Config.Log.Printf("User %s (%s) tried to delete their account, current password wrong", user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "deleteaccount.gohtml", "currentpasswordwrong", nil, user)
+		return
+	}
+
+	// Without a grace period, we delete the account right away.
+	if Config.DeletionGracePeriod <= 0 {
+		if err := session.LogOut(); err != nil {
+			RenderProgramError(response, request, "Could not log user out of session", "", err)
+			return
+		}
+		if err := deleteAccount(user); err != nil {
+			RenderProgramError(response, request, fmt.Sprintf("Could not delete user %s (%s)", user.GetID(), user.GetEmail()), "Could not delete account", err)
+			return
+		}
+		Config.Log.Printf("User %s (%s) deleted their account", user.GetID(), user.GetEmail())
+		RenderPage(response, request, "accountdeleted.gohtml", map[string]interface{}{"config": Config})
+		return
+	}
+
+	// Request the deletion.
+	token, err := sessions.RandomID(22)
+	if err != nil {
+		RenderProgramError(response, request, fmt.Sprintf("Could not generate deletion token for %s (%s)", user.GetID(), user.GetEmail()), "Could not generate deletion token", err)
+		return
+	}
+	requested := time.Now()
+	deletionUser.SetDeletionToken(token, requested)
+	forgetAllDevices(user)
+	if err := Config.UpdateUser(user); err != nil {
+		RenderProgramError(response, request, fmt.Sprintf("Could not save user with deletion token: %s (%s)", user.GetID(), user.GetEmail()), "Could not update user", err)
+		return
+	}
+	if err := session.LogOut(); err != nil {
+		RenderProgramError(response, request, "Could not log user out of session", "", err)
+		return
+	}
+	if err := sessions.LogOut(user.GetID()); err != nil {
+		RenderProgramError(response, request, fmt.Sprintf("Could not log user %s (%s) out of all sessions", user.GetID(), user.GetEmail()), "", err)
+		return
+	}
+	Config.Log.Printf("User %s (%s) requested the deletion of their account", user.GetID(), user.GetEmail())
+
+	// Send an email with the cancellation link.
+	deletion := requested.Add(Config.DeletionGracePeriod).Format("Monday, Jan 2, 2006, 15:04:05")
+	data := map[string]interface{}{
+		"email":    user.GetEmail(),
+		"token":    token,
+		"deletion": deletion,
+		"date":     requested.Format("Mon, 2006-01-02 15:04:05"),
+		"ip":       request.RemoteAddr,
+		"agent":    request.UserAgent(),
+		"config":   Config,
+		"user":     user,
+	}
+	if err := SendMail(request, user.GetEmail(), "deletion_requested.tmpl", data); err != nil {
+		RenderProgramError(response, request, "Could not send deletion email", "", err)
+		return
+	}
+
+	RenderPage(response, request, "deletionrequested.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"deletion": deletion}})
+}
+
+// CancelDeletion is the target of the link sent by DeleteAccount(). It checks
+// the provided deletion token and, upon a GET request, renders the
+// "canceldeletion.gohtml" template which contains a form posting the token
+// back to this handler. Upon that POST request, the pending deletion is
+// cancelled and the "deletioncancelled.gohtml" template is rendered. If the
+// token is unknown (e.g. because the account was already deleted), the
+// "canceldeletion.gohtml" template is rendered with an error.
+func CancelDeletion(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	// Throttle attempts.
+	if Config.ThrottleVerification != nil {
+		Config.ThrottleVerification()
+	}
+
+	// Check if we have a valid deletion token.
+	token := request.FormValue("token")
+	user, err := Config.LoadUserByDeletionToken(token)
+	if err != nil {
+		RenderProgramError(response, request, "Could not load user via deletion token: "+token, "Could not load user", err)
+		return
+	}
+	deletionUser, ok := user.(DeletionUser)
+	if token == "" || !ok {
+		Config.Log.Printf("Deletion token unknown: %s", token)
+		RenderPageError(response, request, "canceldeletion.gohtml", "deletiontokennotfound", nil, nil)
+		return
+	}
+
+	if request.Method != "POST" {
+		// Ask the user to confirm.
+		RenderPage(response, request, "canceldeletion.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"token": token}})
+		return
+	}
+
+	// Cancel the deletion.
+	deletionUser.SetDeletionToken("", time.Unix(0, 0))
+	if err := Config.UpdateUser(user); err != nil {
+		RenderProgramError(response, request, "Could not save user with cancelled deletion", "", err)
+		return
+	}
+	Config.Log.Printf("User %s (%s) cancelled the deletion of their account", user.GetID(), user.GetEmail())
+
+	RenderPage(response, request, "deletioncancelled.gohtml", map[string]interface{}{"config": Config})
+}
+
+// cancelPendingDeletion cancels the pending deletion of the given user who has
+// just logged in. Users are logged out when they request a deletion so logging
+// in again means they want to keep their account.
+func cancelPendingDeletion(user User) error {
+	deletionUser, ok := user.(DeletionUser)
+	if !ok {
+		return nil
+	}
+	if token, _ := deletionUser.GetDeletionToken(); token == "" {
+		return nil
+	}
+	deletionUser.SetDeletionToken("", time.Unix(0, 0))
+	if err := Config.UpdateUser(user); err != nil {
+		return err
+	}
+	Config.Log.Printf("Deletion of user %s (%s) was cancelled by logging in", user.GetID(), user.GetEmail())
+	return nil
+}
+
+// DeleteRequestedAccounts deletes all users whose deletion (see
+// DeleteAccount()) was requested more than Config.DeletionGracePeriod ago.
+// This function is meant to be called periodically, e.g. once an hour by a
+// goroutine in your application. Users are iterated with Config.ForEachUser and
+// only users implementing the DeletionUser interface are considered.
+//
+// The number of deleted accounts is returned. Errors deleting individual
+// accounts are logged but do not stop the process.
+func DeleteRequestedAccounts() (int, error) {
+	if Config.ForEachUser == nil {
+		return 0, fmt.Errorf("ForEachUser is not implemented")
+	}
+
+	// Collect the users first, deleting them may interfere with the iteration.
+	now := time.Now()
+	var due []User
+	err := Config.ForEachUser(func(user User) error {
+		deletionUser, ok := user.(DeletionUser)
+		if !ok {
+			return nil
+		}
+		token, requested := deletionUser.GetDeletionToken()
+		if token != "" && !requested.Add(Config.DeletionGracePeriod).After(now) {
+			due = append(due, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Could not iterate users for account deletion: %s", err)
+	}
+
+	var deleted int
+	for _, user := range due {
+		if err := deleteAccount(user); err != nil {
+			Config.Log.Printf("Could not delete user %s (%s): %s", user.GetID(), user.GetEmail(), err)
+			continue
+		}
+		Config.Log.Printf("Deleted user %s (%s) after the deletion grace period", user.GetID(), user.GetEmail())
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// deleteAccount removes the given user's application data (see
+// Config.DeleteUserData), logs them out of all sessions, and deletes them
+// from the user database.
+func deleteAccount(user User) error {
+	if Config.DeleteUserData != nil {
+		if err := Config.DeleteUserData(user); err != nil {
+			return err
+		}
+	}
+	if err := sessions.LogOut(user.GetID()); err != nil {
+		return err
+	}
+	return Config.DeleteUser(user)
+}
+
+// ExportAccount lets a logged-in user download their account data as a JSON
+// file. It contains the user's ID, email address, state, roles, passkeys,
+// remembered devices, and other information known to this package, as well as
+// the data returned by Config.ExportUserData (under the "application" key).
+// Secrets such as password hashes are not included. Administrators
+// impersonating a user (see Admin()) cannot use this page.
+func ExportAccount(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	if blockImpersonation(response, request) {
+		return
+	}
+
+	// This page only works if the user is logged in.
+	user, _, _ := IsLoggedIn(response, request)
+	if user == nil {
+		RenderProgramError(response, request, "This page may only be accessed when you are logged in", "", nil)
+		return
+	}
+
+	// Collect the data.
+	export, err := accountExport(user)
+	if err != nil {
+		RenderProgramError(response, request, fmt.Sprintf("Could not export data of user %s (%s)", user.GetID(), user.GetEmail()), "Could not export account data", err)
+		return
+	}
+	body, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		RenderProgramError(response, request, fmt.Sprintf("Could not encode data of user %s (%s)", user.GetID(), user.GetEmail()), "Could not export account data", err)
+		return
+	}
+	Config.Log.Printf("User %s (%s) exported their account data", user.GetID(), user.GetEmail())
+
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.Header().Set("Content-Disposition", `attachment; filename="account.json"`)
+	response.Write(body)
+}
+
+// accountExport returns the data of the given user to be exported by
+// ExportAccount().
+func accountExport(user User) (map[string]interface{}, error) {
+	export := map[string]interface{}{
+		"id":               user.GetID(),
+		"email":            user.GetEmail(),
+		"state":            stateName(user.GetState()),
+		"roles":            user.GetRoles(),
+		"twoFactorEnabled": totpEnabled(user),
+		"exported":         time.Now().Format(time.RFC3339),
+	}
+	if ageUser, ok := user.(PasswordAgeUser); ok && !ageUser.GetPasswordChanged().IsZero() {
+		export["passwordChanged"] = ageUser.GetPasswordChanged().Format(time.RFC3339)
+	}
+	if expiryUser, ok := user.(ExpiryUser); ok && !expiryUser.GetExpiry().IsZero() {
+		export["expires"] = expiryUser.GetExpiry().Format(time.RFC3339)
+	}
+	if webAuthnUser, ok := user.(WebAuthnUser); ok {
+		var passkeys []map[string]interface{}
+		for _, credential := range webAuthnUser.GetWebAuthnCredentials() {
+			passkeys = append(passkeys, map[string]interface{}{
+				"name":     credential.Name,
+				"created":  credential.Created.Format(time.RFC3339),
+				"lastUsed": credential.LastUsed.Format(time.RFC3339),
+			})
+		}
+		export["passkeys"] = passkeys
+	}
+	if rememberUser, ok := user.(RememberUser); ok {
+		var devices []map[string]interface{}
+		for _, device := range rememberUser.GetRememberedDevices() {
+			devices = append(devices, map[string]interface{}{
+				"userAgent": device.UserAgent,
+				"ipAddress": device.IPAddress,
+				"created":   device.Created.Format(time.RFC3339),
+				"lastUsed":  device.LastUsed.Format(time.RFC3339),
+				"expires":   device.Expires.Format(time.RFC3339),
+			})
+		}
+		export["devices"] = devices
+	}
+	if Config.ExportUserData != nil {
+		application, err := Config.ExportUserData(user)
+		if err != nil {
+			return nil, err
+		}
+		export["application"] = application
+	}
+	return export, nil
+}
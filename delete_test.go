@@ -0,0 +1,196 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	user := &MyUser{
+		id:           "u",
+		email:        "u@x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		devices:      []RememberedDevice{{ID: "d"}},
+	}
+	computed, _ := runRequest(user, nil, nil, DeleteAccount)
+	assertString("HIDAF", computed, t)
+	computed, _ = runRequest(user, nil, map[string]string{"currentpassword": "54321"}, DeleteAccount)
+	assertString("HIDA!WCP!F", computed, t)
+	if user.deletionToken != "" {
+		t.Fatal("Deletion requested with wrong password")
+	}
+
+	// Request the deletion.
+	computed, mail := runRequest(user, nil, map[string]string{"currentpassword": "12345"}, DeleteAccount)
+	assertString("HODRF", computed, t)
+	if user.deletionToken == "" {
+		t.Fatal("Deletion was not requested")
+	}
+	assertString("DEL"+user.deletionToken, mail, t)
+	if len(user.devices) != 0 {
+		t.Error("Remembered devices were not forgotten")
+	}
+
+	// Cancel it.
+	loadUser := Config.LoadUserByDeletionToken
+	defer func() {
+		Config.LoadUserByDeletionToken = loadUser
+	}()
+	Config.LoadUserByDeletionToken = func(token string) (User, error) {
+		if user.deletionToken == token {
+			return user, nil
+		}
+		return nil, nil
+	}
+	token := user.deletionToken
+	computed, _ = runRequest(nil, map[string]string{"token": token}, nil, CancelDeletion)
+	assertString("HOCD"+token+"F", computed, t)
+	computed, _ = runRequest(nil, nil, map[string]string{"token": token}, CancelDeletion)
+	assertString("HODCF", computed, t)
+	if user.deletionToken != "" {
+		t.Error("Deletion was not cancelled")
+	}
+	computed, _ = runRequest(nil, nil, map[string]string{"token": token}, CancelDeletion)
+	assertString("HOCD!DTN!F", computed, t)
+}
+
+func TestDeleteAccountImmediately(t *testing.T) {
+	Config.DeletionGracePeriod = 0
+	deleteUser := Config.DeleteUser
+	defer func() {
+		Config.DeletionGracePeriod = 14 * 24 * time.Hour
+		Config.DeleteUser = deleteUser
+		Config.DeleteUserData = nil
+	}()
+	var deleted []string
+	Config.DeleteUserData = func(user User) error {
+		deleted = append(deleted, "data")
+		return nil
+	}
+	Config.DeleteUser = func(user User) error {
+		deleted = append(deleted, "user")
+		return nil
+	}
+	user := &MyUser{
+		email:        "u@x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+	}
+	computed, _ := runRequest(user, nil, map[string]string{"currentpassword": "12345"}, DeleteAccount)
+	assertString("HODDF", computed, t)
+	if len(deleted) != 2 || deleted[0] != "data" || deleted[1] != "user" {
+		t.Errorf("Wrong deletion sequence: %v", deleted)
+	}
+}
+
+func TestDeleteRequestedAccounts(t *testing.T) {
+	now := time.Now()
+	list := []*MyUser{
+		{id: "1", email: "due@x", deletionToken: "a", deletionTime: now.Add(-15 * 24 * time.Hour)},
+		{id: "2", email: "pending@x", deletionToken: "b", deletionTime: now.Add(-time.Hour)},
+		{id: "3", email: "failing@x", deletionToken: "c", deletionTime: now.Add(-15 * 24 * time.Hour)},
+		{id: "4", email: "active@x"},
+	}
+	forEachUser, deleteUser := Config.ForEachUser, Config.DeleteUser
+	defer func() {
+		Config.ForEachUser = forEachUser
+		Config.DeleteUser = deleteUser
+		Config.DeleteUserData = nil
+	}()
+	Config.ForEachUser = func(callback func(user User) error) error {
+		for _, user := range list {
+			if err := callback(user); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	Config.DeleteUserData = func(user User) error {
+		if user.GetEmail() == "failing@x" {
+			return errors.New("Failed")
+		}
+		return nil
+	}
+	var deleted []string
+	Config.DeleteUser = func(user User) error {
+		deleted = append(deleted, user.GetEmail())
+		return nil
+	}
+	count, err := DeleteRequestedAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(deleted) != 1 {
+		t.Fatalf("Expected 1 deleted user, got %d (%v)", count, deleted)
+	}
+	assertString("due@x", deleted[0], t)
+}
+
+func TestExportAccount(t *testing.T) {
+	Config.ExportUserData = func(user User) (interface{}, error) {
+		return map[string]string{"posts": "none"}, nil
+	}
+	defer func() {
+		Config.ExportUserData = nil
+	}()
+	user := &MyUser{
+		id:           "u",
+		email:        "u@x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		roles:        []string{"editor"},
+		credentials:  []WebAuthnCredential{{ID: []byte{1}, Name: "Key"}},
+	}
+	computed, _ := runRequest(user, nil, nil, ExportAccount)
+	var export struct {
+		ID          string
+		Email       string
+		State       string
+		Roles       []string
+		Passkeys    []map[string]string
+		Application map[string]string
+	}
+	if err := json.Unmarshal([]byte(computed), &export); err != nil {
+		t.Fatalf("Invalid export %q: %s", computed, err)
+	}
+	assertString("u", export.ID, t)
+	assertString("u@x", export.Email, t)
+	assertString("verified", export.State, t)
+	if len(export.Roles) != 1 || len(export.Passkeys) != 1 || export.Passkeys[0]["name"] != "Key" {
+		t.Errorf("Incomplete export: %s", computed)
+	}
+	assertString("none", export.Application["posts"], t)
+	if strings.Contains(computed, "$2a$") {
+		t.Error("Export contains the password hash")
+	}
+	computed, _ = runRequest(nil, nil, nil, ExportAccount)
+	if computed[0] == '{' {
+		t.Error("Export available without login")
+	}
+}
+
+func TestDeletionCancelledByLogIn(t *testing.T) {
+	user := &MyUser{
+		id:            "u",
+		email:         "u@x",
+		state:         StateVerified,
+		passwordHash:  []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		deletionToken: "token",
+		deletionTime:  time.Now(),
+	}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	computed, _ := runRequest(nil, nil, map[string]string{"email": "u@x", "password": "12345"}, LogIn)
+	assertString("redirect", computed, t)
+	if user.deletionToken != "" {
+		t.Error("Deletion was not cancelled by logging in")
+	}
+	if deleted, err := DeleteRequestedAccounts(); err != nil || deleted != 0 {
+		t.Errorf("Account was deleted after logging in: %d, %v", deleted, err)
+	}
+}
@@ -3,22 +3,33 @@ Package users implements common web user workflows. Most of the provided
 functions are regular net/http handler functions. The following functionality
 is provided:
 
-  - Signing up for a new user account
+  - Signing up for a new user account, publicly or by invitation
   - Logging in and out
   - Checking login status
   - Resetting forgotten passwords
   - Changing email and password
+  - Two-factor authentication with time-based one-time passwords (TOTP)
+  - Passkeys (WebAuthn) as a second factor or for password-less logins
+  - Password-less logins via links sent by email ("magic links")
+  - Role-based access control
+  - A user administration
+  - Account deletion and data export
+  - A command-line tool for user management (see the "cmd/users" directory)
 
 Special emphasis is placed on reducing the risk of someone hijacking user
 accounts. This is achieved by enforcing a certain user structure and following
 certain procedures:
 
-  - Users are identified by their email address.
+  - Users are identified by their email address, compared in a canonical form
+    (see CanonicalEmail()) so that addresses differing only in case, Unicode
+    normalization, full-width characters, or common lookalike letters of other
+    scripts cannot create duplicates. Local parts mixing scripts (e.g. Latin
+    and Cyrillic) are rejected.
   - New or changed email addresses must be verified by clicking on a link
     emailed to that address.
   - Users authenticate by entering their email address and a password.
-  - Password integrity is checked via ReasonablePassword() in the package
-    github.com/rivo/sessions.
+  - New passwords are checked against a PasswordPolicy which, by default,
+    follows the NIST Special Publication 800-63B.
   - Forgotten passwords are reset by clicking on a link emailed to the user.
 
 If your application does not follow these principles, you may not be able to
@@ -52,6 +63,27 @@ Any other handlers can be added to the http.DefaultServeMux before calling
 users.Main(). Alternatively, you can start your own HTTP server. See the
 implementation of users.Main() for how to add the package's handlers.
 
+To protect your own pages, wrap their handlers with RequireLogin(),
+RequireVerified(), or RequireState(). The logged-in user is then available via
+UserFromContext():
+
+  http.Handle("/account", users.RequireVerified(http.HandlerFunc(
+    func(response http.ResponseWriter, request *http.Request) {
+      user := users.UserFromContext(request.Context())
+      fmt.Fprintf(response, "You are logged in: %s", user.GetEmail())
+    })))
+
+Command-Line Tool
+
+Users can also be managed from the command line with Command(), e.g. to create
+the first administrator or to move users between databases. The "cmd/users"
+directory contains a template for such a program. It always exits with an
+error until you copy it, set up Config for your database, and set its
+"configured" constant to true. The resulting tool is used like this:
+
+  users create -verified admin@example.com < password.txt
+  users export -format=json > users.json
+
 Package Configuration
 
 See the package example for a most basic way to use the package. In addition,
@@ -66,10 +98,95 @@ you can see in its documentation. The fields are as follows:
     successfully. This may be used for example to record the login time.
   - NewUser: A function which returns a new object that implements the User
     interface.
-  - PasswordNames: A list of strings to be excluded from passwords. This is
-    usually the application name or the domain name. Anything specific to the
-    application. It will be passed to ReasonablePassword() in the package
-    github.com/rivo/sessions.
+  - PasswordPolicy: The policy new passwords are checked against. The default,
+    NISTPasswordPolicy, checks for a minimum and maximum length, context words
+    (usually the application name or the domain name, anything specific to the
+    application, as well as the user's email address), commonly used passwords
+    (a bundled list or one loaded from a local file), repetitions, and
+    sequences. Rejected passwords lead to a list of PasswordViolation values
+    which are passed to the "error_invalidpassword.gohtml" template under the
+    "violations" key.
+  - BreachedPasswords: If set, new passwords are also checked against a local
+    corpus of breached passwords in the Pwned Passwords format. No network
+    calls are made. Users who log in with a breached password are flagged for
+    a password change if they implement the PasswordChangeUser interface.
+  - PasswordHistory: The number of most recent passwords (including the current
+    one) which users may not choose again. Previous password hashes are kept
+    for users implementing the PasswordHistoryUser interface. Rejected
+    passwords lead to the "error_passwordreused.gohtml" template.
+  - PasswordMaxAge: The maximum age of a password for users implementing the
+    PasswordAgeUser interface. Users with an expired password, or who were
+    flagged with RequirePasswordChange(), are redirected to
+    RoutePasswordChange after entering their password and are only logged in
+    after they have chosen a new one. If they take longer than
+    PasswordChangeValidity, they must log in again.
+  - PasswordExpiryReminder: How long before a password expires a reminder
+    email is sent by SendPasswordExpiryReminders(), which should be called
+    once a day.
+  - TOTPIssuer: The name shown in authenticator apps for two-factor
+    authentication. Users implementing the TOTPUser interface can enable
+    two-factor authentication at RouteTOTPEnroll. After entering their
+    password, they must then enter a TOTP code (or one of their one-time
+    recovery codes) at RouteTOTPChallenge before they are logged in.
+  - RememberMe: How long users stay logged in on a device if they check the
+    "remember" box on the login form. Devices are remembered for users
+    implementing the RememberUser interface, who can view and revoke them at
+    RouteRememberedDevices. Remembered devices are forgotten when the user
+    logs out on them, resets their password, or changes their email address.
+  - MagicLinkValidity: If not 0, users implementing the MagicLinkUser
+    interface may request a single-use login link at RouteMagicLink instead
+    of entering their password. The link points to RouteMagicLogIn and
+    expires after the given duration. This also works for users without a
+    password.
+  - EmailCodeDigits: If not 0, verification and password reset emails also
+    contain a numeric code with this number of digits. Users may enter it at
+    RouteVerify or RouteResetPassword (with an "email" parameter) instead of
+    clicking on the link. Codes become invalid after EmailCodeAttempts wrong
+    attempts. If EmailLinks is false, the emails only contain the code.
+  - WebAuthn*: Settings for passkeys. Users implementing the WebAuthnUser
+    interface can register passkeys at RouteWebAuthnRegister. Users without
+    TOTP who have registered passkeys must use one at RouteWebAuthnLogIn after
+    entering their password. If WebAuthnPasswordless is true, they may also
+    log in there with a passkey only. WebAuthnRPID and WebAuthnOrigins must
+    match your application's domain. Attestations can be restricted with
+    WebAuthnAttestationFormats and WebAuthnAttestationPolicy.
+  - CSRFProtection: If true, POST requests must contain the session's CSRF
+    token and must not come from another origin (unless listed in
+    CSRFTrustedOrigins). API clients which don't use cookies can be exempted
+    with CSRFExempt.
+  - NextPaths: The local paths to which users may be sent back after logging
+    in. LogInURL() returns a login URL with a "next" parameter pointing to the
+    current page. That parameter is carried through the login form, the
+    second factor, and the sign-up and verification pages.
+  - Roles: The roles which may be assigned to users implementing the RoleUser
+    interface (see AssignRole() and RevokeRole()). Roles grant permissions
+    and may inherit other roles. Use RequirePermission() to protect handlers
+    and the "can" template function, e.g. {{ if can .user "billing.edit" }},
+    to check permissions in templates.
+  - AdminPermission: The permission required to access the user
+    administration at RouteAdmin (see Admin()), where operators can search
+    users, verify, expire, suspend, or reinstate accounts, send password
+    reset emails, log users out, delete accounts, and impersonate users for
+    at most ImpersonationDuration. Actions are reported to AdminAction.
+  - AllowedDomains, BlockedDomains: The email domains (including their
+    subdomains) which are accepted or rejected when users sign up, change
+    their email address, or are invited by non-administrators. If BlockDisposableDomains is true, addresses of
+    disposable email providers (DisposableDomains plus the domains listed in
+    DisposableDomainsFile) are rejected, too. Rejections lead to the
+    "error_emaildomain.gohtml" template with the reason under the "reason"
+    key.
+  - InviteOnly: If true, the public sign-up is closed. Users with the
+    InvitePermission (or all verified users if it is empty) may instead invite
+    others at RouteInvite (see Invite()), where they can also list and revoke
+    their pending invitations. Invitations may pre-assign roles and expire
+    after InvitationValidity. Invited people choose their password at
+    RouteAcceptInvitation, which also verifies their email address.
+  - DeletionGracePeriod: Users implementing the DeletionUser interface may
+    delete their account at RouteDeleteAccount. The deletion only takes
+    effect after this grace period (see DeleteRequestedAccounts()), during
+    which a link to RouteCancelDeletion cancels it. Your application's data
+    is removed by DeleteUserData. Users may download their account data at
+    RouteExportAccount, including the data returned by ExportUserData.
   - Route*: The fields starting with "Route" contain the routes for the various
     pages. They are used throughout the package's code as well as in the
     templates.
@@ -117,21 +234,52 @@ A number of functions serve as the interface to your database:
   - LoadUserByVerificationID: Loads a user given a verification ID.
   - LoadUserByPasswordToken: Loads a user given a password reset token.
   - LoadUserByEmail: Loads a user given an email.
+  - ForEachUser: Iterates over all users. This is only needed for periodic
+    tasks such as SendPasswordExpiryReminders() and
+    DeleteRequestedAccounts().
+  - DeleteUser: Removes a user from the database.
+  - SaveInvitation, LoadInvitation, DeleteInvitation, ForEachInvitation:
+    Store pending invitations (see Invite()).
 
 The User Object
 
 Anyone using this package must define a type which implements this package's
-User interface. A user is in one of three possible states:
+User interface. By default, a user is in one of five possible states:
 
   - StateCreated: The user exists but has not yet been verified and can
     therefore not yet use the application.
   - StateVerified: The user has been verified and has access to the application.
   - StateExpired: The user account has expired. The application cannot be used
-    anymore.
+    anymore. Users implementing the ExpiryUser interface expire automatically
+    (see ExpireAccounts()) and are sent to Config.RouteRenewal, if set, where
+    your application may call Renew(). Reminders are sent with
+    SendAccountExpiryReminders() and billing systems may postpone the expiry
+    with Config.ExtendExpiry.
+  - StateSuspended: The user account has been suspended by an administrator
+    (see Suspend() and Reinstate()). The user cannot log in. Users
+    implementing the SuspensionUser interface are told the reason, are
+    reinstated automatically when their suspension ends, and return to the
+    state they were in before.
+  - StatePendingApproval: The user has verified their email address but must
+    be approved by an administrator first (see Config.SignUpApproval,
+    Approve(), and Reject()). The user cannot log in yet.
+
+Applications may register additional states in Config.States, e.g. a "trial"
+state, and declare whether users in those states may log in and use the
+application and which other states they may move into. State changes made
+with ChangeState() are reported to Config.StateTransition.
 
 Users have an ID which must be unique (e.g. generated by CUID() in the package
 github.com/rivo/sessions). But this package may access users based on their
 unique email address, their verification ID, or their password reset token.
+Email addresses are stored as entered (normalized by NormalizeEmail()) so
+that emails reach the mailbox the user named. LoadUserByEmail receives the
+canonical form returned by CanonicalEmail(), and SaveNewUserAtomic must treat
+users as duplicates if the canonical forms of their addresses are equal. A
+simple way to implement this is to store the canonical form in a separate,
+unique database column. To migrate existing records, fill that column with
+CanonicalEmail() of the stored address. Records whose addresses share a
+canonical form must be merged or changed first.
 
 You must implement the Config.NewUser function.
 
@@ -157,6 +305,12 @@ message (these template files start with "error_"), and the other to generate
 the HTML file which shows the error message. Config and User will also be bound
 to the latter as well as any data sent to the error message template.
 
+If Config.CSRFProtection is true (the default), RenderPage() also adds the
+session's CSRF token to map data objects under the "csrf" key. Every form which
+posts to one of this package's handlers must include it in a hidden "csrf"
+field. Requests from other origins or without a valid token are rejected with
+the "csrfinvalid.gohtml" template.
+
 There is another function for errors, RenderProgramError(), which is used to
 show program errors. These are unexpected errors, for example database
 connection issues, and should always be followed up on. While the user usually
@@ -0,0 +1,149 @@
+package users
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons for which an email address is rejected because of its domain (see
+// Config.AllowedDomains, Config.BlockedDomains, and
+// Config.BlockDisposableDomains).
+const (
+	DomainNotAllowed = "notallowed" // The domain is not in Config.AllowedDomains.
+	DomainBlocked    = "blocked"    // The domain is in Config.BlockedDomains.
+	DomainDisposable = "disposable" // The domain belongs to a disposable email provider.
+)
+
+// DisposableDomains is the bundled list of providers of disposable email
+// addresses. Domains found in Config.DisposableDomainsFile are checked in
+// addition to these.
+var DisposableDomains = []string{
+	"10minutemail.com",
+	"burnermail.io",
+	"discard.email",
+	"dispostable.com",
+	"emailondeck.com",
+	"fakeinbox.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"guerrillamail.net",
+	"guerrillamail.org",
+	"inboxkitten.com",
+	"mailcatch.com",
+	"maildrop.cc",
+	"mailinator.com",
+	"mailnesia.com",
+	"mintemail.com",
+	"mohmal.com",
+	"mytemp.email",
+	"sharklasers.com",
+	"spamgourmet.com",
+	"temp-mail.org",
+	"tempmailo.com",
+	"tempr.email",
+	"throwawaymail.com",
+	"trashmail.com",
+	"trashmail.de",
+	"yopmail.com",
+	"yopmail.fr",
+}
+
+// The disposable domains loaded from Config.DisposableDomainsFile.
+var (
+	disposableFile     string              // The file from which "disposableLoaded" was read.
+	disposableModified time.Time           // The modification time of that file when it was read.
+	disposableLoaded   map[string]struct{} // The domains found in that file, lowercase.
+	disposableMutex    sync.Mutex          // Guards the variables above.
+)
+
+// checkEmailDomain checks the domain of the given email address against
+// Config.AllowedDomains, Config.BlockedDomains, and the list of disposable
+// email providers. If the domain is rejected, one of the Domain* reasons is
+// returned. An empty string means the domain is acceptable.
+func checkEmailDomain(email string) (string, error) {
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	if len(Config.AllowedDomains) > 0 && !domainListed(domain, Config.AllowedDomains) {
+		return DomainNotAllowed, nil
+	}
+	if domainListed(domain, Config.BlockedDomains) {
+		return DomainBlocked, nil
+	}
+	if !Config.BlockDisposableDomains {
+		return "", nil
+	}
+	if domainListed(domain, DisposableDomains) {
+		return DomainDisposable, nil
+	}
+	if Config.DisposableDomainsFile != "" {
+		loaded, err := disposableDomains()
+		if err != nil {
+			return "", err
+		}
+		for parent := domain; parent != ""; {
+			if _, ok := loaded[parent]; ok {
+				return DomainDisposable, nil
+			}
+			dot := strings.Index(parent, ".")
+			if dot < 0 {
+				break
+			}
+			parent = parent[dot+1:]
+		}
+	}
+	return "", nil
+}
+
+// domainListed returns whether the given domain or one of its parent domains
+// is contained in the given list.
+func domainListed(domain string, list []string) bool {
+	for _, entry := range list {
+		if ascii, err := emailProfile.ToASCII(entry); err == nil {
+			entry = ascii
+		} else {
+			entry = strings.ToLower(entry)
+		}
+		if domain == entry || strings.HasSuffix(domain, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// disposableDomains returns the domains listed in Config.DisposableDomainsFile,
+// (re)loading them if the file was not read yet or modified since.
+func disposableDomains() (map[string]struct{}, error) {
+	disposableMutex.Lock()
+	defer disposableMutex.Unlock()
+	info, err := os.Stat(Config.DisposableDomainsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open disposable domains file: %s", err)
+	}
+	if disposableLoaded != nil && disposableFile == Config.DisposableDomainsFile && info.ModTime().Equal(disposableModified) {
+		return disposableLoaded, nil
+	}
+
+	file, err := os.Open(Config.DisposableDomainsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open disposable domains file: %s", err)
+	}
+	defer file.Close()
+	loaded := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			loaded[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read disposable domains file: %s", err)
+	}
+
+	disposableLoaded = loaded
+	disposableFile = Config.DisposableDomainsFile
+	disposableModified = info.ModTime()
+	return loaded, nil
+}
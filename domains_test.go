@@ -0,0 +1,92 @@
+package users
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckEmailDomain(t *testing.T) {
+	defer func() {
+		Config.AllowedDomains = nil
+		Config.BlockedDomains = nil
+		Config.DisposableDomainsFile = ""
+	}()
+	check := func(email, expected string) {
+		t.Helper()
+		reason, err := checkEmailDomain(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertString(expected, reason, t)
+	}
+
+	check("a@example.com", "")
+	check("a@Mailinator.com", DomainDisposable)
+	check("a@eu.mailinator.com", DomainDisposable)
+	check("a@notmailinator.com", "")
+
+	Config.BlockedDomains = []string{"spam.com"}
+	check("a@spam.com", DomainBlocked)
+	check("a@mail.spam.com", DomainBlocked)
+	check("a@example.com", "")
+
+	Config.AllowedDomains = []string{"corp.com"}
+	check("a@corp.com", "")
+	check("a@dev.corp.com", "")
+	check("a@example.com", DomainNotAllowed)
+	Config.AllowedDomains = nil
+
+	// Domains from a file, reloaded when modified.
+	file := filepath.Join(t.TempDir(), "disposable.txt")
+	if err := ioutil.WriteFile(file, []byte("# Comment\nthrowaway.net\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	Config.DisposableDomainsFile = file
+	check("a@throwaway.net", DomainDisposable)
+	check("a@burner.org", "")
+	if err := ioutil.WriteFile(file, []byte("burner.org\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	check("a@burner.org", DomainDisposable)
+	check("a@throwaway.net", "")
+
+	Config.BlockDisposableDomains = false
+	check("a@mailinator.com", "")
+	Config.BlockDisposableDomains = true
+}
+
+func TestSignUpEmailDomain(t *testing.T) {
+	Config.BlockedDomains = []string{"spam.com"}
+	defer func() {
+		Config.BlockedDomains = nil
+	}()
+	computed, _ := runRequest(nil, nil, map[string]string{"email": "a@spam.com", "password": "correct horse battery", "passwordconfirm": "correct horse battery"}, SignUp)
+	assertString("HOS!EDblocked!Ea@spam.comF", computed, t)
+	computed, _ = runRequest(nil, nil, map[string]string{"email": "a@yopmail.com", "password": "correct horse battery", "passwordconfirm": "correct horse battery"}, SignUp)
+	assertString("HOS!EDdisposable!Ea@yopmail.comF", computed, t)
+}
+
+func TestChangeEmailDomain(t *testing.T) {
+	Config.AllowedDomains = []string{"x"}
+	defer func() {
+		Config.AllowedDomains = nil
+	}()
+	user := &MyUser{
+		id:           "u",
+		email:        "u@x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+	}
+	computed, _ := runRequest(user, nil, map[string]string{"email": "u@y", "currentpassword": "12345"}, Change)
+	assertString("HIC!EDnotallowed!Eu@yF", computed, t)
+	if user.email != "u@x" {
+		t.Error("Email address was changed")
+	}
+}
@@ -0,0 +1,334 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// emailProfile is the IDNA profile used to convert the domains of email
+// addresses to their ASCII (punycode) form.
+var emailProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.StrictDomainName(true),
+	idna.VerifyDNSLength(true),
+)
+
+// NormalizeEmail parses the given email address and returns it in the form in
+// which it is stored and to which emails are sent, or an error if it is not a
+// valid address. The address must be a plain RFC 5322 addr-spec (with UTF-8
+// allowed as per RFC 6532), i.e. forms with a display name such as
+// "John <john@example.com>", comments, and domain literals are rejected. Local
+// parts which mix scripts (e.g. Latin and Cyrillic letters) are rejected, too,
+// as per the "highly restrictive" level of Unicode Technical Standard #39.
+//
+// In the normalized form, the address is normalized to Unicode NFC, the local
+// part is only quoted if necessary but otherwise kept as entered, and the
+// domain is converted to its lowercase ASCII form using IDNA (e.g.
+// "bücher.de" becomes "xn--bcher-kva.de").
+func NormalizeEmail(address string) (string, error) {
+	return parseEmail(address, false)
+}
+
+// CanonicalEmail parses the given email address (see NormalizeEmail()) and
+// returns its canonical form which is used to look up users and to keep them
+// unique, or an error if it is not a valid address. In addition to the
+// normalization, the local part is mapped to Unicode NFKC (which folds e.g.
+// full-width characters) and lowercased. Local parts are compared
+// case-insensitively because virtually all email providers treat them this way
+// and accounts must not differ only in the case of their email address.
+// Finally, letters of other scripts which look like ASCII letters in upper or
+// lower case (e.g. Cyrillic "а" and "о", Greek "ο") are replaced with these
+// ASCII letters, following the "skeleton" algorithm of Unicode Technical
+// Standard #39. This way, an address written entirely in Cyrillic letters
+// resembling a Latin one has the same canonical form as the Latin address.
+//
+// Only the letters listed in the confusables table of this package are
+// replaced. It covers the Cyrillic, Greek, Armenian, Cherokee, and Latin
+// letters most commonly used for spoofing but not the full confusables data of
+// UTS #39. ASCII characters themselves are never replaced (e.g. "l" and "1"
+// remain distinct) as they denote different mailboxes. Note that extending the
+// table changes the canonical form of existing addresses.
+//
+// The canonical form is not suitable for sending emails as some providers do
+// distinguish case.
+func CanonicalEmail(address string) (string, error) {
+	return parseEmail(address, true)
+}
+
+// parseEmail implements NormalizeEmail() and, if "fold" is true,
+// CanonicalEmail().
+func parseEmail(address string, fold bool) (string, error) {
+	address = norm.NFC.String(strings.TrimSpace(address))
+	if !utf8.ValidString(address) {
+		return "", errors.New("Email address is not valid UTF-8")
+	}
+	if strings.ContainsAny(address, "<>") {
+		return "", errors.New("Email address must not contain a display name")
+	}
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "", errors.New("Email address is missing an @ sign")
+	}
+
+	// Check the local part.
+	local, err := normalizeLocalPart(address[:at], fold)
+	if err != nil {
+		return "", err
+	}
+
+	// Check the domain.
+	domain := address[at+1:]
+	if strings.HasPrefix(domain, "[") {
+		return "", errors.New("Email addresses with domain literals are not supported")
+	}
+	if domain == "" || strings.HasSuffix(domain, ".") {
+		return "", fmt.Errorf("Invalid email domain %q", domain)
+	}
+	domain, err = emailProfile.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("Invalid email domain: %s", err)
+	}
+
+	address = local + "@" + domain
+	if len(address) > 254 {
+		return "", errors.New("Email address is too long")
+	}
+	return address, nil
+}
+
+// normalizeLocalPart checks the given local part of an email address, which
+// must be a dot-atom or a quoted string, and returns its normalized form. If
+// "fold" is true, the canonical form is returned instead.
+func normalizeLocalPart(local string, fold bool) (string, error) {
+	if local == "" {
+		return "", errors.New("Email address is missing its local part")
+	}
+	if len(local) > 64 {
+		return "", errors.New("Local part of email address is too long")
+	}
+
+	// Unquote quoted strings.
+	if strings.HasPrefix(local, `"`) {
+		if len(local) < 2 || !strings.HasSuffix(local, `"`) {
+			return "", errors.New("Unterminated quoted string in email address")
+		}
+		var (
+			unquoted strings.Builder
+			escaped  bool
+		)
+		for _, ch := range local[1 : len(local)-1] {
+			switch {
+			case escaped:
+				if ch < ' ' && ch != '\t' || ch == 0x7f {
+					return "", fmt.Errorf("Invalid escaped character %q in email address", ch)
+				}
+				escaped = false
+			case ch == '\\':
+				escaped = true
+				continue
+			case ch == '"' || ch < ' ' && ch != '\t' || ch == 0x7f:
+				return "", fmt.Errorf("Invalid character %q in quoted email address", ch)
+			}
+			unquoted.WriteRune(ch)
+		}
+		if escaped {
+			return "", errors.New("Unterminated quoted string in email address")
+		}
+		local = unquoted.String()
+	} else if !isDotAtom(local) {
+		return "", fmt.Errorf("Invalid local part %q in email address", local)
+	}
+
+	if mixesScripts(local) {
+		return "", fmt.Errorf("Local part %q of email address mixes scripts", local)
+	}
+	if fold {
+		local = skeleton(strings.ToLower(norm.NFKC.String(local)))
+	}
+	if isDotAtom(local) {
+		return local, nil // No quotes needed.
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(local) + `"`, nil
+}
+
+// confusables maps lowercase letters of other scripts to the ASCII letters
+// they resemble in lower or upper case. Upper case letters are lowercased
+// before they are looked up. The entries are based on the confusables data of
+// Unicode Technical Standard #39.
+var confusables = map[rune]rune{
+	// Cyrillic.
+	'\u0430': 'a', // а
+	'\u0432': 'b', // в (В)
+	'\u0433': 'r', // г
+	'\u0435': 'e', // е
+	'\u043a': 'k', // к (К)
+	'\u043c': 'm', // м (М)
+	'\u043d': 'h', // н (Н)
+	'\u043e': 'o', // о
+	'\u043f': 'n', // п
+	'\u0440': 'p', // р
+	'\u0441': 'c', // с
+	'\u0442': 't', // т (Т)
+	'\u0443': 'y', // у
+	'\u0445': 'x', // х
+	'\u0455': 's', // ѕ
+	'\u0456': 'i', // і
+	'\u0458': 'j', // ј
+	'\u0475': 'v', // ѵ
+	'\u04bb': 'h', // һ
+	'\u04cf': 'l', // ӏ
+	'\u0501': 'd', // ԁ
+	'\u051b': 'q', // ԛ
+	'\u051d': 'w', // ԝ
+
+	// Greek.
+	'\u03b1': 'a', // α
+	'\u03b2': 'b', // β (Β)
+	'\u03b3': 'y', // γ
+	'\u03b5': 'e', // ε (Ε)
+	'\u03b6': 'z', // ζ (Ζ)
+	'\u03b7': 'n', // η
+	'\u03b9': 'i', // ι
+	'\u03ba': 'k', // κ
+	'\u03bc': 'm', // μ (Μ)
+	'\u03bd': 'v', // ν
+	'\u03bf': 'o', // ο
+	'\u03c1': 'p', // ρ
+	'\u03c4': 't', // τ (Τ)
+	'\u03c5': 'u', // υ
+	'\u03c7': 'x', // χ
+	'\u03f2': 'c', // ϲ
+	'\u03f3': 'j', // ϳ
+
+	// Armenian.
+	'\u0566': 'q', // զ
+	'\u0570': 'h', // հ
+	'\u0578': 'n', // ո
+	'\u057d': 'u', // ս
+	'\u0581': 'g', // ց
+	'\u0585': 'o', // օ
+
+	// Cherokee (lowercase forms of the letters resembling upper case ASCII).
+	'\uab70': 'd', // Ꭰ
+	'\uab71': 'r', // Ꭱ
+	'\uab72': 't', // Ꭲ
+	'\uab7a': 'a', // Ꭺ
+	'\uab7b': 'j', // Ꭻ
+	'\uab7c': 'e', // Ꭼ
+	'\uab83': 'w', // Ꮃ
+	'\uab87': 'm', // Ꮇ
+	'\uab8b': 'h', // Ꮋ
+	'\uab90': 'g', // Ꮐ
+	'\uab93': 'z', // Ꮓ
+	'\uaba9': 'v', // Ꮩ
+	'\uabaa': 's', // Ꮪ
+	'\uabae': 'l', // Ꮮ
+	'\uabaf': 'c', // Ꮯ
+	'\uabb2': 'p', // Ꮲ
+	'\uabb6': 'k', // Ꮶ
+	'\u13fc': 'b', // Ᏼ
+
+	// Latin.
+	'\u0131': 'i', // ı
+	'\u0237': 'j', // ȷ
+	'\u0251': 'a', // ɑ
+	'\u0261': 'g', // ɡ
+	'\u0269': 'i', // ɩ
+	'\u1d0f': 'o', // ᴏ
+}
+
+// skeleton replaces the letters of the given lowercase string which are
+// listed in confusables with the ASCII letters they resemble. As in UTS #39,
+// the string is decomposed first so that letters with diacritics (e.g.
+// Cyrillic "ё") are mapped, too, and it is recomposed afterwards.
+func skeleton(s string) string {
+	return norm.NFC.String(strings.Map(func(ch rune) rune {
+		if mapped, ok := confusables[ch]; ok {
+			return mapped
+		}
+		return ch
+	}, norm.NFD.String(s)))
+}
+
+// scriptCombinations are the combinations of scripts which may be used
+// together in a local part, in addition to any single script. They follow the
+// "highly restrictive" level of Unicode Technical Standard #39.
+var scriptCombinations = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// mixesScripts returns whether the letters of the given string belong to more
+// than one script, except for the combinations in scriptCombinations.
+// Characters used across scripts (such as digits and punctuation) are ignored.
+func mixesScripts(s string) bool {
+	scripts := make(map[string]bool)
+	for _, ch := range s {
+		if ch < utf8.RuneSelf {
+			if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' {
+				scripts["Latin"] = true
+			}
+			continue
+		}
+		for name, table := range unicode.Scripts {
+			if name != "Common" && name != "Inherited" && unicode.Is(table, ch) {
+				scripts[name] = true
+				break
+			}
+		}
+	}
+	if len(scripts) <= 1 {
+		return false
+	}
+	for _, combination := range scriptCombinations {
+		var covered int
+		for _, name := range combination {
+			if scripts[name] {
+				covered++
+			}
+		}
+		if covered == len(scripts) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDotAtom returns whether the given string is an RFC 5322 dot-atom, with
+// non-ASCII characters allowed as per RFC 6532.
+func isDotAtom(s string) bool {
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, ch := range atom {
+			if ch >= utf8.RuneSelf && unicode.IsGraphic(ch) && !unicode.IsSpace(ch) {
+				continue
+			}
+			if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", ch) {
+				continue
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// lookupEmail returns the canonical form of the given email address for
+// looking up users. Invalid addresses are returned lowercased as they cannot
+// match any user anyway.
+func lookupEmail(address string) string {
+	canonical, err := CanonicalEmail(address)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(address))
+	}
+	return canonical
+}
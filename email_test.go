@@ -0,0 +1,125 @@
+package users
+
+import "testing"
+
+func TestCanonicalEmail(t *testing.T) {
+	for address, expected := range map[string]string{
+		"john@example.com":                 "john@example.com",
+		"  John.Doe@Example.COM ":          "john.doe@example.com",
+		"a+tag@x":                          "a+tag@x",
+		"bücher@Bücher.de":                 "bücher@xn--bcher-kva.de",
+		"bu\u0308cher@x":                   "bücher@x", // NFC.
+		`"john"@x`:                         "john@x",
+		`"john doe"@x`:                     `"john doe"@x`,
+		`"a\"b"@x`:                         `"a\"b"@x`,
+		`"a\\b"@x`:                         `"a\\b"@x`,
+		"a@b@x":                            "",
+		"@x":                               "",
+		"a@":                               "",
+		"a@x.":                             "",
+		"a..b@x":                           "",
+		".a@x":                             "",
+		"a b@x":                            "",
+		"a@[127.0.0.1]":                    "",
+		"a@exa_mple.com":                   "",
+		"John <john@example.com>":          "",
+		"<john@example.com>":               "",
+		"john@example.com (comment)":       "",
+		"jo\u200bhn@x":                     "",
+		"\uff21dmin@x":                     "admin@x", // Full-width.
+		"\u0430dmin@x":                     "",        // Cyrillic and Latin.
+		"\u0430\u0434\u043c\u0438\u043d@x": "aдmиh@x",
+		"\u0430\u0440\u0440\u0435@x":       "appe@x", // All Cyrillic.
+		"\u0410\u0420\u0420\u0415@x":       "appe@x", // All Cyrillic, upper case.
+		"\u03bf\u03c1\u03b1@x":             "opa@x",  // All Greek.
+		"\u0451\u043b\u043a\u0430@x":       "ëлka@x", // Decomposed first.
+		"\u0131\u0261@x":                   "ig@x",   // Latin lookalikes.
+		"l1@x":                             "l1@x",   // ASCII is kept.
+		"山田.taro@x":                        "山田.taro@x",
+		"やまだ.タロウ@x":                        "やまだ.タロウ@x",
+		`"john@x`:                          "",
+		"x":                                "",
+	} {
+		canonical, err := CanonicalEmail(address)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected, got %q", address, canonical)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %q to be accepted, got error: %s", address, err)
+			continue
+		}
+		assertString(expected, canonical, t)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for address, expected := range map[string]string{
+		"  John.Doe@Example.COM ": "John.Doe@example.com",
+		"Bücher@Bücher.de":        "Bücher@xn--bcher-kva.de",
+		`"John"@x`:                "John@x",
+		`"John Doe"@x`:            `"John Doe"@x`,
+		"\uff21dmin@x":            "\uff21dmin@x",
+		"\u0430dmin@x":            "",
+		"John <john@x>":           "",
+	} {
+		normalized, err := NormalizeEmail(address)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected, got %q", address, normalized)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %q to be accepted, got error: %s", address, err)
+			continue
+		}
+		assertString(expected, normalized, t)
+	}
+}
+
+func TestSignUpCanonicalEmail(t *testing.T) {
+	backup := users
+	users = nil
+	defer func() {
+		users = backup
+	}()
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		for _, user := range users {
+			if lookupEmail(user.GetEmail()) == email {
+				return user, nil
+			}
+		}
+		return nil, nil
+	}
+
+	computed, mail := runRequest(nil, nil, map[string]string{"email": "Bücher@BÜCHER.de", "password": "correct horse battery", "passwordconfirm": "correct horse battery"}, SignUp)
+	assertString("HOVSF", computed, t)
+	assertString("VN", mail, t)
+	if len(users) != 1 || users[0].GetEmail() != "Bücher@xn--bcher-kva.de" {
+		t.Fatalf("Unexpected users: %v", users)
+	}
+
+	// Lookalikes refer to the same user.
+	computed, mail = runRequest(nil, nil, map[string]string{"email": "bücher@xn--bcher-kva.de", "password": "correct horse battery", "passwordconfirm": "correct horse battery"}, SignUp)
+	assertString("HOVSF", computed, t)
+	if len(users) != 1 {
+		t.Errorf("Duplicate user was created: %d users", len(users))
+	}
+	user, _ := Config.LoadUserByEmail(lookupEmail(`"BÜCHER"@bücher.de`))
+	if user != users[0] {
+		t.Error("User not found by lookalike address")
+	}
+
+	// Addresses written in lookalike letters of other scripts, too.
+	runRequest(nil, nil, map[string]string{"email": "pace@x", "password": "correct horse battery", "passwordconfirm": "correct horse battery"}, SignUp)
+	runRequest(nil, nil, map[string]string{"email": "\u0440\u0430\u0441\u0435@x", "password": "correct horse battery", "passwordconfirm": "correct horse battery"}, SignUp)
+	if len(users) != 2 {
+		t.Errorf("Duplicate user was created: %d users", len(users))
+	}
+
+	computed, _ = runRequest(nil, nil, map[string]string{"email": "John <john@x>", "password": "correct horse battery", "passwordconfirm": "correct horse battery"}, SignUp)
+	assertString("HOS!01!EJohn &lt;john@x&gt;F", computed, t)
+}
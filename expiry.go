@@ -0,0 +1,116 @@
+package users
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExpiryUser is an optional extension of the User interface. Users
+// implementing it have an account which expires at a given time, after which
+// they are moved into StateExpired (see ExpireAccounts()).
+type ExpiryUser interface {
+	// The time at which the account expires. The zero time means that it never
+	// expires.
+	SetExpiry(expires time.Time)
+	GetExpiry() time.Time
+}
+
+// Renew sets the expiry time of the given user (who must implement the
+// ExpiryUser interface) to the given time and, if their account had expired,
+// moves them back into StateVerified. Call this function from your renewal page
+// (see Config.RouteRenewal) or your billing system. The zero time removes the
+// expiry.
+func Renew(user User, expires time.Time) error {
+	expiryUser, ok := user.(ExpiryUser)
+	if !ok {
+		return fmt.Errorf("User does not implement the ExpiryUser interface")
+	}
+	if user.GetState() == StateExpired {
+		if err := ChangeState(user, StateVerified); err != nil {
+			return err
+		}
+	}
+	expiryUser.SetExpiry(expires)
+	if err := saveAndRefreshUser(user); err != nil {
+		return err
+	}
+	Config.Log.Printf("User %s (%s) was renewed until %s", user.GetID(), user.GetEmail(), expires.Format(time.RFC3339))
+	return nil
+}
+
+// expireIfDue moves the given user into StateExpired if their account has an
+// expiry time which has passed. Before that, Config.ExtendExpiry is given the
+// chance to extend the expiry time. The user is saved if they were changed.
+// Only users who may log in (see State.LogIn) can expire.
+func expireIfDue(user User) error {
+	expiryUser, ok := user.(ExpiryUser)
+	if !ok || user.GetState() == StateExpired || !stateAllowsLogIn(user) {
+		return nil
+	}
+	now := time.Now()
+	expires := expiryUser.GetExpiry()
+	if expires.IsZero() || expires.After(now) {
+		return nil
+	}
+
+	// Give the application a chance to extend the expiry.
+	if Config.ExtendExpiry != nil {
+		extended, err := Config.ExtendExpiry(user)
+		if err != nil {
+			return err
+		}
+		if extended.After(now) {
+			expiryUser.SetExpiry(extended)
+			if err := saveAndRefreshUser(user); err != nil {
+				return err
+			}
+			Config.Log.Printf("Expiry of user %s (%s) was extended until %s", user.GetID(), user.GetEmail(), extended.Format(time.RFC3339))
+			return nil
+		}
+	}
+
+	// Expire the user.
+	if err := ChangeState(user, StateExpired); err != nil {
+		return err
+	}
+	if err := saveAndRefreshUser(user); err != nil {
+		return err
+	}
+	Config.Log.Printf("User %s (%s) has expired", user.GetID(), user.GetEmail())
+	return nil
+}
+
+// ExpireAccounts moves all users whose expiry time (see ExpiryUser) has passed
+// into StateExpired. Logged-in users are also expired by IsLoggedIn() but this
+// function catches users who are not currently active. It is meant to be
+// called periodically, e.g. once an hour by a goroutine in your application.
+// Users are iterated with Config.ForEachUser and only users implementing the
+// ExpiryUser interface are considered.
+//
+// The number of expired users is returned. Errors expiring individual users
+// are logged but do not stop the process.
+func ExpireAccounts() (int, error) {
+	if Config.ForEachUser == nil {
+		return 0, fmt.Errorf("ForEachUser is not implemented")
+	}
+
+	var expired int
+	err := Config.ForEachUser(func(user User) error {
+		if user.GetState() == StateExpired {
+			return nil
+		}
+		if err := expireIfDue(user); err != nil {
+			Config.Log.Printf("Could not expire user %s (%s): %s", user.GetID(), user.GetEmail(), err)
+			return nil
+		}
+		if user.GetState() == StateExpired {
+			expired++
+		}
+		return nil
+	})
+	if err != nil {
+		return expired, fmt.Errorf("Could not iterate users for account expiry: %s", err)
+	}
+
+	return expired, nil
+}
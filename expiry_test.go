@@ -0,0 +1,137 @@
+package users
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExpiryLogIn(t *testing.T) {
+	Config.RouteRenewal = "/renew"
+	defer func() {
+		Config.RouteRenewal = ""
+	}()
+	user := &MyUser{
+		email:        "u@x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		expires:      time.Now().Add(-time.Minute),
+	}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	computed, _ := runRequest(nil, nil, map[string]string{"email": "u@x", "password": "12345"}, LogIn)
+	assertString("redirect", computed, t)
+	if user.state != StateExpired {
+		t.Fatalf("User was not expired, state is %d", user.state)
+	}
+	assertString("/renew", loggedInRoute(user, "/next"), t)
+	user.state = StateVerified
+	assertString("/next", loggedInRoute(user, "/next"), t)
+}
+
+func TestExpiryLoggedIn(t *testing.T) {
+	user := &MyUser{email: "u@x", state: StateVerified, expires: time.Now().Add(-time.Minute)}
+	handler := RequireVerified(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	})).ServeHTTP
+	computed, _ := runRequest(user, nil, nil, handler)
+	assertString("HIADF", computed, t)
+	if user.state != StateExpired {
+		t.Fatalf("User was not expired, state is %d", user.state)
+	}
+
+	// With a renewal page, the user is sent there.
+	Config.RouteRenewal = "/renew"
+	defer func() {
+		Config.RouteRenewal = ""
+	}()
+	computed, _ = runRequest(user, nil, nil, handler)
+	assertString("redirect", computed, t)
+
+	// Renew.
+	if err := Renew(user, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	computed, _ = runRequest(user, nil, nil, handler)
+	assertString("OK", computed, t)
+}
+
+func TestExtendExpiry(t *testing.T) {
+	extended := time.Now().Add(30 * 24 * time.Hour)
+	Config.ExtendExpiry = func(user User) (time.Time, error) {
+		if user.GetEmail() == "paid@x" {
+			return extended, nil
+		}
+		return time.Time{}, nil
+	}
+	defer func() {
+		Config.ExtendExpiry = nil
+	}()
+	past := time.Now().Add(-time.Minute)
+	list := []*MyUser{
+		{email: "paid@x", state: StateVerified, expires: past},
+		{email: "unpaid@x", state: StateVerified, expires: past},
+		{email: "future@x", state: StateVerified, expires: time.Now().Add(time.Hour)},
+		{email: "never@x", state: StateVerified},
+		{email: "new@x", state: StateCreated, expires: past},
+	}
+	Config.ForEachUser = func(callback func(user User) error) error {
+		for _, user := range list {
+			if err := callback(user); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	count, err := ExpireAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 expired user, got %d", count)
+	}
+	for index, state := range []int{StateVerified, StateExpired, StateVerified, StateVerified, StateCreated} {
+		if list[index].state != state {
+			t.Errorf("User %s has state %d, expected %d", list[index].email, list[index].state, state)
+		}
+	}
+	if !list[0].expires.Equal(extended) {
+		t.Errorf("Expiry was not extended: %s", list[0].expires)
+	}
+}
+
+func TestSendAccountExpiryReminders(t *testing.T) {
+	Config.AccountExpiryReminder = 7 * 24 * time.Hour
+	defer func() {
+		Config.AccountExpiryReminder = 0
+	}()
+	Config.ForEachUser = func(callback func(user User) error) error {
+		for _, user := range []User{
+			&MyUser{email: "a@b", state: StateVerified, expires: time.Now().Add((6*24 + 12) * time.Hour)},
+			&MyUser{email: "b@c", state: StateVerified, expires: time.Now().Add(3 * 24 * time.Hour)},
+			&MyUser{email: "c@d", state: StateExpired, expires: time.Now().Add((6*24 + 12) * time.Hour)},
+			&MyUser{email: "d@e", state: StateVerified},
+		} {
+			if err := callback(user); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var recipients []string
+	Config.SendEmails = true
+	Config.SendEmail = func(recipient, subject, body string) error {
+		recipients = append(recipients, recipient)
+		return nil
+	}
+	sent, err := SendAccountExpiryReminders()
+	Config.SendEmails = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || len(recipients) != 1 {
+		t.Fatalf("Expected one reminder, got %d", sent)
+	}
+	assertString("a@b", recipients[0], t)
+}
@@ -25,6 +25,24 @@ type MyUser struct {
 	vidCreated     time.Time
 	passwordToken  string
 	tokenCreated   time.Time
+	changePassword bool
+	history        [][]byte
+	pwChanged      time.Time
+	totpSecret     string
+	recoveryCodes  [][]byte
+	totpLastStep   int64
+	credentials    []WebAuthnCredential
+	devices        []RememberedDevice
+	loginToken     string
+	loginCreated   time.Time
+	roles          []string
+	deletionToken  string
+	deletionTime   time.Time
+	suspension     string
+	suspendedUntil time.Time
+	stateBefore    int
+	expires        time.Time
+	approved       bool
 }
 
 func (u *MyUser) GetID() interface{} {
@@ -77,14 +95,135 @@ func (u *MyUser) GetPasswordToken() (string, time.Time) {
 	return u.passwordToken, u.tokenCreated
 }
 
+func (u *MyUser) SetPasswordChangeRequired(required bool) {
+	u.changePassword = required
+}
+
+func (u *MyUser) GetPasswordChangeRequired() bool {
+	return u.changePassword
+}
+
+func (u *MyUser) SetPasswordHistory(hashes [][]byte) {
+	u.history = hashes
+}
+
+func (u *MyUser) GetPasswordHistory() [][]byte {
+	return u.history
+}
+
+func (u *MyUser) SetPasswordChanged(changed time.Time) {
+	u.pwChanged = changed
+}
+
+func (u *MyUser) GetPasswordChanged() time.Time {
+	return u.pwChanged
+}
+
+func (u *MyUser) SetTOTPSecret(secret string) {
+	u.totpSecret = secret
+}
+
+func (u *MyUser) GetTOTPSecret() string {
+	return u.totpSecret
+}
+
+func (u *MyUser) SetRecoveryCodes(hashes [][]byte) {
+	u.recoveryCodes = hashes
+}
+
+func (u *MyUser) GetRecoveryCodes() [][]byte {
+	return u.recoveryCodes
+}
+
+func (u *MyUser) SetTOTPLastStep(step int64) {
+	u.totpLastStep = step
+}
+
+func (u *MyUser) GetTOTPLastStep() int64 {
+	return u.totpLastStep
+}
+
+func (u *MyUser) SetWebAuthnCredentials(credentials []WebAuthnCredential) {
+	u.credentials = credentials
+}
+
+func (u *MyUser) GetWebAuthnCredentials() []WebAuthnCredential {
+	return u.credentials
+}
+
+func (u *MyUser) SetRememberedDevices(devices []RememberedDevice) {
+	u.devices = devices
+}
+
+func (u *MyUser) GetRememberedDevices() []RememberedDevice {
+	return u.devices
+}
+
+func (u *MyUser) SetLoginToken(token string, created time.Time) {
+	u.loginToken = token
+	u.loginCreated = created
+}
+
+func (u *MyUser) GetLoginToken() (string, time.Time) {
+	return u.loginToken, u.loginCreated
+}
+
+func (u *MyUser) SetRoles(roles []string) {
+	u.roles = roles
+}
+
 func (u *MyUser) GetRoles() []string {
-	return nil
+	return u.roles
+}
+
+func (u *MyUser) SetDeletionToken(token string, requested time.Time) {
+	u.deletionToken = token
+	u.deletionTime = requested
+}
+
+func (u *MyUser) GetDeletionToken() (string, time.Time) {
+	return u.deletionToken, u.deletionTime
+}
+
+func (u *MyUser) SetSuspension(reason string, until time.Time) {
+	u.suspension = reason
+	u.suspendedUntil = until
+}
+
+func (u *MyUser) GetSuspension() (string, time.Time) {
+	return u.suspension, u.suspendedUntil
+}
+
+func (u *MyUser) SetStateBeforeSuspension(state int) {
+	u.stateBefore = state
+}
+
+func (u *MyUser) GetStateBeforeSuspension() int {
+	return u.stateBefore
+}
+
+func (u *MyUser) SetExpiry(expires time.Time) {
+	u.expires = expires
+}
+
+func (u *MyUser) GetExpiry() time.Time {
+	return u.expires
+}
+
+func (u *MyUser) SetApproved(approved bool) {
+	u.approved = approved
+}
+
+func (u *MyUser) GetApproved() bool {
+	return u.approved
 }
 
 func TestMain(m *testing.M) {
 	Config.HTMLTemplateDir = "test"
 	Config.MailTemplateDir = "test"
+	Config.PasswordPolicy.(*NISTPasswordPolicy).CommonPasswordsFile = "test/commonpasswords.txt"
 	Config.Log = log.New(ioutil.Discard, "", 0)
+	Config.CSRFProtection = false // Tested separately.
 	Config.NewUser = func() User {
 		return &MyUser{
 			id: sessions.CUID(),
@@ -101,6 +240,12 @@ func TestMain(m *testing.M) {
 // The function returns the response body as well as the email text that was
 // sent (if any).
 func runRequest(user User, get, post map[string]string, handler func(response http.ResponseWriter, request *http.Request)) (string, string) {
+	return runSessionRequest(user, nil, get, post, handler)
+}
+
+// Same as runRequest() but if "data" is not nil, the request will have a
+// session containing these session variables (even if "user" is nil).
+func runSessionRequest(user User, data map[string]interface{}, get, post map[string]string, handler func(response http.ResponseWriter, request *http.Request)) (string, string) {
 	// Make HTTP request.
 	method := "GET"
 	var reqBody string
@@ -129,16 +274,24 @@ func runRequest(user User, get, post map[string]string, handler func(response ht
 	response := httptest.NewRecorder()
 
 	// Log in user if required.
-	if user != nil {
+	if user != nil || data != nil {
 		sessions.PurgeSessions()
 		request.AddCookie(&http.Cookie{
 			Name:  "id",
 			Value: "01234567890123456789----",
 		})
+		var userID string
+		if user != nil {
+			userID = "abcd"
+		}
+		serializedData, err := json.Marshal(data)
+		if err != nil || data == nil {
+			serializedData = []byte("{}")
+		}
 		sessions.Persistence = sessions.ExtendablePersistenceLayer{
 			LoadSessionFunc: func(id string) (*sessions.Session, error) {
 				now := time.Now().Format(time.RFC3339)
-				serialized := fmt.Sprintf(`{"cr":"%s","da":{},"ip":"192.168.178.1:80","la":"%s","rf":"","ua":"0","us":"abcd","v":1}`, now, now)
+				serialized := fmt.Sprintf(`{"cr":"%s","da":%s,"ip":"192.168.178.1:80","la":"%s","rf":"","ua":"0","us":"%s","v":1}`, now, serializedData, now, userID)
 				session := &sessions.Session{}
 				if err := json.Unmarshal([]byte(serialized), session); err != nil {
 					panic(err)
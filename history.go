@@ -0,0 +1,61 @@
+package users
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHistoryUser is an optional extension of the User interface. Users
+// implementing it keep the hashes of their previous passwords so they cannot
+// reuse them (see Config.PasswordHistory). The most recent hash comes first.
+// The current password hash is not part of this list.
+type PasswordHistoryUser interface {
+	SetPasswordHistory(hashes [][]byte)
+	GetPasswordHistory() [][]byte
+}
+
+// passwordReused returns true if the given new password is one of the last
+// Config.PasswordHistory passwords of the user, including the current one. If
+// the user does not implement the PasswordHistoryUser interface, only the
+// current password is checked.
+func passwordReused(user User, password string) bool {
+	if Config.PasswordHistory <= 0 {
+		return false
+	}
+	hashes := [][]byte{user.GetPasswordHash()}
+	if historyUser, ok := user.(PasswordHistoryUser); ok {
+		hashes = append(hashes, historyUser.GetPasswordHistory()...)
+	}
+	if len(hashes) > Config.PasswordHistory {
+		hashes = hashes[:Config.PasswordHistory]
+	}
+	for _, hash := range hashes {
+		if len(hash) > 0 && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// setPasswordHash sets a user's new password hash, moving the current hash to
+// the user's password history if they implement the PasswordHistoryUser
+// interface and Config.PasswordHistory is larger than 1. For users
+// implementing the PasswordAgeUser interface, the time of the change is
+// recorded.
+func setPasswordHash(user User, hash []byte) {
+	if historyUser, ok := user.(PasswordHistoryUser); ok && Config.PasswordHistory > 1 {
+		history := historyUser.GetPasswordHistory()
+		if current := user.GetPasswordHash(); len(current) > 0 {
+			history = append([][]byte{current}, history...)
+		}
+		if len(history) > Config.PasswordHistory-1 {
+			history = history[:Config.PasswordHistory-1]
+		}
+		historyUser.SetPasswordHistory(history)
+	}
+	user.SetPasswordHash(hash)
+	if ageUser, ok := user.(PasswordAgeUser); ok {
+		ageUser.SetPasswordChanged(time.Now())
+	}
+}
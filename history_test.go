@@ -0,0 +1,25 @@
+package users
+
+import "testing"
+
+func TestSetPasswordHash(t *testing.T) {
+	Config.PasswordHistory = 3
+	defer func() { Config.PasswordHistory = 0 }()
+	user := &MyUser{}
+	for _, hash := range []string{"a", "b", "c", "d"} {
+		setPasswordHash(user, []byte(hash))
+	}
+	assertString("d", string(user.passwordHash), t)
+	if len(user.history) != 2 {
+		t.Fatalf("Expected 2 hashes in history, got %d", len(user.history))
+	}
+	assertString("c", string(user.history[0]), t)
+	assertString("b", string(user.history[1]), t)
+}
+
+func TestPasswordReusedOff(t *testing.T) {
+	user := &MyUser{passwordHash: []byte("$2a$04$l7kGFwuVt9CQMWdXuvA7wevaMMEzr.4O9SCEZzY8vP.UgUoGzsPCa")}
+	if passwordReused(user, "kjhvasfiuwbucj") {
+		t.Error("Password reuse was detected although history is turned off")
+	}
+}
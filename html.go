@@ -71,6 +71,20 @@ func retrieveTemplate(request *http.Request, htmlTemplate string) (tmpl *templat
 				m["title"] = values[1]
 				return m
 			},
+			"totp": func(user interface{}) bool {
+				// Determine if a user has enabled two-factor authentication.
+				u, ok := user.(User)
+				return ok && totpEnabled(u)
+			},
+			"state": func(state int) string {
+				// Return a readable name for a user state.
+				return stateName(state)
+			},
+			"can": func(user interface{}, permission string) bool {
+				// Determine if a user has a permission.
+				u, ok := user.(User)
+				return ok && Can(u, permission)
+			},
 		})
 
 		// Load template and includes.
@@ -98,7 +112,10 @@ func retrieveTemplate(request *http.Request, htmlTemplate string) (tmpl *templat
 // browser. It also instructs the browser not to cache this page. Other
 // templates used by this htmlTemplate must be specified in
 // Config.HTMLTemplateIncludes (with the exception of error and message
-// templates which are included automatically).
+// templates which are included automatically). If the data is a map and
+// Config.CSRFProtection is true, the session's CSRF token is added to it under
+// the "csrf" key. If an administrator is impersonating the current user, they
+// are added under the "impersonator" key.
 func RenderPage(response http.ResponseWriter, request *http.Request, htmlTemplate string, data interface{}) {
 	// This is a simple version of RenderProgramError(), used here to avoid
 	// an endless recursion.
@@ -120,6 +137,8 @@ func RenderPage(response http.ResponseWriter, request *http.Request, htmlTemplat
 	}
 
 	// Execute the template and send it to the browser.
+	addCSRFToken(response, request, data)
+	addImpersonator(response, request, data)
 	response.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	response.Header().Set("Pragma", "no-cache")
 	response.Header().Set("Expires", "0")
@@ -180,7 +199,6 @@ func RenderPageError(response http.ResponseWriter, request *http.Request, htmlTe
 		return
 	}
 
-	response.WriteHeader(http.StatusBadRequest)
 	data := map[string]interface{}{
 		"config": Config,
 		"error":  template.HTML(strings.TrimSpace(string(errMsg.Bytes()))),
@@ -189,5 +207,7 @@ func RenderPageError(response http.ResponseWriter, request *http.Request, htmlTe
 	if user != nil {
 		data["user"] = user
 	}
+	addCSRFToken(response, request, data) // Before any headers are written.
+	response.WriteHeader(http.StatusBadRequest)
 	RenderPage(response, request, htmlTemplate, data)
 }
@@ -0,0 +1,182 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// startImpersonation logs the given administrator into the current session as
+// the given user. The administrator's identity and the end of the
+// impersonation (see Config.ImpersonationDuration) are remembered in the
+// session.
+func startImpersonation(response http.ResponseWriter, request *http.Request, admin, user User) error {
+	if Config.ImpersonationDuration <= 0 {
+		return errors.New("Impersonation is turned off")
+	}
+	session, err := sessions.Start(response, request, true)
+	if err != nil {
+		return err
+	}
+	if err := session.Set(sessionKeyImpersonator, admin.GetEmail()); err != nil {
+		return err
+	}
+	if err := session.Set(sessionKeyImpersonationEnd, time.Now().Add(Config.ImpersonationDuration).Format(time.RFC3339)); err != nil {
+		return err
+	}
+	if err := session.LogIn(user, false, response); err != nil {
+		return err
+	}
+	Config.Log.Printf("Admin %s (%s) started impersonating user %s (%s)", admin.GetID(), admin.GetEmail(), user.GetID(), user.GetEmail())
+	return nil
+}
+
+// stopImpersonation logs the administrator who impersonates the session's
+// current user back into the session and returns them. If the administrator
+// cannot be loaded anymore, the session is logged out and nil is returned. The
+// "reason" is used for logging.
+func stopImpersonation(response http.ResponseWriter, session *sessions.Session, reason string) (User, error) {
+	admin := Impersonator(session)
+	var user User
+	if u, ok := session.User().(User); ok {
+		user = u
+	}
+	if err := clearImpersonation(session); err != nil {
+		return nil, err
+	}
+	if admin == nil {
+		return nil, session.LogOut()
+	}
+	if err := session.LogIn(admin, false, response); err != nil {
+		return nil, err
+	}
+	if user != nil {
+		Config.Log.Printf("Admin %s (%s) stopped impersonating user %s (%s): %s", admin.GetID(), admin.GetEmail(), user.GetID(), user.GetEmail(), reason)
+		if Config.AdminAction != nil {
+			Config.AdminAction(admin, user, "stopimpersonation")
+		}
+	}
+	return admin, nil
+}
+
+// clearImpersonation removes all information about an impersonation from the
+// given session.
+func clearImpersonation(session *sessions.Session) error {
+	if err := session.Delete(sessionKeyImpersonator); err != nil {
+		return err
+	}
+	return session.Delete(sessionKeyImpersonationEnd)
+}
+
+// Impersonator returns the administrator who is currently impersonating the
+// user logged into the given session (see Admin()), or nil if the session's
+// user is not being impersonated.
+func Impersonator(session *sessions.Session) User {
+	if session == nil {
+		return nil
+	}
+	email, _ := session.Get(sessionKeyImpersonator, "").(string)
+	if email == "" {
+		return nil
+	}
+	admin, err := Config.LoadUserByEmail(lookupEmail(email))
+	if err != nil {
+		Config.Log.Printf("Could not load impersonating admin %s: %s", email, err)
+		return nil
+	}
+	return admin
+}
+
+// addImpersonator adds the administrator impersonating the current user under
+// the "impersonator" key to the given template data if it is a map and if
+// there is such an administrator.
+func addImpersonator(response http.ResponseWriter, request *http.Request, data interface{}) {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if _, ok := m["impersonator"]; ok {
+		return
+	}
+	session, err := sessions.Start(response, request, false)
+	if err != nil || session == nil {
+		return
+	}
+	if admin := Impersonator(session); admin != nil {
+		m["impersonator"] = admin
+	}
+}
+
+// impersonationExpired returns true if the session contains an impersonation
+// whose time has run out.
+func impersonationExpired(session *sessions.Session) bool {
+	end, _ := session.Get(sessionKeyImpersonationEnd, "").(string)
+	if end == "" {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, end)
+	return err != nil || t.Before(time.Now())
+}
+
+// blockImpersonation renders the "accessdenied.gohtml" template (with an
+// "impersonating" key set to true) and returns true if the current user is
+// being impersonated. Handlers which change sensitive account information call
+// this function first.
+func blockImpersonation(response http.ResponseWriter, request *http.Request) bool {
+	session, err := sessions.Start(response, request, false)
+	if err != nil || session == nil {
+		return false
+	}
+	admin := Impersonator(session)
+	if admin == nil {
+		return false
+	}
+	Config.Log.Printf("Admin %s (%s) was blocked from %s while impersonating", admin.GetID(), admin.GetEmail(), request.RequestURI)
+	data := map[string]interface{}{"config": Config, "user": session.User(), "impersonating": true}
+	addCSRFToken(response, request, data) // Before any headers are written.
+	response.WriteHeader(http.StatusForbidden)
+	RenderPage(response, request, "accessdenied.gohtml", data)
+	return true
+}
+
+// StopImpersonation ends the impersonation of a user by an administrator (see
+// Admin()) upon a POST request. The administrator is logged back in and
+// redirected to the impersonated user's page in the user administration. If
+// no user is being impersonated, the request is redirected to
+// Config.RouteLoggedIn.
+func StopImpersonation(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	if request.Method != "POST" {
+		RenderProgramError(response, request, "Stop impersonation request method was "+request.Method, "Method must be POST", nil)
+		return
+	}
+	session, err := sessions.Start(response, request, false)
+	if err != nil {
+		RenderProgramError(response, request, "Error starting session when stopping impersonation", "Could not start user session", err)
+		return
+	}
+	if session == nil || Impersonator(session) == nil {
+		http.Redirect(response, request, Config.RouteLoggedIn, 302)
+		return
+	}
+	var email string
+	if user, ok := session.User().(User); ok {
+		email = user.GetEmail()
+	}
+	admin, err := stopImpersonation(response, session, "returned to admin account")
+	if err != nil {
+		RenderProgramError(response, request, "Could not stop impersonation", "", err)
+		return
+	}
+	if admin == nil {
+		http.Redirect(response, request, Config.RouteLoggedOut, 302)
+		return
+	}
+	http.Redirect(response, request, fmt.Sprintf("%s?email=%s", Config.RouteAdmin, url.QueryEscape(email)), 302)
+}
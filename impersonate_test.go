@@ -0,0 +1,95 @@
+package users
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// testSession returns the session used by the last runRequest() call.
+func testSession() *sessions.Session {
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(&http.Cookie{Name: "id", Value: "01234567890123456789----"})
+	session, _ := sessions.Start(httptest.NewRecorder(), request, false)
+	return session
+}
+
+// impersonation returns session data for an impersonation by "admin@z" which
+// ends at the given time.
+func impersonation(end time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		sessionKeyImpersonator:     "admin@z",
+		sessionKeyImpersonationEnd: end.Format(time.RFC3339),
+	}
+}
+
+func TestImpersonate(t *testing.T) {
+	user := &MyUser{id: "u", email: "u@x", state: StateVerified}
+	other := &MyUser{id: "o", email: "o@x", state: StateVerified, roles: []string{"admin"}}
+	admin, restore := setUpAdmin([]*MyUser{user, other})
+	defer restore()
+	var audit []string
+	Config.AdminAction = func(admin, user User, action string) {
+		audit = append(audit, action+":"+user.GetEmail())
+	}
+
+	computed, _ := runRequest(admin, nil, map[string]string{"email": "u@x", "action": "impersonate"}, Admin)
+	assertString("redirect", computed, t)
+	session := testSession()
+	if session.User() != user {
+		t.Error("Admin is not logged in as the user")
+	}
+	if Impersonator(session) != admin {
+		t.Error("Impersonator not remembered")
+	}
+
+	// Admins cannot be impersonated.
+	computed, _ = runRequest(admin, nil, map[string]string{"email": "o@x", "action": "impersonate"}, Admin)
+	assertString("HIAUverified!IMD!F", computed, t)
+	computed, _ = runRequest(admin, nil, map[string]string{"email": "admin@z", "action": "impersonate"}, Admin)
+	assertString("HIAUverified!ASF!F", computed, t)
+
+	// Return to the admin account.
+	computed, _ = runSessionRequest(user, impersonation(time.Now().Add(time.Minute)), nil, map[string]string{}, StopImpersonation)
+	assertString("redirect", computed, t)
+	session = testSession()
+	if session.User() != admin || Impersonator(session) != nil {
+		t.Error("Admin was not logged back in")
+	}
+	assertString("impersonate:u@x,stopimpersonation:u@x", strings.Join(audit, ","), t)
+}
+
+func TestImpersonationBanner(t *testing.T) {
+	user := &MyUser{id: "u", email: "u@x", state: StateVerified}
+	_, restore := setUpAdmin([]*MyUser{user})
+	defer restore()
+	computed, _ := runSessionRequest(user, impersonation(time.Now().Add(time.Minute)), nil, nil, func(response http.ResponseWriter, request *http.Request) {
+		RenderPageBasic(response, request, "verified.gohtml", user)
+	})
+	assertString("HI*VF", computed, t)
+
+	// Sensitive pages are blocked.
+	computed, _ = runSessionRequest(user, impersonation(time.Now().Add(time.Minute)), nil, nil, Change)
+	assertString("HI*ADF", computed, t)
+	computed, _ = runSessionRequest(user, impersonation(time.Now().Add(time.Minute)), nil, map[string]string{"action": "invite", "email": "new@x"}, Invite)
+	assertString("HI*ADF", computed, t)
+}
+
+func TestImpersonationExpiry(t *testing.T) {
+	user := &MyUser{id: "u", email: "u@x", state: StateVerified}
+	_, restore := setUpAdmin([]*MyUser{user})
+	defer restore()
+	computed, _ := runSessionRequest(user, impersonation(time.Now().Add(-time.Minute)), nil, nil, func(response http.ResponseWriter, request *http.Request) {
+		if user, _, _ := IsLoggedIn(response, request); user != nil {
+			response.Write([]byte(user.GetEmail()))
+		}
+	})
+	assertString("admin@z", computed, t)
+	if Impersonator(testSession()) != nil {
+		t.Error("Impersonation did not end")
+	}
+}
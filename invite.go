@@ -0,0 +1,301 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/rivo/sessions"
+)
+
+// Invitation is an invitation to create a user account, sent by email (see
+// Invite()). Invitations are stored with Config.SaveInvitation and removed
+// once they have been accepted or revoked.
+type Invitation struct {
+	// A random 22 character long string identifying this invitation. It is
+	// part of the link sent to the invited person.
+	Token string
+
+	// The email address of the invited person.
+	Email string
+
+	// The roles which are assigned to the new user (if they implement the
+	// RoleUser interface).
+	Roles []string
+
+	// The ID and the email address of the user who sent the invitation.
+	InviterID    interface{}
+	InviterEmail string
+
+	// The time the invitation was sent and the time after which it cannot be
+	// accepted anymore.
+	Created time.Time
+	Expires time.Time
+}
+
+// Invite lets users send invitations to create an account (see
+// AcceptInvitation()). It is only accessible to logged-in users with the
+// permission Config.InvitePermission or, if that is empty, to all users in a
+// state granting access (see RequireVerified()). Administrators impersonating
+// a user (see Admin()) cannot use it.
+//
+// Upon a GET request, the "invite.gohtml" template is rendered with the
+// user's pending invitations (all pending invitations for users with the
+// permission Config.AdminPermission) under the "infos" key. Upon a POST
+// request, the action given in the "action" field is performed:
+//
+//   - "invite": An invitation to the address given in the "email" field is
+//     sent (using the "invitation.tmpl" mail template). It is valid for
+//     Config.InvitationValidity. The address's domain must pass the checks
+//     configured with Config.AllowedDomains, Config.BlockedDomains, and
+//     Config.BlockDisposableDomains, unless the user has the permission
+//     Config.AdminPermission. Such users may also pre-assign roles, provided
+//     in the "roles" field (separated by spaces or commas).
+//   - "revoke": The invitation identified by the "token" field is removed.
+//     Users may only revoke their own invitations, unless they have the
+//     permission Config.AdminPermission.
+//
+// After both actions, the user is redirected to Config.RouteInvite.
+func Invite(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	if blockImpersonation(response, request) {
+		return
+	}
+	if Config.InvitePermission == "" {
+		RequireVerified(http.HandlerFunc(invite)).ServeHTTP(response, request)
+		return
+	}
+	RequirePermission(Config.InvitePermission, http.HandlerFunc(invite)).ServeHTTP(response, request)
+}
+
+// invite implements Invite() for users who passed the permission check.
+func invite(response http.ResponseWriter, request *http.Request) {
+	inviter := UserFromContext(request.Context())
+	isAdmin := Can(inviter, Config.AdminPermission)
+
+	// Collect pending invitations.
+	var list []*Invitation
+	if err := Config.ForEachInvitation(func(invitation *Invitation) error {
+		if isAdmin || invitation.InviterID == inviter.GetID() {
+			list = append(list, invitation)
+		}
+		return nil
+	}); err != nil {
+		RenderProgramError(response, request, "Could not iterate over invitations", "", err)
+		return
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.After(list[j].Created)
+	})
+	infos := map[string]interface{}{"invitations": list, "admin": isAdmin, "now": time.Now()}
+
+	if request.Method != "POST" {
+		RenderPage(response, request, "invite.gohtml", map[string]interface{}{"config": Config, "user": inviter, "infos": infos})
+		return
+	}
+
+	switch action := request.PostFormValue("action"); action {
+	case "invite":
+		// Check the email address.
+		address := request.PostFormValue("email")
+		email, err := NormalizeEmail(address)
+		if err != nil {
+			Config.Log.Printf("User %s (%s) tried to invite invalid email %q: %s", inviter.GetID(), inviter.GetEmail(), address, err)
+			infos["email"] = address
+			RenderPageError(response, request, "invite.gohtml", "invalidemail", infos, inviter)
+			return
+		}
+		infos["email"] = email
+		existingUser, err := Config.LoadUserByEmail(lookupEmail(email))
+		if err != nil {
+			RenderProgramError(response, request, "Could not load user for invitation: "+email, "Could not load user", err)
+			return
+		}
+		if existingUser != nil {
+			Config.Log.Printf("User %s (%s) tried to invite existing user %s", inviter.GetID(), inviter.GetEmail(), email)
+			RenderPageError(response, request, "invite.gohtml", "userexists", infos, inviter)
+			return
+		}
+
+		// Check the email domain. Administrators may invite anyone.
+		if !isAdmin {
+			reason, err := checkEmailDomain(email)
+			if err != nil {
+				RenderProgramError(response, request, "Could not check email domain", "", err)
+				return
+			}
+			if reason != "" {
+				Config.Log.Printf("User %s (%s) tried to invite %s, domain %s", inviter.GetID(), inviter.GetEmail(), email, reason)
+				infos["reason"] = reason
+				RenderPageError(response, request, "invite.gohtml", "emaildomain", infos, inviter)
+				return
+			}
+		}
+
+		// Create the invitation.
+		token, err := sessions.RandomID(22)
+		if err != nil {
+			RenderProgramError(response, request, "Could not generate invitation token", "", err)
+			return
+		}
+		now := time.Now()
+		invitation := &Invitation{
+			Token:        token,
+			Email:        email,
+			InviterID:    inviter.GetID(),
+			InviterEmail: inviter.GetEmail(),
+			Created:      now,
+			Expires:      now.Add(Config.InvitationValidity),
+		}
+		if isAdmin {
+			invitation.Roles = strings.FieldsFunc(request.PostFormValue("roles"), func(r rune) bool {
+				return r == ',' || r == ' '
+			})
+		}
+		if err := Config.SaveInvitation(invitation); err != nil {
+			RenderProgramError(response, request, "Could not save invitation for "+email, "Could not save invitation", err)
+			return
+		}
+
+		// Send it.
+		if err := SendMail(request, email, "invitation.tmpl", map[string]interface{}{
+			"email":    email,
+			"token":    token,
+			"inviter":  inviter.GetEmail(),
+			"validity": invitation.Expires.Format("Monday, Jan 2, 2006, 15:04:05"),
+			"config":   Config,
+		}); err != nil {
+			RenderProgramError(response, request, "Could not send invitation email", "", err)
+			return
+		}
+		Config.Log.Printf("User %s (%s) invited %s", inviter.GetID(), inviter.GetEmail(), email)
+	case "revoke":
+		token := request.PostFormValue("token")
+		invitation, err := Config.LoadInvitation(token)
+		if err != nil {
+			RenderProgramError(response, request, "Could not load invitation", "", err)
+			return
+		}
+		if invitation == nil || !isAdmin && invitation.InviterID != inviter.GetID() {
+			RenderProgramError(response, request, fmt.Sprintf("User %s (%s) tried to revoke unknown invitation %s", inviter.GetID(), inviter.GetEmail(), token), "Invitation not found", nil)
+			return
+		}
+		if err := Config.DeleteInvitation(token); err != nil {
+			RenderProgramError(response, request, "Could not delete invitation", "", err)
+			return
+		}
+		Config.Log.Printf("User %s (%s) revoked the invitation for %s", inviter.GetID(), inviter.GetEmail(), invitation.Email)
+	default:
+		RenderProgramError(response, request, fmt.Sprintf("Unknown invitation action %q", action), "Unknown action", nil)
+		return
+	}
+
+	http.Redirect(response, request, Config.RouteInvite, 302)
+}
+
+// AcceptInvitation is the target of the link sent by Invite(). Upon a GET
+// request with a valid "token" parameter, the "acceptinvitation.gohtml"
+// template is rendered where the invited person chooses a password. Upon a
+// POST request, the user account is created in StateVerified (the link proves
+// that they own the email address), the invitation's roles are assigned, the
+// invitation is removed, and the new user is logged in. If the token is
+// unknown or the invitation has expired, the "acceptinvitation.gohtml" template
+// is rendered with an error.
+func AcceptInvitation(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	// Throttle attempts.
+	if Config.ThrottleVerification != nil {
+		Config.ThrottleVerification()
+	}
+
+	// Check the invitation.
+	token := request.FormValue("token")
+	invitation, err := Config.LoadInvitation(token)
+	if err != nil {
+		RenderProgramError(response, request, "Could not load invitation: "+token, "Could not load invitation", err)
+		return
+	}
+	if token == "" || invitation == nil {
+		Config.Log.Printf("Invitation token unknown: %s", token)
+		RenderPageError(response, request, "acceptinvitation.gohtml", "invitationnotfound", nil, nil)
+		return
+	}
+	if invitation.Expires.Before(time.Now()) {
+		Config.Log.Printf("Invitation for %s expired: %s", invitation.Email, token)
+		RenderPageError(response, request, "acceptinvitation.gohtml", "invitationexpired", nil, nil)
+		return
+	}
+	infos := map[string]interface{}{"token": token, "email": invitation.Email}
+
+	if request.Method != "POST" {
+		RenderPage(response, request, "acceptinvitation.gohtml", map[string]interface{}{"config": Config, "infos": infos})
+		return
+	}
+
+	// Check the password.
+	password := request.PostFormValue("password")
+	if password != request.PostFormValue("passwordconfirm") {
+		Config.Log.Printf("Passwords for %s don't match", invitation.Email)
+		RenderPageError(response, request, "acceptinvitation.gohtml", "passwordsdontmatch", infos, nil)
+		return
+	}
+	violations, err := validatePassword(password, invitation.Email)
+	if err != nil {
+		RenderProgramError(response, request, "Could not check password", "", err)
+		return
+	}
+	if len(violations) > 0 {
+		Config.Log.Printf("Password was rejected for %s, reasons: %v", invitation.Email, violations)
+		infos["violations"] = violations
+		RenderPageError(response, request, "acceptinvitation.gohtml", "invalidpassword", infos, nil)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+	if err != nil {
+		RenderProgramError(response, request, "Could not generate password hash", "", err)
+		return
+	}
+
+	// Create the user.
+	if Config.NewUser == nil {
+		RenderProgramError(response, request, "NewUser is not implemented", "", nil)
+		return
+	}
+	user := Config.NewUser()
+	user.SetState(StateVerified)
+	user.SetEmail(invitation.Email)
+	setPasswordHash(user, hash)
+	if roleUser, ok := user.(RoleUser); ok && len(invitation.Roles) > 0 {
+		roleUser.SetRoles(invitation.Roles)
+	}
+	if approvalUser, ok := user.(ApprovalUser); ok {
+		approvalUser.SetApproved(true) // The invitation serves as the approval.
+	}
+	existingUser, err := Config.SaveNewUserAtomic(user)
+	if err != nil {
+		RenderProgramError(response, request, "Could not save invited user: "+invitation.Email, "Could not save user", err)
+		return
+	}
+	if existingUser != nil {
+		Config.Log.Printf("Invitation accepted for existing user %s (%s)", existingUser.GetID(), invitation.Email)
+		RenderPageError(response, request, "acceptinvitation.gohtml", "userexists", nil, nil)
+		return
+	}
+	if err := Config.DeleteInvitation(token); err != nil {
+		RenderProgramError(response, request, "Could not delete accepted invitation", "", err)
+		return
+	}
+	Config.Log.Printf("User %s (%s) accepted the invitation of %s", user.GetID(), user.GetEmail(), invitation.InviterEmail)
+
+	// Log the new user in.
+	completeLogIn(response, request, user, false, "")
+}
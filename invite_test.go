@@ -0,0 +1,132 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvite(t *testing.T) {
+	admin, restore := setUpAdmin(nil)
+	defer restore()
+	defer func() {
+		invitations = make(map[string]*Invitation)
+	}()
+	user := &MyUser{id: "u", email: "u@x", state: StateVerified}
+
+	// Users need the invite permission.
+	computed, _ := runRequest(user, nil, nil, Invite)
+	assertString("HIADF", computed, t)
+	computed, _ = runRequest(admin, nil, nil, Invite)
+	assertString("HIIN0F", computed, t)
+
+	// Invite a new user.
+	computed, mail := runRequest(admin, nil, map[string]string{"action": "invite", "email": "New@x", "roles": "editor, viewer"}, Invite)
+	assertString("redirect", computed, t)
+	if len(invitations) != 1 {
+		t.Fatalf("Expected one invitation, got %d", len(invitations))
+	}
+	var invitation *Invitation
+	for _, invitation = range invitations {
+	}
+	assertString("INV"+invitation.Token, strings.TrimSpace(mail), t)
+	if invitation.Email != "New@x" || invitation.InviterID != "admin" || len(invitation.Roles) != 2 || invitation.Roles[1] != "viewer" {
+		t.Errorf("Unexpected invitation: %+v", invitation)
+	}
+	if !invitation.Expires.After(time.Now().Add(Config.InvitationValidity - time.Minute)) {
+		t.Errorf("Unexpected invitation expiry: %s", invitation.Expires)
+	}
+	computed, _ = runRequest(admin, nil, map[string]string{"action": "invite", "email": "admin@z"}, Invite)
+	assertString("HIIN1!UEX!F", computed, t)
+
+	// Without an invite permission, all users may invite but only see their own
+	// invitations and cannot assign roles.
+	Config.InvitePermission = ""
+	defer func() {
+		Config.InvitePermission = "users.invite"
+	}()
+	computed, _ = runRequest(user, nil, nil, Invite)
+	assertString("HIIN0F", computed, t)
+	computed, _ = runRequest(user, nil, map[string]string{"action": "invite", "email": "other@x", "roles": "admin"}, Invite)
+	assertString("redirect", computed, t)
+	computed, _ = runRequest(user, nil, nil, Invite)
+	assertString("HIIN1F", computed, t)
+	for _, other := range invitations {
+		if other.Email == "other@x" && len(other.Roles) > 0 {
+			t.Error("Roles were assigned without admin permission")
+		}
+	}
+
+	// Only administrators may invite addresses from blocked domains.
+	Config.BlockedDomains = []string{"blocked.example"}
+	defer func() {
+		Config.BlockedDomains = nil
+	}()
+	computed, _ = runRequest(user, nil, map[string]string{"action": "invite", "email": "u@blocked.example"}, Invite)
+	assertString("HIIN1!EDblocked!F", computed, t)
+	computed, _ = runRequest(admin, nil, map[string]string{"action": "invite", "email": "u@blocked.example"}, Invite)
+	assertString("redirect", computed, t)
+
+	// Revoke.
+	computed, _ = runRequest(user, nil, map[string]string{"action": "revoke", "token": invitation.Token}, Invite)
+	if !strings.Contains(computed, "PE") {
+		t.Errorf("User revoked a foreign invitation: %s", computed)
+	}
+	computed, _ = runRequest(admin, nil, map[string]string{"action": "revoke", "token": invitation.Token}, Invite)
+	assertString("redirect", computed, t)
+	if _, ok := invitations[invitation.Token]; ok || len(invitations) != 2 {
+		t.Error("Invitation was not revoked")
+	}
+}
+
+func TestAcceptInvitation(t *testing.T) {
+	backup := users
+	users = nil
+	defer func() {
+		users = backup
+		invitations = make(map[string]*Invitation)
+	}()
+	Config.Roles = map[string]Role{"editor": {Permissions: []string{"posts.edit"}}}
+	defer func() {
+		Config.Roles = nil
+	}()
+	now := time.Now()
+	invitations["valid"] = &Invitation{Token: "valid", Email: "new@x", Roles: []string{"editor"}, Created: now, Expires: now.Add(time.Hour)}
+	invitations["expired"] = &Invitation{Token: "expired", Email: "old@x", Created: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)}
+
+	computed, _ := runRequest(nil, map[string]string{"token": "unknown"}, nil, AcceptInvitation)
+	assertString("HOAI!INF!F", computed, t)
+	computed, _ = runRequest(nil, map[string]string{"token": "expired"}, nil, AcceptInvitation)
+	assertString("HOAI!IEX!F", computed, t)
+	computed, _ = runRequest(nil, map[string]string{"token": "valid"}, nil, AcceptInvitation)
+	assertString("HOAInew@xF", computed, t)
+	computed, _ = runRequest(nil, nil, map[string]string{"token": "valid", "password": "correct horse battery", "passwordconfirm": "correct horse"}, AcceptInvitation)
+	assertString("HOAInew@x!2!F", computed, t)
+
+	// Accept.
+	computed, _ = runRequest(nil, nil, map[string]string{"token": "valid", "password": "correct horse battery", "passwordconfirm": "correct horse battery"}, AcceptInvitation)
+	assertString("redirect", computed, t)
+	if len(users) != 1 {
+		t.Fatalf("Expected one user, got %d", len(users))
+	}
+	user := users[0].(*MyUser)
+	if user.email != "new@x" || user.state != StateVerified || !Can(user, "posts.edit") {
+		t.Errorf("Unexpected user: %s, state %d, roles %v", user.email, user.state, user.roles)
+	}
+	if _, ok := invitations["valid"]; ok {
+		t.Error("Invitation was not removed")
+	}
+	computed, _ = runRequest(nil, map[string]string{"token": "valid"}, nil, AcceptInvitation)
+	assertString("HOAI!INF!F", computed, t)
+}
+
+func TestSignUpInviteOnly(t *testing.T) {
+	Config.InviteOnly = true
+	defer func() {
+		Config.InviteOnly = false
+	}()
+	computed, _ := runRequest(nil, nil, nil, SignUp)
+	assertString("HOSCF", computed, t)
+	computed, _ = runRequest(nil, nil, map[string]string{"email": "a@x", "password": "correct horse battery", "passwordconfirm": "correct horse battery"}, SignUp)
+	assertString("HOSCF", computed, t)
+}
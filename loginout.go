@@ -4,33 +4,61 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/rivo/sessions"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Keys of session variables used by this package.
+const (
+	sessionKeyPasswordChange    = "users_passwordchange"    // The email address of a user who must change their password before being logged in.
+	sessionKeyPasswordChangeEnd = "users_passwordchangeend" // The time (RFC 3339) at which a pending password change runs out.
+	sessionKeySecondFactor      = "users_secondfactor"      // The email address of a user who must provide a second factor before being logged in.
+	sessionKeyTOTPSecret        = "users_totpsecret"        // A TOTP secret which is being enrolled but has not been confirmed yet.
+	sessionKeyWebAuthnChallenge = "users_webauthnchallenge" // The challenge of a pending WebAuthn registration or login.
+	sessionKeyRemember          = "users_remember"          // Set if the user wants to stay logged in once their pending login is complete.
+	sessionKeyNext              = "users_next"              // The page to which the user is redirected once their pending login is complete.
+	sessionKeyImpersonator      = "users_impersonator"      // The email address of an administrator who is impersonating the session's user.
+	sessionKeyImpersonationEnd  = "users_impersonationend"  // The time (RFC 3339) at which an impersonation ends.
+	sessionKeyCSRF              = "users_csrf"              // The token which must be included in all POST requests (see Config.CSRFProtection).
+)
+
 // LogIn logs a user into the system, i.e. attaches their User object to the
 // current session. Upon a GET request, the "login.gohtml" template is shown
 // if no user is logged in yet. If they are logged in (which is checked by
 // calling IsLoggedIn()), they are redirected to Config.RouteLoggedIn. A POST
 // request will cause a login attempt. After a successful login attempt, users
-// are redirected to Config.RouteLoggedIn.
+// are redirected to Config.RouteLoggedIn or, if a "next" parameter was
+// provided (see LogInURL()), to that page. The parameter is passed to the
+// template under the "infos" key and must be a local path which starts with
+// one of the prefixes in Config.NextPaths. Users who enabled two-factor
+// authentication are not logged in yet but redirected to
+// Config.RouteTOTPChallenge (see TOTPChallenge()) or, if they only registered
+// WebAuthn credentials, to Config.RouteWebAuthnLogIn (see WebAuthnLogIn()).
+// Users whose password has expired or who were flagged for a password change
+// are not logged in but redirected to Config.RoutePasswordChange instead (see
+// ChangePassword()).
 func LogIn(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	next := safeNext(request.FormValue("next"))
 	if request.Method == "GET" {
 		// If we're already logged in, skip ahead.
 		if user, _, _ := IsLoggedIn(response, request); user != nil {
 			Config.Log.Printf("Login page visited while logged in with %s (%s)", user.GetID(), user.GetEmail())
-			http.Redirect(response, request, Config.RouteLoggedIn, 302)
+			http.Redirect(response, request, loggedInRoute(user, next), 302)
 			return
 		}
 
 		// Display a login form.
-		RenderPageBasic(response, request, "login.gohtml", nil)
+		RenderPage(response, request, "login.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"next": next}})
 		return
 	}
 
-	email := strings.ToLower(request.PostFormValue("email"))
+	email := lookupEmail(request.PostFormValue("email"))
 	password := request.PostFormValue("password")
 
 	// Throttle attempts.
@@ -46,45 +74,155 @@ func LogIn(response http.ResponseWriter, request *http.Request) {
 	}
 	if user == nil {
 		Config.Log.Printf("Non-existing email entered during login: %s", email)
-		RenderPageError(response, request, "login.gohtml", "wronglogin", nil, nil)
+		RenderPageError(response, request, "login.gohtml", "wronglogin", map[string]string{"next": next}, nil)
 		return
 	}
 
 	// Check password.
 	if er := bcrypt.CompareHashAndPassword(user.GetPasswordHash(), []byte(password)); er != nil {
 		Config.Log.Printf(`Login password not correct: %s (%s)`, user.GetID(), email)
-		RenderPageError(response, request, "login.gohtml", "wronglogin", nil, nil)
+		RenderPageError(response, request, "login.gohtml", "wronglogin", map[string]string{"next": next}, nil)
 		return
 	}
 
 	// Is the user in the correct state?
-	switch user.GetState() {
-	case StateVerified, StateExpired:
-	case StateCreated:
-		Config.Log.Printf(`Login attempted despite account not yet verified: %s (%s)`, user.GetID(), email)
-		RenderPageError(response, request, "signup.gohtml", "verificationincomplete", map[string]string{}, nil)
-		return
-	default:
-		RenderProgramError(response, request, fmt.Sprintf("Unknown user state %d: %s (%s)", user.GetState(), user.GetID(), email), "Invalid user state", nil)
+	if !checkLogInState(response, request, user) {
 		return
 	}
 
+	// Flag the user for a password change if their password was breached.
+	if Config.BreachedPasswords != nil {
+		if changeUser, ok := user.(PasswordChangeUser); ok && !changeUser.GetPasswordChangeRequired() {
+			breached, err := Config.BreachedPasswords.Contains(password)
+			if err != nil {
+				Config.Log.Printf("Could not check password of %s (%s) for breaches: %s", user.GetID(), email, err)
+			} else if breached {
+				changeUser.SetPasswordChangeRequired(true)
+				if err := Config.UpdateUser(user); err != nil {
+					RenderProgramError(response, request, fmt.Sprintf("Could not flag user %s (%s) for password change", user.GetID(), email), "Could not update user", err)
+					return
+				}
+				Config.Log.Printf("Password of user %s (%s) was found in breach corpus, password change required", user.GetID(), email)
+			}
+		}
+	}
+
+	// Does the user want to stay logged in?
+	remember := Config.RememberMe > 0 && request.PostFormValue("remember") != ""
+
 	// Log the user in.
+	checkSecondFactor(response, request, user, remember, next)
+}
+
+// checkSecondFactor is called when a user has provided their first factor,
+// e.g. their password. If they enabled two-factor authentication, they are
+// redirected to Config.RouteTOTPChallenge or Config.RouteWebAuthnLogIn.
+// Otherwise, proceedLogIn() is called.
+func checkSecondFactor(response http.ResponseWriter, request *http.Request, user User, remember bool, next string) {
+	if totpEnabled(user) || webAuthnEnabled(user) {
+		session, err := sessions.Start(response, request, true)
+		if err != nil {
+			RenderProgramError(response, request, "Error starting session during login", "Could not start user session", err)
+			return
+		}
+		if err := session.Set(sessionKeySecondFactor, user.GetEmail()); err != nil {
+			RenderProgramError(response, request, "Could not save pending second factor in session", "Could not start user session", err)
+			return
+		}
+		if err := saveRememberChoice(session, remember); err != nil {
+			RenderProgramError(response, request, "Could not save remember-me choice in session", "Could not start user session", err)
+			return
+		}
+		if err := saveNext(session, next); err != nil {
+			RenderProgramError(response, request, "Could not save next page in session", "Could not start user session", err)
+			return
+		}
+		Config.Log.Printf("User %s (%s) needs to provide a second factor before logging in", user.GetID(), user.GetEmail())
+		route := Config.RouteTOTPChallenge
+		if !totpEnabled(user) {
+			route = Config.RouteWebAuthnLogIn
+		}
+		http.Redirect(response, request, route, 302)
+		return
+	}
+
+	proceedLogIn(response, request, user, remember, next)
+}
+
+// proceedLogIn is called when a user has been authenticated. If they need to
+// choose a new password first, they are redirected to
+// Config.RoutePasswordChange. Otherwise, completeLogIn() is called. The
+// "remember" flag indicates whether the user wants to stay logged in, "next"
+// is the page they will be redirected to afterwards (if not empty).
+func proceedLogIn(response http.ResponseWriter, request *http.Request, user User, remember bool, next string) {
+	if passwordChangeRequired(user) {
+		session, err := sessions.Start(response, request, true)
+		if err != nil {
+			RenderProgramError(response, request, "Error starting session during login", "Could not start user session", err)
+			return
+		}
+		if err := session.Set(sessionKeyPasswordChange, user.GetEmail()); err != nil {
+			RenderProgramError(response, request, "Could not save pending password change in session", "Could not start user session", err)
+			return
+		}
+		if err := session.Set(sessionKeyPasswordChangeEnd, time.Now().Add(Config.PasswordChangeValidity).Format(time.RFC3339)); err != nil {
+			RenderProgramError(response, request, "Could not save end of pending password change in session", "Could not start user session", err)
+			return
+		}
+		if err := saveRememberChoice(session, remember); err != nil {
+			RenderProgramError(response, request, "Could not save remember-me choice in session", "Could not start user session", err)
+			return
+		}
+		if err := saveNext(session, next); err != nil {
+			RenderProgramError(response, request, "Could not save next page in session", "Could not start user session", err)
+			return
+		}
+		Config.Log.Printf("User %s (%s) needs to change their password before logging in", user.GetID(), user.GetEmail())
+		http.Redirect(response, request, Config.RoutePasswordChange, 302)
+		return
+	}
+
+	completeLogIn(response, request, user, remember, next)
+}
+
+// completeLogIn attaches the given user to the current session (starting a
+// new one if necessary), cancels a pending account deletion, remembers the
+// device if "remember" is true, calls Config.LoggedIn, and redirects to the
+// "next" page or, if it is empty or not safe, to Config.RouteLoggedIn. The user
+// must have been fully authenticated.
+func completeLogIn(response http.ResponseWriter, request *http.Request, user User, remember bool, next string) {
 	session, err := sessions.Start(response, request, true)
 	if err != nil {
 		RenderProgramError(response, request, "Error starting session during login", "Could not start user session", err)
 		return
 	}
+	if err := clearImpersonation(session); err != nil {
+		RenderProgramError(response, request, "Could not remove impersonation from session", "", err)
+		return
+	}
+	if err := cancelPendingDeletion(user); err != nil {
+		RenderProgramError(response, request, "Could not cancel pending deletion during login", "", err)
+		return
+	}
 	if err := session.LogIn(user, false, response); err != nil {
 		RenderProgramError(response, request, "Login failed", "", err)
 		return
 	}
+	if remember {
+		if err := rememberDevice(response, request, user); err != nil {
+			RenderProgramError(response, request, "Could not remember device", "", err)
+			return
+		}
+	}
 
-	Config.Log.Printf("User %s (%s) was logged in", user.GetID(), email)
+	Config.Log.Printf("User %s (%s) was logged in", user.GetID(), user.GetEmail())
 	if Config.LoggedIn != nil {
 		Config.LoggedIn(user, request.RemoteAddr)
 	}
-	http.Redirect(response, request, Config.RouteLoggedIn, 302)
+	if err := expireIfDue(user); err != nil {
+		Config.Log.Printf("Could not check expiry of user %s (%s): %s", user.GetID(), user.GetEmail(), err)
+	}
+	http.Redirect(response, request, loggedInRoute(user, next), 302)
 }
 
 // IsLoggedIn checks if a user is logged in. If they are, the User object is
@@ -101,6 +239,17 @@ func LogIn(response http.ResponseWriter, request *http.Request) {
 // StateExpired, in which case an according message should be displayed. In that
 // state, users should not have access to any functionality but instead be
 // presented with information instructing them what to do to regain access.
+// RequireVerified() performs this check for you. Users implementing the
+// ExpiryUser interface whose expiry time has passed are moved into
+// StateExpired here (see ExpireAccounts()).
+//
+// If an administrator is impersonating the returned user (see Admin()),
+// Impersonator() returns that administrator. Impersonations which have run
+// out of time (see Config.ImpersonationDuration) are ended here, i.e. the
+// administrator is logged back in and returned.
+//
+// If no user is logged in but the browser was remembered for a user who chose
+// to stay logged in (see Config.RememberMe), that user is logged in first.
 //
 // This function will also send HTTP headers that instruct the browser not to
 // cache this page.
@@ -116,6 +265,25 @@ func IsLoggedIn(response http.ResponseWriter, request *http.Request) (User, *ses
 		Config.Log.Printf(`Login check failed, could not get session on %s: %s`, request.RequestURI, err)
 		return nil, nil, errors.New("Unable to retrieve session")
 	}
+
+	// Restore the login of a user who chose to stay logged in.
+	if (session == nil || session.User() == nil) && Config.RememberMe > 0 {
+		if user := rememberedUser(response, request); user != nil && !passwordChangeRequired(user) {
+			session, err = sessions.Start(response, request, true)
+			if err != nil {
+				Config.Log.Printf(`Login check failed, could not start session on %s: %s`, request.RequestURI, err)
+				return nil, nil, errors.New("Unable to start session")
+			}
+			if err := session.LogIn(user, false, response); err != nil {
+				Config.Log.Printf(`Login check failed, could not log in remembered user %s (%s) on %s: %s`, user.GetID(), user.GetEmail(), request.RequestURI, err)
+				return nil, session, errors.New("Unable to log in")
+			}
+			Config.Log.Printf("User %s (%s) was logged in on a remembered device", user.GetID(), user.GetEmail())
+			if Config.LoggedIn != nil {
+				Config.LoggedIn(user, request.RemoteAddr)
+			}
+		}
+	}
 	if session == nil {
 		return nil, nil, nil
 	}
@@ -125,17 +293,31 @@ func IsLoggedIn(response http.ResponseWriter, request *http.Request) (User, *ses
 		return nil, session, nil
 	}
 
+	// End expired impersonations.
+	if impersonationExpired(session) {
+		if _, err := stopImpersonation(response, session, "time limit reached"); err != nil {
+			Config.Log.Printf(`Login check failed, could not stop impersonation on %s: %s`, request.RequestURI, err)
+			return nil, session, errors.New("Unable to stop impersonation")
+		}
+		if session.User() == nil {
+			return nil, session, nil
+		}
+	}
+
 	// We need the correct user state.
 	user := session.User().(User)
-	switch user.GetState() {
-	case StateVerified, StateExpired:
-	case StateCreated:
-		session.LogOut()
-		Config.Log.Printf(`Login check failed because account is not verified: %s (%s) on %s`, user.GetID(), user.GetEmail(), request.RequestURI)
-		return nil, session, errors.New("Cannot access this page (verification incomplete)")
-	default:
+	if state, ok := Config.States[user.GetState()]; !ok {
 		Config.Log.Printf(`Login check failed because of an unknown user state "%d": %s (%s) on %s`, user.GetState(), user.GetID(), user.GetEmail(), request.RequestURI)
 		return nil, session, errors.New("Cannot access this page (unknown user state)")
+	} else if !state.LogIn {
+		session.LogOut()
+		Config.Log.Printf(`Login check failed because of user state %q: %s (%s) on %s`, state.Name, user.GetID(), user.GetEmail(), request.RequestURI)
+		return nil, session, fmt.Errorf("Cannot access this page (account %s)", state.Name)
+	}
+
+	// Expire the user if their time has come.
+	if err := expireIfDue(user); err != nil {
+		Config.Log.Printf(`Login check could not check expiry of user %s (%s) on %s: %s`, user.GetID(), user.GetEmail(), request.RequestURI, err)
 	}
 
 	return user, session, nil
@@ -146,10 +328,16 @@ func IsLoggedIn(response http.ResponseWriter, request *http.Request) (User, *ses
 // cause users to log out. A simple form with a button will cause the logout
 // link to be visited using POST:
 //
-//   <form action="/logout" method="POST"><button>Log out</button></form>
+//	<form action="/logout" method="POST"><button>Log out</button></form>
 //
 // You can use CSS to make the button look like a link.
+//
+// If the user chose to stay logged in on this device, the device is forgotten.
 func LogOut(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
 	// Make sure we only process POST requests.
 	if request.Method != "POST" {
 		RenderProgramError(response, request, "Logout request method was "+request.Method, "Logout method must be POST", nil)
@@ -175,6 +363,14 @@ func LogOut(response http.ResponseWriter, request *http.Request) {
 	user := session.User().(User)
 	id := user.GetID()
 	email := user.GetEmail()
+	if err := forgetDevice(response, request, user); err != nil {
+		RenderProgramError(response, request, "Could not forget remembered device", "", err)
+		return
+	}
+	if err := clearImpersonation(session); err != nil {
+		RenderProgramError(response, request, "Could not remove impersonation from session", "", err)
+		return
+	}
 	if err := session.LogOut(); err != nil {
 		RenderProgramError(response, request, "Could not log user out of session", "", err)
 		return
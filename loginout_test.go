@@ -2,8 +2,11 @@ package users
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rivo/sessions"
 )
@@ -82,6 +85,75 @@ func TestLogIn(t *testing.T) {
 	assertString("logged in", event, t)
 }
 
+func TestLogInBreachedPassword(t *testing.T) {
+	user := &MyUser{
+		email:        "X",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+	}
+	Config.LoadUserByEmail = func(id string) (User, error) {
+		return user, nil
+	}
+	Config.BreachedPasswords = &BreachedPasswords{File: "test/breachedpasswords.txt"}
+	computed, _ := runRequest(nil, nil, map[string]string{
+		"email":    "@",
+		"password": "12345",
+	}, LogIn)
+	Config.BreachedPasswords = nil
+	assertString("redirect", computed, t)
+	if !user.changePassword {
+		t.Error("User was not flagged for a password change")
+	}
+}
+
+func TestLogInExpiredPassword(t *testing.T) {
+	Config.PasswordMaxAge = 90 * 24 * time.Hour
+	defer func() { Config.PasswordMaxAge = 0 }()
+	var event string
+	user := &MyUser{
+		email:        "X",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		pwChanged:    time.Now().Add(-100 * 24 * time.Hour),
+	}
+	Config.LoadUserByEmail = func(id string) (User, error) {
+		return user, nil
+	}
+	Config.LoggedIn = func(user User, ipAddress string) {
+		event = "logged in"
+	}
+	form := url.Values{"email": {"@"}, "password": {"12345"}}
+	request := httptest.NewRequest("POST", "/test", strings.NewReader(form.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	response := httptest.NewRecorder()
+	LogIn(response, request)
+	Config.LoggedIn = nil
+	if response.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect but got status %d", response.Code)
+	}
+	assertString(Config.RoutePasswordChange, response.Header().Get("Location"), t)
+	assertString("", event, t)
+
+	// The session holds the pending password change but no user.
+	request = httptest.NewRequest("GET", "/test", nil)
+	for _, cookie := range response.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	session, err := sessions.Start(httptest.NewRecorder(), request, false)
+	if err != nil || session == nil {
+		t.Fatalf("Session not found: %v", err)
+	}
+	if session.User() != nil {
+		t.Error("User was logged in despite an expired password")
+	}
+	if session.Get(sessionKeyPasswordChange, nil) == nil {
+		t.Error("Pending password change was not stored in the session")
+	}
+	if passwordChangeExpired(session) {
+		t.Error("Pending password change ran out immediately")
+	}
+}
+
 func TestLoggedInUnverifiedUser(t *testing.T) {
 	computed, _ := runRequest(&MyUser{
 		state: StateCreated,
@@ -0,0 +1,191 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// MagicLinkUser is an optional extension of the User interface. Users
+// implementing it may log in by clicking on a link emailed to them instead of
+// entering their password (see Config.MagicLinkValidity). This also works for
+// users who have no password at all.
+type MagicLinkUser interface {
+	// Login tokens (a 22 character long string and its creation time) are used
+	// in magic login links.
+	SetLoginToken(token string, created time.Time)
+	GetLoginToken() (string, time.Time)
+}
+
+// MagicLink renders the "magiclink.gohtml" template upon a GET request,
+// unless a user is logged in (checked with IsLoggedIn()), in which case they
+// are redirected to Config.RouteLoggedIn. Upon a POST request, an email is
+// sent to the provided address. If the email address is of an existing user
+// account, a single-use login token is generated and a link containing it is
+// sent in the email (using the "magiclink_existing.tmpl" mail template). If
+// the email address is unknown, the email sent will contain basic information
+// about the request (using the "magiclink_unknown.tmpl" mail template). In
+// any case, the "magiclinksent.gohtml" template is rendered.
+//
+// Magic links are only available if Config.MagicLinkValidity is not 0.
+func MagicLink(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	if Config.MagicLinkValidity <= 0 {
+		RenderProgramError(response, request, "Magic link requested but magic links are turned off", "Magic links are not available", nil)
+		return
+	}
+
+	if request.Method == "GET" {
+		user, _, _ := IsLoggedIn(response, request)
+		if user != nil {
+			// A user is already logged in. Abort.
+			Config.Log.Printf("Magic link page visited while logged in with %s (%s)", user.GetID(), user.GetEmail())
+			http.Redirect(response, request, Config.RouteLoggedIn, 302)
+			return
+		}
+
+		// Just render the "magic link" page.
+		RenderPageBasic(response, request, "magiclink.gohtml", nil)
+		return
+	}
+
+	// Throttle attempts.
+	address := strings.TrimSpace(request.PostFormValue("email"))
+	email := lookupEmail(address)
+	if Config.ThrottleLogin != nil {
+		Config.ThrottleLogin(email)
+	}
+
+	// Check if we know this user.
+	user, err := Config.LoadUserByEmail(email)
+	if err != nil {
+		RenderProgramError(response, request, "Could not load user on magic link request: "+email, "Could not load user", err)
+		return
+	}
+
+	// Emails go to the stored or the normalized address, not to its canonical
+	// form. Invalid addresses cannot receive any email.
+	if user != nil {
+		email = user.GetEmail()
+	} else if email, err = NormalizeEmail(address); err != nil {
+		Config.Log.Printf("Magic link requested for invalid email %q: %s", address, err)
+		RenderPage(response, request, "magiclinksent.gohtml", map[string]interface{}{"email": address})
+		return
+	}
+
+	// Check what needs to be done now.
+	template := "magiclink_existing.tmpl"
+	data := map[string]interface{}{
+		"email":  email,
+		"date":   time.Now().Format("Mon, 2006-01-02 15:04:05"),
+		"ip":     request.RemoteAddr,
+		"agent":  request.UserAgent(),
+		"config": Config,
+		"user":   user,
+	}
+	magicUser, ok := user.(MagicLinkUser)
+	if ok && (stateAllowsLogIn(user) || user.GetState() == StateSuspended) {
+		// The user exists and may log in. Suspended users receive a link, too, so
+		// that MagicLogIn() can show them the suspension page or, if their
+		// suspension has ended, reinstate them (see checkLogInState()). Create a
+		// login token.
+		token, err := sessions.RandomID(22)
+		if err != nil {
+			RenderProgramError(response, request, fmt.Sprintf("Could not generate login token for %s (%s)", user.GetID(), user.GetEmail()), "Could not generate login token", err)
+			return
+		}
+		tokenCreated := time.Now()
+		magicUser.SetLoginToken(token, tokenCreated)
+		if err := Config.UpdateUser(user); err != nil {
+			RenderProgramError(response, request, fmt.Sprintf("Cannot save user with new login token: %s (%s)", user.GetID(), user.GetEmail()), "Cannot update user", err)
+			return
+		}
+		data["token"] = token
+		data["validity"] = tokenCreated.Add(Config.MagicLinkValidity).Format("Monday, Jan 2, 2006, 15:04:05")
+		Config.Log.Printf("Sending magic link email for existing account: %s (%s)", user.GetID(), user.GetEmail())
+	} else {
+		// This user does not exist (or cannot use magic links).
+		template = "magiclink_unknown.tmpl"
+		Config.Log.Printf("Sending magic link info email for unknown account: %s", email)
+	}
+
+	// Send magic link email.
+	if err := SendMail(request, email, template, data); err != nil {
+		RenderProgramError(response, request, "Could not send magic link email", "", err)
+		return
+	}
+
+	RenderPage(response, request, "magiclinksent.gohtml", map[string]interface{}{"email": email})
+}
+
+// MagicLogIn is the target of the link sent by MagicLink(). It checks the
+// provided login token and, upon a GET request, renders the
+// "magiclogin.gohtml" template which contains a form posting the token back to
+// this handler. Upon that POST request, the token is invalidated and the user
+// is logged in. This way, mail scanners which follow every link in an email
+// cannot use up the token. Users who enabled two-factor authentication must
+// still provide their second factor (see LogIn()). If the token is unknown or
+// has expired, the "magiclink.gohtml" template is rendered with an error.
+func MagicLogIn(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	if Config.MagicLinkValidity <= 0 {
+		RenderProgramError(response, request, "Magic link used but magic links are turned off", "Magic links are not available", nil)
+		return
+	}
+
+	// Throttle attempts.
+	if Config.ThrottleVerification != nil {
+		Config.ThrottleVerification()
+	}
+
+	// Check if we have a valid login token.
+	token := request.FormValue("token")
+	user, err := Config.LoadUserByLoginToken(token)
+	if err != nil {
+		RenderProgramError(response, request, "Could not load user via login token: "+token, "Could not load user", err)
+		return
+	}
+	magicUser, ok := user.(MagicLinkUser)
+	if token == "" || !ok {
+		Config.Log.Printf("Login token unknown: %s", token)
+		RenderPageError(response, request, "magiclink.gohtml", "logintokennotfound", nil, nil)
+		return
+	}
+	_, tokenCreated := magicUser.GetLoginToken()
+	if tokenCreated.Add(Config.MagicLinkValidity).Before(time.Now()) {
+		Config.Log.Printf("Login token for user %s (%s) expired: %s", user.GetID(), user.GetEmail(), token)
+		RenderPageError(response, request, "magiclink.gohtml", "logintokenexpired", nil, nil)
+		return
+	}
+
+	if request.Method != "POST" {
+		// Ask the user to confirm.
+		RenderPage(response, request, "magiclogin.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"token": token}})
+		return
+	}
+
+	// Invalidate the token.
+	magicUser.SetLoginToken("", time.Unix(0, 0))
+	if err := Config.UpdateUser(user); err != nil {
+		RenderProgramError(response, request, "Could not save user with invalidated login token", "", err)
+		return
+	}
+
+	// Is the user still in the correct state?
+	if !checkLogInState(response, request, user) {
+		return
+	}
+	Config.Log.Printf("User %s (%s) used a magic link", user.GetID(), user.GetEmail())
+
+	// Log the user in.
+	checkSecondFactor(response, request, user, false, "")
+}
@@ -0,0 +1,98 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMagicLinkOff(t *testing.T) {
+	computed, _ := runRequest(nil, nil, nil, MagicLink)
+	if computed == "HOMLF" {
+		t.Error("Magic link page shown although magic links are turned off")
+	}
+}
+
+func TestMagicLinkPage(t *testing.T) {
+	Config.MagicLinkValidity = 15 * time.Minute
+	defer func() { Config.MagicLinkValidity = 0 }()
+	computed, _ := runRequest(nil, nil, nil, MagicLink)
+	assertString("HOMLF", computed, t)
+}
+
+func TestMagicLinkExistingUser(t *testing.T) {
+	Config.MagicLinkValidity = 15 * time.Minute
+	defer func() { Config.MagicLinkValidity = 0 }()
+	for state, expected := range map[int]string{StateVerified: "MLE", StateExpired: "MLE", StateCreated: "MLU"} {
+		user := &MyUser{email: "@", state: state}
+		Config.LoadUserByEmail = func(email string) (User, error) {
+			return user, nil
+		}
+		html, mail := runRequest(nil, nil, map[string]string{"email": "@"}, MagicLink)
+		assertString("HOMS@F", html, t)
+		assertString(expected, mail, t)
+		if (expected == "MLE") != (user.loginToken != "") {
+			t.Errorf("Wrong login token for user state %d: %q", state, user.loginToken)
+		}
+	}
+}
+
+func TestMagicLinkUnknownUser(t *testing.T) {
+	Config.MagicLinkValidity = 15 * time.Minute
+	defer func() { Config.MagicLinkValidity = 0 }()
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return nil, nil
+	}
+	html, mail := runRequest(nil, nil, map[string]string{"email": " New@X "}, MagicLink)
+	assertString("HOMSNew@xF", html, t)
+	assertString("MLU", mail, t)
+
+	// Invalid addresses receive no email.
+	html, mail = runRequest(nil, nil, map[string]string{"email": "@"}, MagicLink)
+	assertString("HOMS@F", html, t)
+	assertString("", mail, t)
+}
+
+func TestMagicLogIn(t *testing.T) {
+	var event string
+	Config.MagicLinkValidity = 15 * time.Minute
+	Config.LoggedIn = func(user User, ipAddress string) {
+		event = "logged in"
+	}
+	defer func() {
+		Config.MagicLinkValidity = 0
+		Config.LoggedIn = nil
+	}()
+
+	// A user without a password.
+	user := &MyUser{email: "@", state: StateVerified, loginToken: "abc", loginCreated: time.Now()}
+	Config.LoadUserByLoginToken = func(token string) (User, error) {
+		if user.loginToken == token {
+			return user, nil
+		}
+		return nil, nil
+	}
+	computed, _ := runRequest(nil, map[string]string{"token": "abc"}, nil, MagicLogIn)
+	assertString("HOMCabcF", computed, t)
+	assertString("", event, t)
+	computed, _ = runRequest(nil, nil, map[string]string{"token": "abc"}, MagicLogIn)
+	assertString("redirect", computed, t)
+	assertString("logged in", event, t)
+
+	// The link can only be used once.
+	event = ""
+	computed, _ = runRequest(nil, nil, map[string]string{"token": "abc"}, MagicLogIn)
+	assertString("HOML!LTN!F", computed, t)
+	assertString("", event, t)
+
+	// Expired links are rejected.
+	user.loginToken, user.loginCreated = "def", time.Now().Add(-time.Hour)
+	computed, _ = runRequest(nil, map[string]string{"token": "def"}, nil, MagicLogIn)
+	assertString("HOML!LTE!F", computed, t)
+	assertString("", event, t)
+
+	// The second factor is still required.
+	user.loginToken, user.loginCreated, user.totpSecret = "ghi", time.Now(), testTOTPSecret
+	computed, _ = runRequest(nil, nil, map[string]string{"token": "ghi"}, MagicLogIn)
+	assertString("redirect", computed, t)
+	assertString("", event, t)
+}
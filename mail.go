@@ -17,6 +17,9 @@ import (
 // the mail template will be used the email's subject. It must be followed by an
 // empty line before the mail body starts.
 //
+// The request is only used to determine the user's language and may be nil
+// for emails which are not sent in response to an HTTP request.
+//
 // If this call fails with "x509: certificate signed by unknown authority" and
 // the email server (operated by you) is using a self-signed certificate, you
 // will need to add it to your server's list of trusted certificates.
@@ -28,7 +31,7 @@ func SendMail(request *http.Request, email, mailTemplate string, data interface{
 
 	// Determine template subdirectory.
 	var subdirectory string
-	if Config.Internationalization {
+	if Config.Internationalization && request != nil {
 		if cookie, err := request.Cookie("lang"); err == nil {
 			languageFormat := regexp.MustCompile("^[a-zA-Z]{2}(-[a-zA-Z]{2})?$")
 			if languageFormat.MatchString(cookie.Value) {
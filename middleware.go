@@ -0,0 +1,109 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/rivo/sessions"
+)
+
+// contextKey is the type of the keys under which this package stores values in
+// a request's context.
+type contextKey int
+
+// Keys of context values set by RequireState().
+const (
+	contextKeyUser contextKey = iota
+	contextKeySession
+)
+
+// RequireState wraps the given handler such that it is only called if a user
+// is logged in (checked with IsLoggedIn()) and the "allowed" function returns
+// true for them. If "allowed" is nil, any logged-in user is accepted. The
+// user and their session are added to the request's context and can be
+// retrieved with UserFromContext() and SessionFromContext().
+//
+// If no user is logged in, browsers are redirected to the login page which
+// will send them back to the requested page afterwards (see LogInURL()). API
+// requests (see below) receive a 401 Unauthorized error instead. If the user
+// is logged in but not allowed, browsers receive the "accessdenied.gohtml"
+// template (with an "expired" key set to true if the user's state is
+// StateExpired) and API requests a plain error, both with a 403 Forbidden
+// status. Browsers of expired users are redirected to Config.RouteRenewal
+// instead if it is set.
+//
+// A request is considered an API request if it has a JSON body, if it accepts
+// JSON but not HTML, or if it was sent with an "X-Requested-With" header.
+func RequireState(allowed func(user User) bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		user, session, _ := IsLoggedIn(response, request)
+		if user == nil {
+			if apiRequest(request) {
+				http.Error(response, "Login required", http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(response, request, LogInURL(request), 302)
+			return
+		}
+		if allowed != nil && !allowed(user) {
+			Config.Log.Printf("User %s (%s) was denied access to %s", user.GetID(), user.GetEmail(), request.RequestURI)
+			if apiRequest(request) {
+				http.Error(response, "Access denied", http.StatusForbidden)
+				return
+			}
+			if user.GetState() == StateExpired && Config.RouteRenewal != "" {
+				http.Redirect(response, request, Config.RouteRenewal, 302)
+				return
+			}
+			data := map[string]interface{}{"config": Config, "user": user, "expired": user.GetState() == StateExpired}
+			addCSRFToken(response, request, data) // Before any headers are written.
+			response.WriteHeader(http.StatusForbidden)
+			RenderPage(response, request, "accessdenied.gohtml", data)
+			return
+		}
+		ctx := context.WithValue(request.Context(), contextKeyUser, user)
+		ctx = context.WithValue(ctx, contextKeySession, session)
+		handler.ServeHTTP(response, request.WithContext(ctx))
+	})
+}
+
+// RequireLogin wraps the given handler such that it is only called if a user
+// is logged in. See RequireState() for details.
+func RequireLogin(handler http.Handler) http.Handler {
+	return RequireState(nil, handler)
+}
+
+// RequireVerified wraps the given handler such that it is only called if a
+// user is logged in and their account has not expired, i.e. their state is
+// StateVerified or any other state which grants access (see State.Access).
+// See RequireState() for details.
+func RequireVerified(handler http.Handler) http.Handler {
+	return RequireState(stateAllowsAccess, handler)
+}
+
+// UserFromContext returns the logged-in user stored in the given context by
+// RequireState(), RequireLogin(), or RequireVerified(). If there is no such
+// user, nil is returned.
+func UserFromContext(ctx context.Context) User {
+	user, _ := ctx.Value(contextKeyUser).(User)
+	return user
+}
+
+// SessionFromContext returns the session of the logged-in user stored in the
+// given context by RequireState(), RequireLogin(), or RequireVerified(). If
+// there is no such session, nil is returned.
+func SessionFromContext(ctx context.Context) *sessions.Session {
+	session, _ := ctx.Value(contextKeySession).(*sessions.Session)
+	return session
+}
+
+// apiRequest returns true if the given request was most likely not sent by a
+// browser navigating to a page but by a script or an API client.
+func apiRequest(request *http.Request) bool {
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") || request.Header.Get("X-Requested-With") != "" {
+		return true
+	}
+	accept := request.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
@@ -0,0 +1,62 @@
+package users
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// contextHandler writes the email address of the user stored in the request's
+// context.
+var contextHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+	user := UserFromContext(request.Context())
+	if user == nil || SessionFromContext(request.Context()) == nil {
+		response.Write([]byte("no user"))
+		return
+	}
+	response.Write([]byte(user.GetEmail()))
+})
+
+func TestRequireLogin(t *testing.T) {
+	handler := RequireLogin(contextHandler)
+
+	// Not logged in.
+	computed, _ := runRequest(nil, nil, nil, handler.ServeHTTP)
+	assertString("redirect", computed, t)
+	request := httptest.NewRequest("GET", "/api", nil)
+	request.Header.Set("Accept", "application/json")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", response.Code)
+	}
+
+	// Logged in.
+	computed, _ = runRequest(&MyUser{email: "a@b", state: StateExpired}, nil, nil, handler.ServeHTTP)
+	assertString("a@b", computed, t)
+}
+
+func TestRequireVerified(t *testing.T) {
+	handler := RequireVerified(contextHandler)
+	computed, _ := runRequest(&MyUser{email: "a@b", state: StateVerified}, nil, nil, handler.ServeHTTP)
+	assertString("a@b", computed, t)
+	computed, _ = runRequest(&MyUser{email: "a@b", state: StateExpired}, nil, nil, handler.ServeHTTP)
+	assertString("HIADF", computed, t)
+}
+
+func TestRequireState(t *testing.T) {
+	handler := RequireState(func(user User) bool {
+		return user.GetEmail() == "admin@b"
+	}, contextHandler)
+	computed, _ := runRequest(&MyUser{email: "admin@b", state: StateVerified}, nil, nil, handler.ServeHTTP)
+	assertString("admin@b", computed, t)
+	computed, _ = runRequest(&MyUser{email: "a@b", state: StateVerified}, nil, nil, handler.ServeHTTP)
+	assertString("HIADF", computed, t)
+}
+
+func TestUserFromContext(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	if UserFromContext(request.Context()) != nil || SessionFromContext(request.Context()) != nil {
+		t.Error("Empty context returned a user or session")
+	}
+}
@@ -0,0 +1,77 @@
+package users
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rivo/sessions"
+)
+
+// safeNext returns the given "next" path if it is a local path which starts
+// with one of the prefixes in Config.NextPaths. Otherwise, an empty string is
+// returned. This prevents open redirects to other sites.
+func safeNext(next string) string {
+	if next == "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\") {
+		return ""
+	}
+	for _, r := range next {
+		if r < 0x20 || r == 0x7f {
+			return ""
+		}
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return ""
+	}
+	for _, prefix := range Config.NextPaths {
+		if strings.HasPrefix(u.Path, prefix) {
+			return next
+		}
+	}
+	return ""
+}
+
+// loggedInRoute returns the page to which the given user is redirected after
+// logging in: Config.RouteRenewal if their account has expired and that route
+// is set, the given "next" path if it is safe, Config.RouteLoggedIn otherwise.
+func loggedInRoute(user User, next string) string {
+	if user != nil && user.GetState() == StateExpired && Config.RouteRenewal != "" {
+		return Config.RouteRenewal
+	}
+	if next = safeNext(next); next != "" {
+		return next
+	}
+	return Config.RouteLoggedIn
+}
+
+// LogInURL returns the URL of the login page (Config.RouteLogIn) with a "next"
+// parameter pointing to the requested page. Redirect users to this URL when
+// they need to log in to see the requested page. After logging in, they will
+// be sent back to it.
+func LogInURL(request *http.Request) string {
+	next := safeNext(request.URL.RequestURI())
+	if next == "" {
+		return Config.RouteLogIn
+	}
+	return Config.RouteLogIn + "?next=" + url.QueryEscape(next)
+}
+
+// saveNext stores the page to which the user is redirected after logging in in
+// the session while their login is pending.
+func saveNext(session *sessions.Session, next string) error {
+	if next = safeNext(next); next == "" {
+		return nil
+	}
+	return session.Set(sessionKeyNext, next)
+}
+
+// takeNext returns the page stored with saveNext() and removes it from the
+// session.
+func takeNext(session *sessions.Session) (string, error) {
+	next, _ := session.Get(sessionKeyNext, "").(string)
+	if next == "" {
+		return "", nil
+	}
+	return next, session.Delete(sessionKeyNext)
+}
@@ -0,0 +1,72 @@
+package users
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSafeNext(t *testing.T) {
+	for next, expected := range map[string]string{
+		"":                       "",
+		"/":                      "/",
+		"/account?tab=2#top":     "/account?tab=2#top",
+		"account":                "",
+		"//evil.com":             "",
+		"/\\evil.com":            "",
+		"https://evil.com/":      "",
+		"javascript:alert(1)":    "",
+		"/foo\r\nLocation: /bar": "",
+	} {
+		assertString(expected, safeNext(next), t)
+	}
+
+	Config.NextPaths = []string{"/app/"}
+	defer func() {
+		Config.NextPaths = []string{"/"}
+	}()
+	assertString("/app/x", safeNext("/app/x"), t)
+	assertString("", safeNext("/admin"), t)
+}
+
+func TestLogInURL(t *testing.T) {
+	request := httptest.NewRequest("GET", "/account?tab=2", nil)
+	assertString(Config.RouteLogIn+"?next=%2Faccount%3Ftab%3D2", LogInURL(request), t)
+}
+
+func TestLogInNext(t *testing.T) {
+	Config.LoadUserByEmail = func(id string) (User, error) {
+		return &MyUser{
+			email:        "X",
+			state:        StateVerified,
+			passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		}, nil
+	}
+	for next, expected := range map[string]string{
+		"/account":         "/account",
+		"https://evil.com": Config.RouteLoggedIn,
+		"":                 Config.RouteLoggedIn,
+	} {
+		form := url.Values{"email": {"@"}, "password": {"12345"}, "next": {next}}
+		request := httptest.NewRequest("POST", "/test", strings.NewReader(form.Encode()))
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		response := httptest.NewRecorder()
+		LogIn(response, request)
+		assertString(expected, response.Header().Get("Location"), t)
+	}
+
+	// The login form carries the parameter.
+	computed, _ := runRequest(nil, map[string]string{"next": "/account"}, nil, LogIn)
+	assertString("HOL/accountF", computed, t)
+}
+
+func TestSignUpNext(t *testing.T) {
+	_, mail := runRequest(nil, nil, map[string]string{
+		"email":           "next@b",
+		"password":        "lakjshfaksjhf",
+		"passwordconfirm": "lakjshfaksjhf",
+		"next":            "/account",
+	}, SignUp)
+	assertString("VN>/account", mail, t)
+}
@@ -1,6 +1,7 @@
 package users
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -14,12 +15,16 @@ import (
 // request, unless a user is logged in (checked with IsLoggedIn()), in which
 // case they are redirected to Config.RouteLoggedIn. Upon a POST request, an
 // email is sent to the provided address. If the email address is of an existing
-// user account, a temporary ID for a password reset link is generated and the
-// link sent in the email (using the "reset_existing.tmpl" mail template). If
-// the email address is unknown, the email sent will contain basic information
-// about the request (using the "reset_unknown.tmpl" mail template). In any
-// case, the "resetlinksent.gohtml" template is rendered.
+// user account whose state allows logging in (see State.LogIn), a temporary ID
+// for a password reset link is generated and the link sent in the email (using
+// the "reset_existing.tmpl" mail template). Otherwise, the email sent will
+// contain basic information about the request (using the "reset_unknown.tmpl"
+// mail template). In any case, the "resetlinksent.gohtml" template is rendered.
 func ForgottenPassword(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
 	if request.Method == "GET" {
 		user, _, _ := IsLoggedIn(response, request)
 		if user != nil {
@@ -35,61 +40,125 @@ func ForgottenPassword(response http.ResponseWriter, request *http.Request) {
 	}
 
 	// Check if we know this user.
-	email := strings.ToLower(request.PostFormValue("email"))
-	user, err := Config.LoadUserByEmail(email)
+	email := strings.TrimSpace(request.PostFormValue("email"))
+	user, err := Config.LoadUserByEmail(lookupEmail(email))
 	if err != nil {
 		RenderProgramError(response, request, "Could not load user on forgotten password: "+email, "Could not load user", err)
 		return
 	}
 
 	// Check what needs to be done now.
-	template := "reset_existing.tmpl"
-	data := map[string]interface{}{
-		"email":  email,
-		"date":   time.Now().Format("Mon, 2006-01-02 15:04:05"),
-		"ip":     request.RemoteAddr,
-		"agent":  request.UserAgent(),
-		"config": Config,
-		"user":   user,
-	}
-	if user != nil && user.GetState() == StateVerified {
-		// The user exists and is verified. Create a reset ID.
-		token, err := sessions.RandomID(22)
-		if err != nil {
-			RenderProgramError(response, request, fmt.Sprintf("Could not generate password reset ID for %s (%s)", user.GetID(), user.GetEmail()), "Could not generate password reset ID", err)
+	if user != nil && stateAllowsLogIn(user) {
+		// The user exists and may log in. Send them a reset link.
+		if err := sendPasswordReset(request, user); err != nil {
+			RenderProgramError(response, request, fmt.Sprintf("Could not send password reset email to %s (%s)", user.GetID(), user.GetEmail()), "Could not send password reset email", err)
 			return
 		}
-		tokenCreated := time.Now()
-		user.SetPasswordToken(token, tokenCreated)
-		if err := Config.UpdateUser(user); err != nil {
-			RenderProgramError(response, request, fmt.Sprintf("Cannot save user with new password reset ID: %s (%s)", user.GetID(), user.GetEmail()), "Cannot update user", err)
-			return
-		}
-		data["token"] = token
-		data["validity"] = tokenCreated.Add(24 * time.Hour).Format("Monday, Jan 2, 2006, 15:04:05")
-		Config.Log.Printf("Sending password reset email for existing account: %s (%s)", user.GetID(), user.GetEmail())
 	} else {
 		// This user does not exist
-		template = "reset_unknown.tmpl"
 		Config.Log.Printf("Sending passwort reset info email for unknown account: %s", email)
+		if err := SendMail(request, email, "reset_unknown.tmpl", map[string]interface{}{
+			"email":  email,
+			"date":   time.Now().Format("Mon, 2006-01-02 15:04:05"),
+			"ip":     request.RemoteAddr,
+			"agent":  request.UserAgent(),
+			"config": Config,
+			"user":   user,
+		}); err != nil {
+			RenderProgramError(response, request, "Could not send password reset email", "", err)
+			return
+		}
 	}
 
-	// Send password reset email.
-	if err := SendMail(request, email, template, data); err != nil {
-		RenderProgramError(response, request, "Could not send password reset email", "", err)
-		return
-	}
+	RenderPage(response, request, "resetlinksent.gohtml", map[string]interface{}{"config": Config, "email": email})
+}
 
-	RenderPage(response, request, "resetlinksent.gohtml", map[string]interface{}{"email": email})
+// sendPasswordReset generates a new password reset token for the given user,
+// saves the user, and sends them the "reset_existing.tmpl" email containing a
+// link to reset their password.
+func sendPasswordReset(request *http.Request, user User) error {
+	token, err := sessions.RandomID(22)
+	if err != nil {
+		return err
+	}
+	tokenCreated := time.Now()
+	user.SetPasswordToken(token, tokenCreated)
+	if err := Config.UpdateUser(user); err != nil {
+		return err
+	}
+	Config.Log.Printf("Sending password reset email for existing account: %s (%s)", user.GetID(), user.GetEmail())
+	return SendMail(request, user.GetEmail(), "reset_existing.tmpl", map[string]interface{}{
+		"email":    user.GetEmail(),
+		"date":     time.Now().Format("Mon, 2006-01-02 15:04:05"),
+		"ip":       request.RemoteAddr,
+		"agent":    request.UserAgent(),
+		"config":   Config,
+		"user":     user,
+		"token":    token,
+		"code":     emailCode(token),
+		"validity": tokenCreated.Add(24 * time.Hour).Format("Monday, Jan 2, 2006, 15:04:05"),
+	})
 }
 
 // ResetPassword checks, upon a GET request, the provided token and renders
 // the "resetpassword.gohtml" template which contains a form to reset the user's
-// password. Upon a POST request, the entered password is checked and saved.
+// password. A GET request never changes the user, so mail scanners following
+// the link in the email cannot invalidate the token. Upon a POST request, the
+// entered password is checked and saved.
 // Upon success, the user is logged out of all sessions (provided
-// sessions.Persistence.UserSessions is implemented) and the
-// "passwordreset.gohtml" template is shown.
+// sessions.Persistence.UserSessions is implemented), all remembered devices
+// are forgotten, and the "passwordreset.gohtml" template is shown.
+//
+// If Config.EmailCodeDigits is not 0, users may instead provide their email
+// address ("email" field) and post the code sent to them ("code" field), upon
+// which the "resetpassword.gohtml" template is rendered as if they had
+// provided the token. If only the email address is provided, or if the
+// request is not a POST request, the "entercode.gohtml" template is rendered
+// with a form to enter the code.
 func ResetPassword(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	// Check if the user entered a code instead of using the link.
+	if email := request.FormValue("email"); Config.EmailCodeDigits > 0 && email != "" {
+		code := request.FormValue("code")
+		if code == "" || request.Method != "POST" {
+			RenderPage(response, request, "entercode.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"email": email, "action": Config.RouteResetPassword}})
+			return
+		}
+		if Config.ThrottleVerification != nil {
+			Config.ThrottleVerification()
+		}
+		user, exhausted, err := loadUserByEmailCode(email, code, func(u User) (string, time.Time) {
+			token, created := u.GetPasswordToken()
+			return token, created.Add(30 * time.Minute)
+		}, func(u User) {
+			u.SetPasswordToken("", time.Unix(0, 0))
+		})
+		if err != nil {
+			RenderProgramError(response, request, "Could not load user for password reset code", "", err)
+			return
+		}
+		if user == nil {
+			Config.Log.Printf("Wrong password reset code entered for %s", email)
+			errorName := "codeinvalid"
+			if exhausted {
+				errorName = "codeexhausted"
+			}
+			RenderPageError(response, request, "entercode.gohtml", errorName, map[string]string{"email": email, "action": Config.RouteResetPassword}, nil)
+			return
+		}
+		token, tokenCreated := user.GetPasswordToken()
+		if tokenCreated.Add(30 * time.Minute).Before(time.Now()) {
+			Config.Log.Printf("Password reset token for user %s (%s) expired: %s", user.GetID(), user.GetEmail(), token)
+			RenderPageError(response, request, "forgottenpassword.gohtml", "resettokenexpired", nil, nil)
+			return
+		}
+		RenderPage(response, request, "resetpassword.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"token": token}})
+		return
+	}
+
 	// Check if we have a valid password reset token.
 	token := request.FormValue("token")
 	user, err := Config.LoadUserByPasswordToken(token)
@@ -127,9 +196,21 @@ func ResetPassword(response http.ResponseWriter, request *http.Request) {
 	}
 
 	// Check password integrity.
-	if result := sessions.ReasonablePassword(password, append(Config.PasswordNames, user.GetEmail())); result != sessions.PasswordOK {
-		Config.Log.Printf("New password was rejected for %s (%s), reason: %d", user.GetID(), user.GetEmail(), result)
-		RenderPageError(response, request, "resetpassword.gohtml", "invalidpassword", map[string]interface{}{"issue": result, "token": token}, nil)
+	violations, err := validatePassword(password, user.GetEmail())
+	if err != nil {
+		RenderProgramError(response, request, "Could not check new password", "", err)
+		return
+	}
+	if len(violations) > 0 {
+		Config.Log.Printf("New password was rejected for %s (%s), reasons: %v", user.GetID(), user.GetEmail(), violations)
+		RenderPageError(response, request, "resetpassword.gohtml", "invalidpassword", map[string]interface{}{"violations": violations, "token": token}, nil)
+		return
+	}
+
+	// Check password history.
+	if passwordReused(user, password) {
+		Config.Log.Printf("New password for %s (%s) was used before", user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "resetpassword.gohtml", "passwordreused", map[string]interface{}{"history": Config.PasswordHistory, "token": token}, nil)
 		return
 	}
 
@@ -141,8 +222,12 @@ func ResetPassword(response http.ResponseWriter, request *http.Request) {
 	}
 
 	// Save new password.
-	user.SetPasswordHash(hash)
+	setPasswordHash(user, hash)
 	user.SetPasswordToken("", time.Unix(0, 0)) // Invalidate token.
+	forgetAllDevices(user)
+	if changeUser, ok := user.(PasswordChangeUser); ok {
+		changeUser.SetPasswordChangeRequired(false)
+	}
 	if err := Config.UpdateUser(user); err != nil {
 		RenderProgramError(response, request, "Could not save user with new password", "", err)
 		return
@@ -158,3 +243,179 @@ func ResetPassword(response http.ResponseWriter, request *http.Request) {
 	// Show a confirmation.
 	RenderPageBasic(response, request, "passwordreset.gohtml", nil)
 }
+
+// ChangePassword is the page to which LogIn() redirects users whose password
+// has expired (see Config.PasswordMaxAge) or who were flagged for a password
+// change (see RequirePasswordChange()). These users have entered their correct
+// password but are not logged in yet. Upon a GET request, the
+// "changepassword.gohtml" template is rendered, containing a form to choose a
+// new password. Upon a POST request, the new password is checked and saved,
+// and the user is logged in and redirected to Config.RouteLoggedIn. Until
+// then, the user cannot access any other functionality. If they don't do so
+// within Config.PasswordChangeValidity, they are redirected to
+// Config.RouteLogIn and must log in again.
+func ChangePassword(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	// Find out who wants to change their password.
+	session, err := sessions.Start(response, request, false)
+	if err != nil {
+		RenderProgramError(response, request, "Error starting session during password change", "Could not start user session", err)
+		return
+	}
+	var email string
+	if session != nil {
+		email, _ = session.Get(sessionKeyPasswordChange, "").(string)
+	}
+	if email == "" {
+		Config.Log.Print("Password change page visited without pending password change")
+		http.Redirect(response, request, Config.RouteLogIn, 302)
+		return
+	}
+	if passwordChangeExpired(session) {
+		Config.Log.Printf("Pending password change for %s ran out", email)
+		session.Delete(sessionKeyPasswordChange)
+		session.Delete(sessionKeyPasswordChangeEnd)
+		http.Redirect(response, request, Config.RouteLogIn, 302)
+		return
+	}
+	user, err := Config.LoadUserByEmail(lookupEmail(email))
+	if err != nil {
+		RenderProgramError(response, request, "Could not load user for password change: "+email, "Could not load user", err)
+		return
+	}
+	if user == nil {
+		Config.Log.Printf("User for password change not found: %s", email)
+		session.Delete(sessionKeyPasswordChange)
+		session.Delete(sessionKeyPasswordChangeEnd)
+		http.Redirect(response, request, Config.RouteLogIn, 302)
+		return
+	}
+
+	if request.Method == "GET" {
+		// Simply render the change password template.
+		RenderPageBasic(response, request, "changepassword.gohtml", nil)
+		return
+	}
+
+	// Get the form entries.
+	password := request.PostFormValue("password")
+	passwordConfirm := request.PostFormValue("passwordconfirm")
+
+	// Check if passwords match.
+	if password != passwordConfirm {
+		Config.Log.Printf("Required new passwords for %s (%s) don't match", user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "changepassword.gohtml", "passwordsdontmatch", nil, nil)
+		return
+	}
+
+	// Check password integrity.
+	violations, err := validatePassword(password, user.GetEmail())
+	if err != nil {
+		RenderProgramError(response, request, "Could not check required new password", "", err)
+		return
+	}
+	if len(violations) > 0 {
+		Config.Log.Printf("Required new password was rejected for %s (%s), reasons: %v", user.GetID(), user.GetEmail(), violations)
+		RenderPageError(response, request, "changepassword.gohtml", "invalidpassword", map[string]interface{}{"violations": violations}, nil)
+		return
+	}
+
+	// The new password must differ from the current one.
+	if passwordReused(user, password) || bcrypt.CompareHashAndPassword(user.GetPasswordHash(), []byte(password)) == nil {
+		Config.Log.Printf("Required new password for %s (%s) was used before", user.GetID(), user.GetEmail())
+		history := Config.PasswordHistory
+		if history < 1 {
+			history = 1
+		}
+		RenderPageError(response, request, "changepassword.gohtml", "passwordreused", map[string]interface{}{"history": history}, nil)
+		return
+	}
+
+	// Generate password hash.
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+	if err != nil {
+		RenderProgramError(response, request, "Could not generate required new password hash", "", err)
+		return
+	}
+
+	// Save new password.
+	setPasswordHash(user, hash)
+	if changeUser, ok := user.(PasswordChangeUser); ok {
+		changeUser.SetPasswordChangeRequired(false)
+	}
+	if err := Config.UpdateUser(user); err != nil {
+		RenderProgramError(response, request, "Could not save user with required new password", "", err)
+		return
+	}
+	if err := session.Delete(sessionKeyPasswordChange); err != nil {
+		RenderProgramError(response, request, "Could not remove pending password change from session", "", err)
+		return
+	}
+	if err := session.Delete(sessionKeyPasswordChangeEnd); err != nil {
+		RenderProgramError(response, request, "Could not remove end of pending password change from session", "", err)
+		return
+	}
+	remember, err := takeRememberChoice(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not remove remember-me choice from session", "", err)
+		return
+	}
+	next, err := takeNext(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not remove next page from session", "", err)
+		return
+	}
+	Config.Log.Printf("Required password change completed for user %s (%s)", user.GetID(), user.GetEmail())
+
+	// Now we can log them in.
+	completeLogIn(response, request, user, remember, next)
+}
+
+// RequirePasswordChange flags the given user for a password change, forgets
+// their remembered devices, and logs them out of all sessions (provided
+// sessions.Persistence.UserSessions is implemented). The next time they log
+// in, they will have to choose a new password before they can access the
+// application. The user must implement the PasswordChangeUser interface.
+func RequirePasswordChange(user User) error {
+	changeUser, ok := user.(PasswordChangeUser)
+	if !ok {
+		return errors.New("User does not implement the PasswordChangeUser interface")
+	}
+	changeUser.SetPasswordChangeRequired(true)
+	forgetAllDevices(user)
+	if err := Config.UpdateUser(user); err != nil {
+		return fmt.Errorf("Could not save user flagged for password change: %s", err)
+	}
+	if err := sessions.LogOut(user.GetID()); err != nil {
+		return fmt.Errorf("Could not log user out of all sessions: %s", err)
+	}
+	Config.Log.Printf("User %s (%s) was flagged for a password change", user.GetID(), user.GetEmail())
+	return nil
+}
+
+// passwordChangeExpired returns true if the pending password change stored in
+// the session has run out of time (see Config.PasswordChangeValidity).
+func passwordChangeExpired(session *sessions.Session) bool {
+	end, _ := session.Get(sessionKeyPasswordChangeEnd, "").(string)
+	t, err := time.Parse(time.RFC3339, end)
+	return err != nil || t.Before(time.Now())
+}
+
+// passwordChangeRequired returns whether the given user must choose a new
+// password before being logged in, either because they were flagged for a
+// password change or because their password has expired.
+func passwordChangeRequired(user User) bool {
+	if changeUser, ok := user.(PasswordChangeUser); ok && changeUser.GetPasswordChangeRequired() {
+		return true
+	}
+	if Config.PasswordMaxAge > 0 {
+		if ageUser, ok := user.(PasswordAgeUser); ok {
+			changed := ageUser.GetPasswordChanged()
+			return !changed.IsZero() && changed.Add(Config.PasswordMaxAge).Before(time.Now())
+		}
+	}
+	return false
+}
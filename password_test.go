@@ -30,6 +30,19 @@ func TestForgottenPasswordExistingUser(t *testing.T) {
 	}
 }
 
+func TestForgottenPasswordStates(t *testing.T) {
+	for state, expected := range map[int]string{StateExpired: "RE", StateCreated: "RU", StateSuspended: "RU"} {
+		user := &MyUser{email: "@", state: state}
+		Config.LoadUserByEmail = func(email string) (User, error) {
+			return user, nil
+		}
+		_, mail := runRequest(nil, nil, map[string]string{
+			"email": "@",
+		}, ForgottenPassword)
+		assertString(expected, mail, t)
+	}
+}
+
 func TestForgottenPasswordUnknownUser(t *testing.T) {
 	Config.LoadUserByEmail = func(email string) (User, error) {
 		return nil, nil
@@ -86,11 +99,11 @@ func TestResetPasswordInvalidPassword(t *testing.T) {
 		"password":        "abc",
 		"passwordconfirm": "abc",
 	}, ResetPassword)
-	assertString("HORP12345!a3!F", computed, t)
+	assertString("HORP12345!tooshort8;sequence;3!F", computed, t)
 }
 
 func TestResetPassword(t *testing.T) {
-	user := &MyUser{passwordToken: "12345", tokenCreated: time.Now(), state: StateVerified}
+	user := &MyUser{passwordToken: "12345", tokenCreated: time.Now(), state: StateVerified, changePassword: true}
 	Config.LoadUserByPasswordToken = func(token string) (User, error) {
 		return user, nil
 	}
@@ -103,4 +116,114 @@ func TestResetPassword(t *testing.T) {
 	if len(user.passwordHash) == 0 {
 		t.Error("No password was set")
 	}
+	if user.changePassword {
+		t.Error("Password change flag was not cleared")
+	}
+}
+
+func TestResetPasswordReused(t *testing.T) {
+	Config.PasswordHistory = 1
+	defer func() { Config.PasswordHistory = 0 }()
+	Config.LoadUserByPasswordToken = func(token string) (User, error) {
+		return &MyUser{
+			passwordToken: "12345",
+			tokenCreated:  time.Now(),
+			state:         StateVerified,
+			passwordHash:  []byte("$2a$04$l7kGFwuVt9CQMWdXuvA7wevaMMEzr.4O9SCEZzY8vP.UgUoGzsPCa"),
+		}, nil
+	}
+	computed, _ := runRequest(nil, nil, map[string]string{
+		"token":           "12345",
+		"password":        "kjhvasfiuwbucj",
+		"passwordconfirm": "kjhvasfiuwbucj",
+	}, ResetPassword)
+	assertString("HORP12345!PRU!F", computed, t)
+}
+
+func TestChangePasswordNotPending(t *testing.T) {
+	computed, _ := runRequest(nil, nil, nil, ChangePassword)
+	assertString("redirect", computed, t)
+}
+
+// pendingEnd returns the end time of a pending password change which has not
+// run out yet.
+func pendingEnd() string {
+	return time.Now().Add(time.Minute).Format(time.RFC3339)
+}
+
+func TestChangePasswordExpired(t *testing.T) {
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return &MyUser{email: email, state: StateVerified}, nil
+	}
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeyPasswordChange: "a@b", sessionKeyPasswordChangeEnd: time.Now().Add(-time.Minute).Format(time.RFC3339)}, nil, nil, ChangePassword)
+	assertString("redirect", computed, t)
+	computed, _ = runSessionRequest(nil, map[string]interface{}{sessionKeyPasswordChange: "a@b"}, nil, nil, ChangePassword)
+	assertString("redirect", computed, t)
+}
+
+func TestChangePasswordPage(t *testing.T) {
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return &MyUser{email: email, state: StateVerified}, nil
+	}
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeyPasswordChange: "a@b", sessionKeyPasswordChangeEnd: pendingEnd()}, nil, nil, ChangePassword)
+	assertString("HOCPF", computed, t)
+}
+
+func TestChangePasswordSame(t *testing.T) {
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return &MyUser{
+			email:        email,
+			state:        StateVerified,
+			passwordHash: []byte("$2a$04$l7kGFwuVt9CQMWdXuvA7wevaMMEzr.4O9SCEZzY8vP.UgUoGzsPCa"),
+		}, nil
+	}
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeyPasswordChange: "a@b", sessionKeyPasswordChangeEnd: pendingEnd()}, nil, map[string]string{
+		"password":        "kjhvasfiuwbucj",
+		"passwordconfirm": "kjhvasfiuwbucj",
+	}, ChangePassword)
+	assertString("HOCP!PRU!F", computed, t)
+}
+
+func TestChangePassword(t *testing.T) {
+	user := &MyUser{
+		email:          "a@b",
+		state:          StateVerified,
+		passwordHash:   []byte("$2a$04$l7kGFwuVt9CQMWdXuvA7wevaMMEzr.4O9SCEZzY8vP.UgUoGzsPCa"),
+		changePassword: true,
+	}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeyPasswordChange: "a@b", sessionKeyPasswordChangeEnd: pendingEnd()}, nil, map[string]string{
+		"password":        "lkasflkhasf",
+		"passwordconfirm": "lkasflkhasf",
+	}, ChangePassword)
+	assertString("redirect", computed, t)
+	if user.changePassword {
+		t.Error("Password change flag was not cleared")
+	}
+	if user.pwChanged.IsZero() {
+		t.Error("Time of password change was not recorded")
+	}
+}
+
+func TestRequirePasswordChange(t *testing.T) {
+	user := &MyUser{email: "a@b", state: StateVerified}
+	if err := RequirePasswordChange(user); err != nil {
+		t.Fatal(err)
+	}
+	if !passwordChangeRequired(user) {
+		t.Error("User was not flagged for a password change")
+	}
+}
+
+func TestPasswordExpired(t *testing.T) {
+	Config.PasswordMaxAge = 90 * 24 * time.Hour
+	defer func() { Config.PasswordMaxAge = 0 }()
+	if passwordChangeRequired(&MyUser{pwChanged: time.Now().Add(-89 * 24 * time.Hour)}) {
+		t.Error("Password expired too early")
+	}
+	if !passwordChangeRequired(&MyUser{pwChanged: time.Now().Add(-91 * 24 * time.Hour)}) {
+		t.Error("Password did not expire")
+	}
 }
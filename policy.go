@@ -0,0 +1,230 @@
+package users
+
+import (
+	"bufio"
+	_ "embed" // For the bundled list of common passwords.
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// bundledCommonPasswords is the list of commonly used passwords which is used
+// when NISTPasswordPolicy.CommonPasswordsFile is empty.
+//
+//go:embed commonpasswords.txt
+var bundledCommonPasswords string
+
+// Reasons for which a password may be rejected. These are found in the
+// Reason field of PasswordViolation and are typically used by the
+// "error_invalidpassword.gohtml" template to generate a localized message.
+const (
+	PasswordTooShort   = "tooshort"   // The password has fewer characters than required.
+	PasswordTooLong    = "toolong"    // The password has more characters than allowed.
+	PasswordContext    = "context"    // The password contains the application's name, the user's email address, or similar.
+	PasswordCommon     = "common"     // The password was found in a list of commonly used passwords.
+	PasswordRepetitive = "repetitive" // The password consists of one repeated character only.
+	PasswordSequence   = "sequence"   // The password is a simple sequence of characters.
+)
+
+// PasswordViolation describes one reason why a password was rejected.
+type PasswordViolation struct {
+	// The reason for the rejection, e.g. PasswordTooShort.
+	Reason string
+
+	// Additional information which may be helpful for the user, e.g. the
+	// minimum length for PasswordTooShort or the offending word for
+	// PasswordContext. May be nil.
+	Value interface{}
+}
+
+// PasswordPolicy checks new passwords before they are accepted. It is used
+// during sign-up, password resets, and password changes.
+type PasswordPolicy interface {
+	// Check examines a new password for a user with the given email address. An
+	// empty slice means that the password is acceptable. Errors are returned
+	// only if the check itself could not be performed.
+	Check(password, email string) ([]PasswordViolation, error)
+}
+
+// NISTPasswordPolicy is the default PasswordPolicy. It follows the guidelines
+// of NIST Special Publication 800-63B: Passwords need a minimum length, must
+// not exceed a maximum length (to allow for passphrases but prevent abuse), and
+// must not be a context-specific word, a commonly used password, a repetition
+// of one character, or a simple sequence. There are no composition rules.
+type NISTPasswordPolicy struct {
+	// The minimum number of characters (not bytes) of a password.
+	MinLength int
+
+	// The maximum number of characters of a password. 0 means no limit.
+	MaxLength int
+
+	// A list of words which must not be contained in passwords. This is
+	// typically the name of your application, its domain name etc. The user's
+	// email address and its local part are always added to this list.
+	ContextWords []string
+
+	// The name of a local file containing commonly used passwords, one per
+	// line. Comparisons are case-insensitive. If empty, a short list of the
+	// most common passwords bundled with this package is used. The file is read
+	// once, upon first use.
+	CommonPasswordsFile string
+
+	common      map[string]struct{} // The common passwords, lowercase.
+	commonFile  string              // The file from which "common" was read.
+	commonMutex sync.Mutex          // Guards "common" and "commonFile".
+}
+
+// Check implements the PasswordPolicy interface.
+func (p *NISTPasswordPolicy) Check(password, email string) ([]PasswordViolation, error) {
+	var violations []PasswordViolation
+
+	// Check length.
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, PasswordViolation{Reason: PasswordTooShort, Value: p.MinLength})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, PasswordViolation{Reason: PasswordTooLong, Value: p.MaxLength})
+	}
+	lower := strings.ToLower(password)
+
+	// Check context words.
+	words := append(append([]string{}, p.ContextWords...), Config.PasswordNames...)
+	if email != "" {
+		words = append(words, email)
+		if at := strings.LastIndex(email, "@"); at >= 3 {
+			words = append(words, email[:at])
+		}
+	}
+	for _, word := range words {
+		if word != "" && strings.Contains(lower, strings.ToLower(word)) {
+			violations = append(violations, PasswordViolation{Reason: PasswordContext, Value: word})
+			break
+		}
+	}
+
+	// Check common passwords.
+	common, err := p.commonPasswords()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := common[lower]; ok {
+		violations = append(violations, PasswordViolation{Reason: PasswordCommon})
+	}
+
+	// Check repetitions and sequences.
+	if length > 1 {
+		runes := []rune(lower)
+		repetitive, ascending, descending := true, true, true
+		for index := 1; index < len(runes); index++ {
+			if runes[index] != runes[0] {
+				repetitive = false
+			}
+			if runes[index] != runes[index-1]+1 {
+				ascending = false
+			}
+			if runes[index] != runes[index-1]-1 {
+				descending = false
+			}
+		}
+		if repetitive {
+			violations = append(violations, PasswordViolation{Reason: PasswordRepetitive})
+		} else if ascending || descending || isKeyboardSequence(lower) {
+			violations = append(violations, PasswordViolation{Reason: PasswordSequence})
+		}
+	}
+
+	return violations, nil
+}
+
+// commonPasswords returns the set of common passwords, loading them from
+// CommonPasswordsFile (or the bundled list) if they haven't been loaded yet.
+func (p *NISTPasswordPolicy) commonPasswords() (map[string]struct{}, error) {
+	p.commonMutex.Lock()
+	defer p.commonMutex.Unlock()
+	if p.common != nil && p.commonFile == p.CommonPasswordsFile {
+		return p.common, nil
+	}
+
+	var reader io.Reader = strings.NewReader(bundledCommonPasswords)
+	if p.CommonPasswordsFile != "" {
+		file, err := os.Open(p.CommonPasswordsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open common passwords file: %s", err)
+		}
+		defer file.Close()
+		reader = file
+	}
+	common := make(map[string]struct{})
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			common[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read common passwords file: %s", err)
+	}
+
+	p.common = common
+	p.commonFile = p.CommonPasswordsFile
+	return common, nil
+}
+
+// keyboardRows are character sequences found on common keyboard layouts.
+var keyboardRows = []string{
+	"1234567890",
+	"qwertyuiop",
+	"qwertzuiop",
+	"azertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+	"yxcvbnm",
+	"wxcvbn",
+}
+
+// isKeyboardSequence returns true if the given lowercase string is a sequence
+// of at least three adjacent keys in one keyboard row, in either direction.
+func isKeyboardSequence(password string) bool {
+	if len(password) < 3 {
+		return false
+	}
+	for _, row := range keyboardRows {
+		if strings.Contains(row, password) || strings.Contains(reverse(row), password) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverse returns the given string with its characters in reverse order.
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// validatePassword checks a new password for a user with the given email
+// address against Config.PasswordPolicy and, if provided,
+// Config.BreachedPasswords.
+func validatePassword(password, email string) ([]PasswordViolation, error) {
+	violations, err := Config.PasswordPolicy.Check(password, email)
+	if err != nil {
+		return nil, err
+	}
+	if Config.BreachedPasswords != nil {
+		breached, err := Config.BreachedPasswords.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{Reason: PasswordBreached})
+		}
+	}
+	return violations, nil
+}
@@ -0,0 +1,63 @@
+package users
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNISTPasswordPolicy(t *testing.T) {
+	policy := &NISTPasswordPolicy{
+		MinLength:           8,
+		MaxLength:           16,
+		ContextWords:        []string{"Example"},
+		CommonPasswordsFile: "test/commonpasswords.txt",
+	}
+	for password, expected := range map[string]string{
+		"lakjshfaksjhf":       "[]",
+		"lakjshfaksjhflakjsh": "[{toolong 16}]",
+		"abc":                 "[{tooshort 8} {sequence <nil>}]",
+		"myexamplepw":         "[{context Example}]",
+		"johndoe123":          "[{context johndoe}]",
+		"PASSWORD":            "[{common <nil>}]",
+		"zzzzzzzzz":           "[{repetitive <nil>}]",
+		"poiuztrewq":          "[{sequence <nil>}]",
+		"hgfedcba":            "[{sequence <nil>}]",
+	} {
+		violations, err := policy.Check(password, "johndoe@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertString(expected, fmt.Sprintf("%v", violations), t)
+	}
+}
+
+func TestNISTPasswordPolicyMissingFile(t *testing.T) {
+	policy := &NISTPasswordPolicy{MinLength: 8, CommonPasswordsFile: "test/doesnotexist.txt"}
+	if _, err := policy.Check("lakjshfaksjhf", "a@b"); err == nil {
+		t.Error("No error for missing common passwords file")
+	}
+}
+
+func TestNISTPasswordPolicyBundledList(t *testing.T) {
+	policy := &NISTPasswordPolicy{MinLength: 8}
+	for _, password := range []string{"password", "iloveyou", "Sunshine1"} {
+		violations, err := policy.Check(password, "a@b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertString("[{common <nil>}]", fmt.Sprintf("%v", violations), t)
+	}
+}
+
+func TestPasswordNames(t *testing.T) {
+	Config.PasswordNames = []string{"Acme"}
+	defer func() {
+		Config.PasswordNames = nil
+	}()
+	policy := &NISTPasswordPolicy{MinLength: 8}
+	violations, err := policy.Check("acmecorporation", "a@b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertString("[{context Acme}]", fmt.Sprintf("%v", violations), t)
+}
@@ -0,0 +1,258 @@
+package users
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// rememberCookie is the name of the cookie which holds a remember-me token.
+const rememberCookie = "users_remember"
+
+// RememberedDevice is a browser in which a user chose to stay logged in. The
+// browser holds a cookie with the device's ID and a secret. Only a hash of the
+// secret is stored here.
+type RememberedDevice struct {
+	// A random ID identifying this device.
+	ID string
+
+	// The SHA-256 hash of the secret stored in the browser's cookie.
+	Hash []byte
+
+	// Information about the browser when the user logged in.
+	UserAgent string
+	IPAddress string
+
+	// The time the device was remembered, the time it was last used to restore
+	// a login, and the time after which it will not be accepted anymore.
+	Created  time.Time
+	LastUsed time.Time
+	Expires  time.Time
+}
+
+// RememberUser is an optional extension of the User interface. Users
+// implementing it may choose to stay logged in on a device (see
+// Config.RememberMe) even after their session has ended.
+type RememberUser interface {
+	SetRememberedDevices(devices []RememberedDevice)
+	GetRememberedDevices() []RememberedDevice
+}
+
+// RememberedDevices lets a logged-in user view and revoke the devices on which
+// they chose to stay logged in. Upon a GET request, the
+// "remembereddevices.gohtml" template is rendered with the user's devices
+// (under the "devices" key) and the ID of the current device (under the
+// "current" key, if any). Upon a POST request, the device with the ID provided
+// in the "revoke" field is forgotten, or all devices if the field's value is
+// "all". The user is then redirected to Config.RouteRememberedDevices.
+func RememberedDevices(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	if blockImpersonation(response, request) {
+		return
+	}
+
+	// This page only works if the user is logged in.
+	user, _, _ := IsLoggedIn(response, request)
+	if user == nil {
+		RenderProgramError(response, request, "This page may only be accessed when you are logged in", "", nil)
+		return
+	}
+	rememberUser, ok := user.(RememberUser)
+	if !ok {
+		RenderProgramError(response, request, "User does not implement the RememberUser interface", "Remembered devices are not available", nil)
+		return
+	}
+
+	if request.Method == "GET" {
+		var current string
+		if cookie, err := request.Cookie(rememberCookie); err == nil {
+			current = strings.SplitN(cookie.Value, ":", 2)[0]
+		}
+		RenderPage(response, request, "remembereddevices.gohtml", map[string]interface{}{
+			"config":  Config,
+			"user":    user,
+			"devices": rememberUser.GetRememberedDevices(),
+			"current": current,
+		})
+		return
+	}
+
+	// Revoke devices.
+	revoke := request.PostFormValue("revoke")
+	var devices []RememberedDevice
+	if revoke != "all" {
+		for _, device := range rememberUser.GetRememberedDevices() {
+			if device.ID != revoke {
+				devices = append(devices, device)
+			}
+		}
+	}
+	rememberUser.SetRememberedDevices(devices)
+	if err := Config.UpdateUser(user); err != nil {
+		RenderProgramError(response, request, "Could not save user after revoking remembered devices", "", err)
+		return
+	}
+	if err := sessions.RefreshUser(user); err != nil {
+		RenderProgramError(response, request, "Could not refresh user after revoking remembered devices", "", err)
+		return
+	}
+	Config.Log.Printf("User %s (%s) revoked remembered device %s", user.GetID(), user.GetEmail(), revoke)
+
+	http.Redirect(response, request, Config.RouteRememberedDevices, 302)
+}
+
+// rememberDevice remembers the current browser for the given user and sets
+// the remember-me cookie. Expired devices of the user are removed.
+func rememberDevice(response http.ResponseWriter, request *http.Request, user User) error {
+	rememberUser, ok := user.(RememberUser)
+	if !ok {
+		return nil
+	}
+	id, err := sessions.RandomID(16)
+	if err != nil {
+		return err
+	}
+	secret, err := sessions.RandomID(32)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(secret))
+	now := time.Now()
+	devices := []RememberedDevice{{
+		ID:        id,
+		Hash:      hash[:],
+		UserAgent: request.UserAgent(),
+		IPAddress: request.RemoteAddr,
+		Created:   now,
+		Expires:   now.Add(Config.RememberMe),
+	}}
+	for _, device := range rememberUser.GetRememberedDevices() {
+		if device.Expires.After(now) {
+			devices = append(devices, device)
+		}
+	}
+	rememberUser.SetRememberedDevices(devices)
+	if err := Config.UpdateUser(user); err != nil {
+		return err
+	}
+
+	http.SetCookie(response, &http.Cookie{
+		Name:     rememberCookie,
+		Value:    id + ":" + secret,
+		Path:     "/",
+		Expires:  now.Add(Config.RememberMe),
+		MaxAge:   int(Config.RememberMe / time.Second),
+		Secure:   request.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	Config.Log.Printf("Remembering device %s for user %s (%s)", id, user.GetID(), user.GetEmail())
+	return nil
+}
+
+// rememberedUser returns the user remembered by the browser's remember-me
+// cookie, or nil if there is no valid cookie. Invalid cookies are deleted.
+func rememberedUser(response http.ResponseWriter, request *http.Request) User {
+	cookie, err := request.Cookie(rememberCookie)
+	if err != nil {
+		return nil
+	}
+	fields := strings.SplitN(cookie.Value, ":", 2)
+	var (
+		user  User
+		index = -1
+	)
+	if len(fields) == 2 {
+		user, err = Config.LoadUserByRememberedDevice(fields[0])
+		if err != nil {
+			Config.Log.Printf("Could not load user for remembered device %s: %s", fields[0], err)
+			return nil
+		}
+	}
+	if rememberUser, ok := user.(RememberUser); ok {
+		hash := sha256.Sum256([]byte(fields[1]))
+		for i, device := range rememberUser.GetRememberedDevices() {
+			if device.ID == fields[0] && device.Expires.After(time.Now()) && subtle.ConstantTimeCompare(device.Hash, hash[:]) == 1 {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 {
+		Config.Log.Printf("Invalid remember-me cookie received on %s", request.RequestURI)
+		forgetDevice(response, request, nil)
+		return nil
+	}
+
+	// Note when the device was used.
+	rememberUser := user.(RememberUser)
+	devices := rememberUser.GetRememberedDevices()
+	devices[index].LastUsed = time.Now()
+	rememberUser.SetRememberedDevices(devices)
+	if err := Config.UpdateUser(user); err != nil {
+		Config.Log.Printf("Could not save user %s (%s) after using remembered device: %s", user.GetID(), user.GetEmail(), err)
+	}
+	return user
+}
+
+// saveRememberChoice stores the user's choice to stay logged in in the session
+// while their login is pending.
+func saveRememberChoice(session *sessions.Session, remember bool) error {
+	if !remember {
+		return nil
+	}
+	return session.Set(sessionKeyRemember, true)
+}
+
+// takeRememberChoice returns the choice stored with saveRememberChoice() and
+// removes it from the session.
+func takeRememberChoice(session *sessions.Session) (bool, error) {
+	remember, _ := session.Get(sessionKeyRemember, false).(bool)
+	if !remember {
+		return false, nil
+	}
+	return true, session.Delete(sessionKeyRemember)
+}
+
+// forgetDevice deletes the browser's remember-me cookie. If a user is
+// provided, the device is also removed from the user's remembered devices.
+func forgetDevice(response http.ResponseWriter, request *http.Request, user User) error {
+	cookie, err := request.Cookie(rememberCookie)
+	if err != nil {
+		return nil // Nothing to forget.
+	}
+	http.SetCookie(response, &http.Cookie{
+		Name:     rememberCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	rememberUser, ok := user.(RememberUser)
+	if !ok {
+		return nil
+	}
+	id := strings.SplitN(cookie.Value, ":", 2)[0]
+	var devices []RememberedDevice
+	for _, device := range rememberUser.GetRememberedDevices() {
+		if device.ID != id {
+			devices = append(devices, device)
+		}
+	}
+	rememberUser.SetRememberedDevices(devices)
+	return Config.UpdateUser(user)
+}
+
+// forgetAllDevices removes all remembered devices from the given user. The
+// user is not saved.
+func forgetAllDevices(user User) {
+	if rememberUser, ok := user.(RememberUser); ok {
+		rememberUser.SetRememberedDevices(nil)
+	}
+}
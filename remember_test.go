@@ -0,0 +1,150 @@
+package users
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// rememberedRequest returns a request carrying a remember-me cookie for a new
+// remembered device of the given user.
+func rememberedRequest(t *testing.T, user User) *http.Request {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	if err := rememberDevice(recorder, httptest.NewRequest("POST", "/login", nil), user); err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("GET", "/test", nil)
+	for _, cookie := range recorder.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	return request
+}
+
+func TestLogInRememberMe(t *testing.T) {
+	for _, remember := range []string{"", "1"} {
+		user := &MyUser{email: "a@b", state: StateVerified, passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC")}
+		Config.LoadUserByEmail = func(email string) (User, error) {
+			return user, nil
+		}
+		computed, _ := runRequest(nil, nil, map[string]string{"email": "a@b", "password": "12345", "remember": remember}, LogIn)
+		assertString("redirect", computed, t)
+		if remember == "" && len(user.devices) != 0 {
+			t.Error("Device was remembered without the user's consent")
+		}
+		if remember != "" && (len(user.devices) != 1 || user.devices[0].Expires.Before(time.Now().Add(Config.RememberMe-time.Minute))) {
+			t.Errorf("Device was not remembered correctly: %+v", user.devices)
+		}
+	}
+}
+
+func TestRememberedUser(t *testing.T) {
+	user := &MyUser{email: "a@b", state: StateVerified}
+	Config.LoadUserByRememberedDevice = func(id string) (User, error) {
+		return user, nil
+	}
+	request := rememberedRequest(t, user)
+	if rememberedUser(httptest.NewRecorder(), request) != user {
+		t.Error("Remembered user was not found")
+	}
+	if user.devices[0].LastUsed.IsZero() {
+		t.Error("Remembered device was not updated")
+	}
+
+	// Wrong secret.
+	cookie, _ := request.Cookie(rememberCookie)
+	request = httptest.NewRequest("GET", "/test", nil)
+	request.AddCookie(&http.Cookie{Name: rememberCookie, Value: cookie.Value + "x"})
+	if rememberedUser(httptest.NewRecorder(), request) != nil {
+		t.Error("Remembered user found with wrong secret")
+	}
+
+	// Expired device.
+	request = rememberedRequest(t, user)
+	user.devices[0].Expires = time.Now().Add(-time.Minute)
+	if rememberedUser(httptest.NewRecorder(), request) != nil {
+		t.Error("Remembered user found with expired device")
+	}
+
+	// Forgotten devices.
+	request = rememberedRequest(t, user)
+	forgetAllDevices(user)
+	if rememberedUser(httptest.NewRecorder(), request) != nil {
+		t.Error("Remembered user found after forgetting all devices")
+	}
+}
+
+func TestIsLoggedInRemembered(t *testing.T) {
+	var event string
+	user := &MyUser{email: "a@b", state: StateVerified}
+	Config.LoadUserByRememberedDevice = func(id string) (User, error) {
+		return user, nil
+	}
+	Config.LoggedIn = func(user User, ipAddress string) {
+		event = "logged in"
+	}
+	defer func() { Config.LoggedIn = nil }()
+	sessions.PurgeSessions()
+	sessions.Persistence = sessions.ExtendablePersistenceLayer{}
+	loggedIn, _, _ := IsLoggedIn(httptest.NewRecorder(), rememberedRequest(t, user))
+	if loggedIn != user {
+		t.Error("Remembered user was not logged in")
+	}
+	assertString("logged in", event, t)
+
+	// Users who must change their password are not logged in.
+	user.changePassword = true
+	loggedIn, _, _ = IsLoggedIn(httptest.NewRecorder(), rememberedRequest(t, user))
+	if loggedIn != nil {
+		t.Error("Remembered user was logged in despite required password change")
+	}
+}
+
+func TestForgetDevice(t *testing.T) {
+	user := &MyUser{email: "a@b", state: StateVerified, devices: []RememberedDevice{{ID: "other", Expires: time.Now().Add(time.Hour)}}}
+	request := rememberedRequest(t, user)
+	recorder := httptest.NewRecorder()
+	if err := forgetDevice(recorder, request, user); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.devices) != 1 || user.devices[0].ID != "other" {
+		t.Errorf("Wrong devices forgotten: %+v", user.devices)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != rememberCookie || cookies[0].MaxAge >= 0 {
+		t.Error("Remember-me cookie was not deleted")
+	}
+}
+
+func TestRememberedDevices(t *testing.T) {
+	user := &MyUser{email: "x", state: StateVerified, devices: []RememberedDevice{{ID: "a"}, {ID: "b"}}}
+	computed, _ := runRequest(user, nil, nil, RememberedDevices)
+	assertString("HIRD2F", computed, t)
+	computed, _ = runRequest(user, nil, map[string]string{"revoke": "a"}, RememberedDevices)
+	assertString("redirect", computed, t)
+	if len(user.devices) != 1 || user.devices[0].ID != "b" {
+		t.Errorf("Wrong device was forgotten: %+v", user.devices)
+	}
+	computed, _ = runRequest(user, nil, map[string]string{"revoke": "all"}, RememberedDevices)
+	assertString("redirect", computed, t)
+	if len(user.devices) != 0 {
+		t.Error("Not all devices were forgotten")
+	}
+}
+
+func TestRememberMeAfterSecondFactor(t *testing.T) {
+	user := &MyUser{email: "a@b", state: StateVerified, totpSecret: testTOTPSecret}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeySecondFactor: "a@b", sessionKeyRemember: true}, nil, map[string]string{
+		"code": totpCode([]byte("12345678901234567890"), time.Now().Unix()/totpPeriod),
+	}, TOTPChallenge)
+	assertString("redirect", computed, t)
+	if len(user.devices) != 1 {
+		t.Error("Device was not remembered after second factor")
+	}
+}
@@ -0,0 +1,118 @@
+package users
+
+import (
+	"fmt"
+	"time"
+)
+
+// SendPasswordExpiryReminders sends an email (using the
+// "password_expiry.tmpl" mail template) to all users who may log in (see
+// State.LogIn) and whose password expires within the next
+// Config.PasswordExpiryReminder but not more than one day earlier than that.
+// This function is meant to be called once a day, e.g. by a goroutine in your
+// application, so that each user receives one reminder. Users are iterated with Config.ForEachUser and only users
+// implementing the PasswordAgeUser interface are considered.
+//
+// The number of reminders sent is returned. Errors sending individual emails
+// are logged but do not stop the process.
+func SendPasswordExpiryReminders() (int, error) {
+	if Config.PasswordMaxAge <= 0 || Config.PasswordExpiryReminder <= 0 {
+		return 0, nil
+	}
+	if Config.ForEachUser == nil {
+		return 0, fmt.Errorf("ForEachUser is not implemented")
+	}
+
+	now := time.Now()
+	var sent int
+	err := Config.ForEachUser(func(user User) error {
+		ageUser, ok := user.(PasswordAgeUser)
+		if !ok || !stateAllowsLogIn(user) {
+			return nil
+		}
+		changed := ageUser.GetPasswordChanged()
+		if changed.IsZero() {
+			return nil
+		}
+		expiry := changed.Add(Config.PasswordMaxAge)
+		remaining := expiry.Sub(now)
+		if remaining <= 0 || remaining > Config.PasswordExpiryReminder || remaining <= Config.PasswordExpiryReminder-24*time.Hour {
+			return nil
+		}
+
+		// Send a reminder.
+		data := map[string]interface{}{
+			"email":  user.GetEmail(),
+			"expiry": expiry.Format("Monday, Jan 2, 2006, 15:04:05"),
+			"config": Config,
+			"user":   user,
+		}
+		if err := SendMail(nil, user.GetEmail(), "password_expiry.tmpl", data); err != nil {
+			Config.Log.Printf("Could not send password expiry reminder to %s (%s): %s", user.GetID(), user.GetEmail(), err)
+			return nil
+		}
+		Config.Log.Printf("Sent password expiry reminder to %s (%s)", user.GetID(), user.GetEmail())
+		sent++
+		return nil
+	})
+	if err != nil {
+		return sent, fmt.Errorf("Could not iterate users for password expiry reminders: %s", err)
+	}
+
+	return sent, nil
+}
+
+// SendAccountExpiryReminders sends an email (using the "account_expiry.tmpl"
+// mail template) to all users whose account (see ExpiryUser) expires within
+// the next Config.AccountExpiryReminder but not more than one day earlier than
+// that. Like SendPasswordExpiryReminders(), this function is meant to be called
+// once a day. Only users who may currently log in (see State.LogIn) and who
+// have not expired yet are considered.
+//
+// The number of reminders sent is returned. Errors sending individual emails
+// are logged but do not stop the process.
+func SendAccountExpiryReminders() (int, error) {
+	if Config.AccountExpiryReminder <= 0 {
+		return 0, nil
+	}
+	if Config.ForEachUser == nil {
+		return 0, fmt.Errorf("ForEachUser is not implemented")
+	}
+
+	now := time.Now()
+	var sent int
+	err := Config.ForEachUser(func(user User) error {
+		expiryUser, ok := user.(ExpiryUser)
+		if !ok || user.GetState() == StateExpired || !stateAllowsLogIn(user) {
+			return nil
+		}
+		expiry := expiryUser.GetExpiry()
+		if expiry.IsZero() {
+			return nil
+		}
+		remaining := expiry.Sub(now)
+		if remaining <= 0 || remaining > Config.AccountExpiryReminder || remaining <= Config.AccountExpiryReminder-24*time.Hour {
+			return nil
+		}
+
+		// Send a reminder.
+		data := map[string]interface{}{
+			"email":  user.GetEmail(),
+			"expiry": expiry.Format("Monday, Jan 2, 2006, 15:04:05"),
+			"config": Config,
+			"user":   user,
+		}
+		if err := SendMail(nil, user.GetEmail(), "account_expiry.tmpl", data); err != nil {
+			Config.Log.Printf("Could not send account expiry reminder to %s (%s): %s", user.GetID(), user.GetEmail(), err)
+			return nil
+		}
+		Config.Log.Printf("Sent account expiry reminder to %s (%s)", user.GetID(), user.GetEmail())
+		sent++
+		return nil
+	})
+	if err != nil {
+		return sent, fmt.Errorf("Could not iterate users for account expiry reminders: %s", err)
+	}
+
+	return sent, nil
+}
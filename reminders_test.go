@@ -0,0 +1,39 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendPasswordExpiryReminders(t *testing.T) {
+	Config.PasswordMaxAge = 90 * 24 * time.Hour
+	defer func() { Config.PasswordMaxAge = 0 }()
+	Config.ForEachUser = func(callback func(user User) error) error {
+		for _, user := range []User{
+			&MyUser{email: "a@b", state: StateVerified, pwChanged: time.Now().Add(-(76*24 + 12) * time.Hour)},
+			&MyUser{email: "b@c", state: StateVerified, pwChanged: time.Now().Add(-70 * 24 * time.Hour)},
+			&MyUser{email: "c@d", state: StateVerified, pwChanged: time.Now().Add(-80 * 24 * time.Hour)},
+			&MyUser{email: "d@e", state: StateCreated, pwChanged: time.Now().Add(-77 * 24 * time.Hour)},
+		} {
+			if err := callback(user); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var recipients []string
+	Config.SendEmails = true
+	Config.SendEmail = func(recipient, subject, body string) error {
+		recipients = append(recipients, recipient)
+		return nil
+	}
+	sent, err := SendPasswordExpiryReminders()
+	Config.SendEmails = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || len(recipients) != 1 {
+		t.Fatalf("Expected one reminder, got %d", sent)
+	}
+	assertString("a@b", recipients[0], t)
+}
@@ -0,0 +1,144 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is a named set of permissions. A role may inherit the permissions of
+// other roles. Roles are defined in Config.Roles.
+type Role struct {
+	// The permissions granted by this role. Permissions are dot-separated
+	// strings, e.g. "billing.edit". A permission ending in ".*" grants all
+	// permissions starting with the part before the asterisk, e.g.
+	// "billing.*" grants "billing.edit" and "billing.view". A single "*"
+	// grants all permissions.
+	Permissions []string
+
+	// The names of the roles whose permissions this role also grants.
+	Inherits []string
+}
+
+// RoleUser is an optional extension of the User interface. Users implementing
+// it can be assigned roles with AssignRole() and RevokeRole(). The roles
+// themselves are retrieved with GetRoles() which all users implement.
+type RoleUser interface {
+	SetRoles(roles []string)
+}
+
+// HasRole returns true if the given user has the given role, either directly
+// or because one of their roles inherits it.
+func HasRole(user User, role string) bool {
+	if user == nil {
+		return false
+	}
+	_, ok := userRoles(user)[role]
+	return ok
+}
+
+// Can returns true if one of the given user's roles (including inherited
+// roles) grants the given permission.
+func Can(user User, permission string) bool {
+	if user == nil {
+		return false
+	}
+	for name := range userRoles(user) {
+		for _, granted := range Config.Roles[name].Permissions {
+			if permissionGranted(granted, permission) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequirePermission wraps the given handler such that it is only called if a
+// user is logged in, is in a state which grants access (see RequireVerified()),
+// and has the given permission (see Can()). See RequireState() for details.
+func RequirePermission(permission string, handler http.Handler) http.Handler {
+	return RequireState(func(user User) bool {
+		return stateAllowsAccess(user) && Can(user, permission)
+	}, handler)
+}
+
+// AssignRole adds the given role to the user's roles and saves the user. The
+// role must be defined in Config.Roles and the user must implement the
+// RoleUser interface.
+func AssignRole(user User, role string) error {
+	roleUser, ok := user.(RoleUser)
+	if !ok {
+		return errors.New("User does not implement the RoleUser interface")
+	}
+	if _, ok := Config.Roles[role]; !ok {
+		return fmt.Errorf("Unknown role: %s", role)
+	}
+	roles := user.GetRoles()
+	for _, existing := range roles {
+		if existing == role {
+			return nil // Already assigned.
+		}
+	}
+	roleUser.SetRoles(append(append([]string(nil), roles...), role))
+	if err := saveAndRefreshUser(user); err != nil {
+		return err
+	}
+	Config.Log.Printf("Role %s was assigned to user %s (%s)", role, user.GetID(), user.GetEmail())
+	return nil
+}
+
+// RevokeRole removes the given role from the user's roles and saves the user.
+// Roles inherited from other roles are not affected. The user must implement
+// the RoleUser interface.
+func RevokeRole(user User, role string) error {
+	roleUser, ok := user.(RoleUser)
+	if !ok {
+		return errors.New("User does not implement the RoleUser interface")
+	}
+	var roles []string
+	for _, existing := range user.GetRoles() {
+		if existing != role {
+			roles = append(roles, existing)
+		}
+	}
+	roleUser.SetRoles(roles)
+	if err := saveAndRefreshUser(user); err != nil {
+		return err
+	}
+	Config.Log.Printf("Role %s was revoked from user %s (%s)", role, user.GetID(), user.GetEmail())
+	return nil
+}
+
+// userRoles returns the names of all roles of the given user, including the
+// roles inherited from them. Roles not defined in Config.Roles are ignored.
+func userRoles(user User) map[string]struct{} {
+	roles := make(map[string]struct{})
+	queue := append([]string(nil), user.GetRoles()...) // Don't modify the user's slice.
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if _, ok := roles[name]; ok {
+			continue // Already visited. This also breaks cycles.
+		}
+		role, ok := Config.Roles[name]
+		if !ok {
+			continue
+		}
+		roles[name] = struct{}{}
+		queue = append(queue, role.Inherits...)
+	}
+	return roles
+}
+
+// permissionGranted returns true if the granted permission (which may contain
+// a wildcard, see Role) covers the requested permission.
+func permissionGranted(granted, requested string) bool {
+	if granted == "*" || granted == requested {
+		return true
+	}
+	if strings.HasSuffix(granted, ".*") {
+		return strings.HasPrefix(requested, granted[:len(granted)-1])
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package users
+
+import (
+	"net/http"
+	"testing"
+)
+
+// setTestRoles defines a role hierarchy and returns a function which removes
+// it again.
+func setTestRoles() func() {
+	Config.Roles = map[string]Role{
+		"viewer":     {Permissions: []string{"billing.view", "reports.view"}},
+		"accountant": {Permissions: []string{"billing.*"}, Inherits: []string{"viewer"}},
+		"admin":      {Permissions: []string{"*"}, Inherits: []string{"accountant"}},
+		"loop":       {Inherits: []string{"loop", "viewer"}},
+	}
+	return func() {
+		Config.Roles = nil
+	}
+}
+
+func TestCan(t *testing.T) {
+	defer setTestRoles()()
+	for index, test := range []struct {
+		roles      []string
+		permission string
+		result     bool
+	}{
+		{nil, "billing.view", false},
+		{[]string{"viewer"}, "billing.view", true},
+		{[]string{"viewer"}, "billing.edit", false},
+		{[]string{"accountant"}, "billing.edit", true},
+		{[]string{"accountant"}, "reports.view", true},
+		{[]string{"accountant"}, "reports.edit", false},
+		{[]string{"accountant"}, "billingx", false},
+		{[]string{"admin"}, "users.delete", true},
+		{[]string{"loop"}, "reports.view", true},
+		{[]string{"unknown"}, "billing.view", false},
+	} {
+		if Can(&MyUser{roles: test.roles}, test.permission) != test.result {
+			t.Errorf("Test %d failed, expected %t", index, test.result)
+		}
+	}
+	if Can(nil, "billing.view") {
+		t.Error("Nil user has a permission")
+	}
+
+	// Inherited roles are not written into the user's roles.
+	roles := make([]string, 1, 4)
+	roles[0] = "accountant"
+	Can(&MyUser{roles: roles}, "billing.view")
+	if extended := roles[:2]; extended[1] != "" {
+		t.Errorf("User's roles were modified: %v", extended)
+	}
+}
+
+func TestHasRole(t *testing.T) {
+	defer setTestRoles()()
+	user := &MyUser{roles: []string{"accountant"}}
+	if !HasRole(user, "accountant") || !HasRole(user, "viewer") || HasRole(user, "admin") {
+		t.Error("Wrong roles")
+	}
+}
+
+func TestAssignRole(t *testing.T) {
+	defer setTestRoles()()
+	user := &MyUser{}
+	if err := AssignRole(user, "unknown"); err == nil {
+		t.Error("Unknown role was assigned")
+	}
+	if err := AssignRole(user, "viewer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AssignRole(user, "viewer"); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.roles) != 1 || !Can(user, "reports.view") {
+		t.Errorf("Role not assigned correctly: %v", user.roles)
+	}
+	if err := RevokeRole(user, "viewer"); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.roles) != 0 {
+		t.Errorf("Role not revoked: %v", user.roles)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	defer setTestRoles()()
+	handler := RequirePermission("billing.edit", http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	}))
+	computed, _ := runRequest(&MyUser{state: StateVerified, roles: []string{"accountant"}}, nil, nil, handler.ServeHTTP)
+	assertString("OK", computed, t)
+	computed, _ = runRequest(&MyUser{state: StateVerified, roles: []string{"viewer"}}, nil, nil, handler.ServeHTTP)
+	assertString("HIADF", computed, t)
+
+	// Expired users are refused despite their roles.
+	computed, _ = runRequest(&MyUser{state: StateExpired, roles: []string{"accountant"}}, nil, nil, handler.ServeHTTP)
+	assertString("HIADF", computed, t)
+}
@@ -3,7 +3,6 @@ package users
 import (
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -19,41 +18,78 @@ import (
 // (using the "verification_new.tmpl" mail template for new users and the
 // "verification_existing.tmpl" mail template for existing users) and the
 // "validationsent.gohtml" template to be shown.
+//
+// A "next" parameter (see LogIn()) is carried through the sign-up form and
+// the verification link so that users are sent to that page after verifying
+// their email address and logging in.
+//
+// If Config.InviteOnly is true, the sign-up is closed and the
+// "signupclosed.gohtml" template is rendered instead (see Invite()).
 func SignUp(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	next := safeNext(request.FormValue("next"))
 	if request.Method == "GET" {
 		user, _, _ := IsLoggedIn(response, request)
 		if user != nil {
 			Config.Log.Printf("Sign-up page visited while logged in with %s (%s)", user.GetID(), user.GetEmail())
-			http.Redirect(response, request, Config.RouteLoggedIn, 302)
+			http.Redirect(response, request, loggedInRoute(user, next), 302)
 			return
 		}
-
-		RenderPageBasic(response, request, "signup.gohtml", nil)
+	}
+	if Config.InviteOnly {
+		Config.Log.Printf("Sign-up attempted while invite-only from %s", request.RemoteAddr)
+		RenderPage(response, request, "signupclosed.gohtml", map[string]interface{}{"config": Config})
+		return
+	}
+	if request.Method == "GET" {
+		RenderPage(response, request, "signup.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"next": next}})
 		return
 	}
 
 	// Get the form entries.
-	email := strings.ToLower(request.PostFormValue("email"))
+	address := request.PostFormValue("email")
 	password := request.PostFormValue("password")
 	passwordConfirm := request.PostFormValue("passwordconfirm")
 
-	// Perform a very basic email check. We'll send a validation email anyway.
-	if !strings.Contains(email, "@") {
-		RenderPageError(response, request, "signup.gohtml", "invalidemail", map[string]string{"email": email}, nil)
+	// Check the email address syntax. We'll send a validation email anyway.
+	email, err := NormalizeEmail(address)
+	if err != nil {
+		Config.Log.Printf("Sign-up rejected for %q: %s", address, err)
+		RenderPageError(response, request, "signup.gohtml", "invalidemail", map[string]string{"email": address, "next": next}, nil)
+		return
+	}
+
+	// Check the email domain.
+	reason, err := checkEmailDomain(email)
+	if err != nil {
+		RenderProgramError(response, request, "Could not check email domain", "", err)
+		return
+	}
+	if reason != "" {
+		Config.Log.Printf("Sign-up rejected for %s, domain %s", email, reason)
+		RenderPageError(response, request, "signup.gohtml", "emaildomain", map[string]string{"email": email, "next": next, "reason": reason}, nil)
 		return
 	}
 
 	// Check if passwords match.
 	if password != passwordConfirm {
 		Config.Log.Printf("Passwords for %s don't match", email)
-		RenderPageError(response, request, "signup.gohtml", "passwordsdontmatch", map[string]string{"email": email}, nil)
+		RenderPageError(response, request, "signup.gohtml", "passwordsdontmatch", map[string]string{"email": email, "next": next}, nil)
 		return
 	}
 
 	// Check password integrity.
-	if result := sessions.ReasonablePassword(password, append(Config.PasswordNames, email)); result != sessions.PasswordOK {
-		Config.Log.Printf("Password was rejected for %s, reason: %d", email, result)
-		RenderPageError(response, request, "signup.gohtml", "invalidpassword", map[string]interface{}{"email": email, "issue": result}, nil)
+	violations, err := validatePassword(password, email)
+	if err != nil {
+		RenderProgramError(response, request, "Could not check password", "", err)
+		return
+	}
+	if len(violations) > 0 {
+		Config.Log.Printf("Password was rejected for %s, reasons: %v", email, violations)
+		RenderPageError(response, request, "signup.gohtml", "invalidpassword", map[string]interface{}{"email": email, "violations": violations, "next": next}, nil)
 		return
 	}
 
@@ -72,6 +108,10 @@ func SignUp(response http.ResponseWriter, request *http.Request) {
 
 	// Create a new user.
 	user := Config.NewUser()
+	if _, ok := user.(ApprovalUser); Config.SignUpApproval && !ok {
+		RenderProgramError(response, request, "Config.SignUpApproval is set but users don't implement ApprovalUser", "Could not sign up", nil)
+		return
+	}
 	verificationID, err := sessions.RandomID(22)
 	if err != nil {
 		RenderProgramError(response, request, "Unable to create a verification ID", "", err)
@@ -81,7 +121,7 @@ func SignUp(response http.ResponseWriter, request *http.Request) {
 	user.SetVerificationID(verificationID, idCreated)
 	user.SetState(StateCreated)
 	user.SetEmail(email)
-	user.SetPasswordHash(hash)
+	setPasswordHash(user, hash)
 
 	// Save that new user.
 	existingUser, err := Config.SaveNewUserAtomic(user)
@@ -95,12 +135,9 @@ func SignUp(response http.ResponseWriter, request *http.Request) {
 	if existingUser != nil {
 		// We already have this user in our database. What we do now depends on
 		// their state.
-		switch existingUser.GetState() {
-		case StateVerified, StateExpired:
-			// Don't verify again. We send a notification of this creation attempt.
-			template = "verification_existing.tmpl"
-			Config.Log.Printf("Sending verification notification for existing account: %s (%s)", existingUser.GetID(), email)
-		case StateCreated:
+		_, registered := Config.States[existingUser.GetState()]
+		switch {
+		case existingUser.GetState() == StateCreated:
 			// This user was already created but not yet verified. Refresh the
 			// verification ID.
 			user.SetID(existingUser.GetID())
@@ -109,6 +146,12 @@ func SignUp(response http.ResponseWriter, request *http.Request) {
 				return
 			}
 			Config.Log.Printf("Sending repeated verification email for new account: %s (%s)", user.GetID(), email)
+		case registered:
+			// Don't verify again. We send a notification of this creation attempt
+			// to the registered address.
+			email = existingUser.GetEmail()
+			template = "verification_existing.tmpl"
+			Config.Log.Printf("Sending verification notification for existing account: %s (%s)", existingUser.GetID(), email)
 		default:
 			RenderProgramError(response, request, fmt.Sprintf("Unknown user state %d: %s (%s)", user.GetState(), user.GetID(), email), "Invalid user state", nil)
 			return
@@ -125,6 +168,8 @@ func SignUp(response http.ResponseWriter, request *http.Request) {
 		"ip":           request.RemoteAddr,
 		"agent":        request.UserAgent(),
 		"verification": verificationID,
+		"code":         emailCode(verificationID),
+		"next":         next,
 		"validity":     idCreated.Add(3 * 24 * time.Hour).Format("Monday, Jan 2, 2006, 15:04:05"),
 		"config":       Config,
 		"user":         user,
@@ -137,16 +182,73 @@ func SignUp(response http.ResponseWriter, request *http.Request) {
 	RenderPage(response, request, "verificationsent.gohtml", map[string]interface{}{"config": Config, "email": email})
 }
 
-// Verify processes a verification link by checking the provided verification ID
-// and, if valid, setting the user's state to "verified".
+// Verify processes a verification link by checking the provided verification
+// ID. Upon a GET request, if the ID is valid, the "confirmverify.gohtml"
+// template is rendered, containing a form which posts the ID back to this
+// handler. Only upon that POST request is the user's state set to "verified".
+// This way, mail scanners which follow every link in an email cannot verify an
+// account.
+//
+// If Config.EmailCodeDigits is not 0, users may instead post their email
+// address ("email" field) and the code sent to them ("code" field). If only
+// the email address is provided, or if the request is not a POST request, the
+// "entercode.gohtml" template is rendered with a form to enter the code.
+//
+// A "next" parameter (see SignUp()) is passed on to the "confirmverify.gohtml"
+// and "verified.gohtml" templates under the "infos" key.
+//
+// If Config.SignUpApproval is true, users who have not been approved yet are
+// put into StatePendingApproval instead, the administrators are notified, and
+// the "awaitingapproval.gohtml" template is rendered.
 func Verify(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	// Show the code entry form.
+	email := request.FormValue("email")
+	code := request.FormValue("code")
+	if Config.EmailCodeDigits > 0 && email != "" && (code == "" || request.Method != "POST") {
+		RenderPage(response, request, "entercode.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"email": email, "action": Config.RouteVerify}})
+		return
+	}
+
 	if Config.ThrottleVerification != nil {
 		Config.ThrottleVerification()
 	}
 
-	// Find the user for this verification ID.
+	// Find the user for this verification ID or code.
+	var (
+		user User
+		err  error
+	)
 	verificationID := request.FormValue("id")
-	user, err := Config.LoadUserByVerificationID(verificationID)
+	next := safeNext(request.FormValue("next"))
+	if Config.EmailCodeDigits > 0 && email != "" {
+		var exhausted bool
+		user, exhausted, err = loadUserByEmailCode(email, code, func(u User) (string, time.Time) {
+			id, created := u.GetVerificationID()
+			return id, created.Add(3 * 24 * time.Hour)
+		}, func(u User) {
+			u.SetVerificationID("", time.Unix(0, 0))
+		})
+		if err != nil {
+			RenderProgramError(response, request, "Could not load user for verification code", "", err)
+			return
+		}
+		if user == nil {
+			Config.Log.Printf("Wrong verification code entered for %s", email)
+			errorName := "codeinvalid"
+			if exhausted {
+				errorName = "codeexhausted"
+			}
+			RenderPageError(response, request, "entercode.gohtml", errorName, map[string]string{"email": email, "action": Config.RouteVerify}, nil)
+			return
+		}
+		verificationID, _ = user.GetVerificationID()
+	} else {
+		user, err = Config.LoadUserByVerificationID(verificationID)
+	}
 	if err != nil {
 		RenderProgramError(response, request, "Could not load user for verification ID", "", err)
 		return
@@ -177,8 +279,21 @@ func Verify(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if request.Method != "POST" {
+		// Ask the user to confirm.
+		RenderPage(response, request, "confirmverify.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"id": verificationID, "next": next}})
+		return
+	}
+
 	// User has been verified. Update status.
-	user.SetState(StateVerified)
+	state := StateVerified
+	if approvalRequired(user) {
+		state = StatePendingApproval
+	}
+	if err = ChangeState(user, state); err != nil {
+		RenderProgramError(response, request, fmt.Sprintf("Could not change state of user %s (%s)", user.GetID(), user.GetEmail()), "Could not verify user", err)
+		return
+	}
 	user.SetVerificationID("", time.Unix(0, 0)) // Invalidate verification ID.
 	if err = Config.UpdateUser(user); err != nil {
 		RenderProgramError(response, request, fmt.Sprintf("Could not verify user %s (%s)", user.GetID(), user.GetEmail()), "Could not verify user", err)
@@ -192,6 +307,16 @@ func Verify(response http.ResponseWriter, request *http.Request) {
 		session.LogOut()
 	}
 
+	// New users may need to be approved first.
+	if state == StatePendingApproval {
+		if err := requestApproval(request, user); err != nil {
+			RenderProgramError(response, request, fmt.Sprintf("Could not request approval for user %s (%s)", user.GetID(), user.GetEmail()), "Could not request approval", err)
+			return
+		}
+		RenderPage(response, request, "awaitingapproval.gohtml", map[string]interface{}{"config": Config})
+		return
+	}
+
 	// Show a confirmation.
-	RenderPageBasic(response, request, "verified.gohtml", nil)
+	RenderPage(response, request, "verified.gohtml", map[string]interface{}{"config": Config, "infos": map[string]string{"next": next}})
 }
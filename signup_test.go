@@ -41,7 +41,7 @@ func TestSignUpNoPassword(t *testing.T) {
 	computed, _ := runRequest(nil, nil, map[string]string{
 		"email": "a@b",
 	}, SignUp)
-	assertString("HOS!a3!Ea@bF", computed, t)
+	assertString("HOS!tooshort8;3!Ea@bF", computed, t)
 }
 
 func TestSignUpAppPassword(t *testing.T) {
@@ -50,7 +50,7 @@ func TestSignUpAppPassword(t *testing.T) {
 		"password":        "test@example.com",
 		"passwordconfirm": "test@example.com",
 	}, SignUp)
-	assertString("HOS!b3!Etest@example.comF", computed, t)
+	assertString("HOS!contextexample.com;3!Etest@example.comF", computed, t)
 }
 
 func TestSignUpCompromisedPassword(t *testing.T) {
@@ -59,16 +59,16 @@ func TestSignUpCompromisedPassword(t *testing.T) {
 		"password":        "12345678",
 		"passwordconfirm": "12345678",
 	}, SignUp)
-	assertString("HOS!c3!Ea@bF", computed, t)
+	assertString("HOS!common;sequence;3!Ea@bF", computed, t)
 }
 
-func TestSignUpDictionaryPassword(t *testing.T) {
+func TestSignUpCommonPassword(t *testing.T) {
 	computed, _ := runRequest(nil, nil, map[string]string{
 		"email":           "a@b",
 		"password":        "aardvarks",
 		"passwordconfirm": "aardvarks",
 	}, SignUp)
-	assertString("HOS!d3!Ea@bF", computed, t)
+	assertString("HOS!common;3!Ea@bF", computed, t)
 }
 
 func TestSignUpRepetitivePassword(t *testing.T) {
@@ -77,7 +77,7 @@ func TestSignUpRepetitivePassword(t *testing.T) {
 		"password":        "öööööööö",
 		"passwordconfirm": "öööööööö",
 	}, SignUp)
-	assertString("HOS!e3!Ea@bF", computed, t)
+	assertString("HOS!repetitive;3!Ea@bF", computed, t)
 }
 
 func TestSignUpSequencePassword(t *testing.T) {
@@ -86,7 +86,7 @@ func TestSignUpSequencePassword(t *testing.T) {
 		"password":        "ertzuiop",
 		"passwordconfirm": "ertzuiop",
 	}, SignUp)
-	assertString("HOS!f3!Ea@bF", computed, t)
+	assertString("HOS!sequence;3!Ea@bF", computed, t)
 }
 
 func TestSignUpExistingAccount(t *testing.T) {
@@ -167,8 +167,26 @@ func TestVerify(t *testing.T) {
 	html, _ := runRequest(nil, map[string]string{
 		"id": "12345",
 	}, nil, Verify)
+	assertString("HOCV12345F", html, t)
+	if user.state != StateCreated {
+		t.Error("User was verified without confirmation")
+	}
+	html, _ = runRequest(nil, nil, map[string]string{
+		"id": "12345",
+	}, Verify)
 	assertString("HOVF", html, t)
 	if user.state != StateVerified {
 		t.Error("User was not verified")
 	}
 }
+
+func TestSignUpBreachedPassword(t *testing.T) {
+	Config.BreachedPasswords = &BreachedPasswords{File: "test/breachedpasswords.txt"}
+	computed, _ := runRequest(nil, nil, map[string]string{
+		"email":           "a@b",
+		"password":        "correcthorsebatterystaple",
+		"passwordconfirm": "correcthorsebatterystaple",
+	}, SignUp)
+	Config.BreachedPasswords = nil
+	assertString("HOS!breached;3!Ea@bF", computed, t)
+}
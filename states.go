@@ -0,0 +1,125 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// State describes a user state. States are registered in Config.States under
+// their numeric value (which is what User.GetState() returns). The states
+// StateCreated, StateVerified, StateExpired, and StateSuspended are registered
+// by default. Applications may add their own states, e.g. a "trial" state,
+// using values starting at StateCustom.
+type State struct {
+	// A short, readable name for the state, e.g. "verified". It is shown in the
+	// user administration and used in exported user files.
+	Name string
+
+	// Whether users in this state may log in.
+	LogIn bool
+
+	// Whether users in this state may use the application, i.e. pass
+	// RequireVerified().
+	Access bool
+
+	// The states into which users may move from this state (see ChangeState()).
+	// A nil slice allows all transitions. An empty slice allows none.
+	Transitions []int
+}
+
+// StateCustom is the lowest value for application-defined user states. Values
+// below it are reserved for this package.
+const StateCustom = 100
+
+// ChangeState moves the given user into the given state. The new state must be
+// registered in Config.States and must be reachable from the user's current
+// state (see State.Transitions). Before the state is changed,
+// Config.StateTransition is called. If it returns an error, the state is not
+// changed and that error is returned. The user is not saved.
+func ChangeState(user User, state int) error {
+	from := user.GetState()
+	if from == state {
+		return nil
+	}
+	if _, ok := Config.States[state]; !ok {
+		return fmt.Errorf("Unknown user state %d", state)
+	}
+	if current, ok := Config.States[from]; ok && current.Transitions != nil {
+		var allowed bool
+		for _, to := range current.Transitions {
+			if to == state {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("User state %q cannot change to %q", stateName(from), stateName(state))
+		}
+	}
+	if Config.StateTransition != nil {
+		if err := Config.StateTransition(user, from, state); err != nil {
+			return err
+		}
+	}
+	user.SetState(state)
+	return nil
+}
+
+// stateName returns a readable name for the given user state.
+func stateName(state int) string {
+	if registered, ok := Config.States[state]; ok {
+		return registered.Name
+	}
+	return "unknown"
+}
+
+// parseStateName is the inverse of stateName().
+func parseStateName(name string) (int, bool) {
+	for state, registered := range Config.States {
+		if registered.Name == name {
+			return state, true
+		}
+	}
+	return 0, false
+}
+
+// stateAllowsLogIn returns whether the given user's state is registered and
+// allows them to log in.
+func stateAllowsLogIn(user User) bool {
+	return Config.States[user.GetState()].LogIn
+}
+
+// stateAllowsAccess returns whether the given user's state is registered and
+// allows them to use the application.
+func stateAllowsAccess(user User) bool {
+	return Config.States[user.GetState()].Access
+}
+
+// checkLogInState checks whether the given user, who is about to be logged in,
+// is in a state which allows logging in. If not, an according page is rendered
+// and false is returned.
+func checkLogInState(response http.ResponseWriter, request *http.Request, user User) bool {
+	switch user.GetState() {
+	case StateCreated:
+		Config.Log.Printf(`Login attempted despite account not yet verified: %s (%s)`, user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "signup.gohtml", "verificationincomplete", map[string]string{}, nil)
+		return false
+	case StateSuspended:
+		return checkSuspension(response, request, user)
+	case StatePendingApproval:
+		Config.Log.Printf(`Login attempted while awaiting approval: %s (%s)`, user.GetID(), user.GetEmail())
+		RenderPage(response, request, "awaitingapproval.gohtml", map[string]interface{}{"config": Config})
+		return false
+	}
+	state, ok := Config.States[user.GetState()]
+	if !ok {
+		RenderProgramError(response, request, fmt.Sprintf("Unknown user state %d: %s (%s)", user.GetState(), user.GetID(), user.GetEmail()), "Invalid user state", nil)
+		return false
+	}
+	if !state.LogIn {
+		Config.Log.Printf(`Login attempted in state %q: %s (%s)`, state.Name, user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "login.gohtml", "statenologin", map[string]string{"state": state.Name}, nil)
+		return false
+	}
+	return true
+}
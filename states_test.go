@@ -0,0 +1,95 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	stateTrial   = StateCustom
+	statePending = StateCustom + 1
+)
+
+// registerTestStates adds custom states to Config.States and returns a
+// function which removes them again.
+func registerTestStates() func() {
+	Config.States[stateTrial] = State{Name: "trial", LogIn: true, Access: true, Transitions: []int{StateVerified, StateExpired}}
+	Config.States[statePending] = State{Name: "pending", Transitions: []int{stateTrial}}
+	return func() {
+		delete(Config.States, stateTrial)
+		delete(Config.States, statePending)
+		Config.StateTransition = nil
+	}
+}
+
+func TestChangeState(t *testing.T) {
+	defer registerTestStates()()
+	var transitions []string
+	Config.StateTransition = func(user User, from, to int) error {
+		if to == StateExpired {
+			return errors.New("Vetoed")
+		}
+		transitions = append(transitions, fmt.Sprintf("%s>%s", stateName(from), stateName(to)))
+		return nil
+	}
+
+	user := &MyUser{state: statePending}
+	if err := ChangeState(user, StateVerified); err == nil {
+		t.Error("Transition not in the list was allowed")
+	}
+	if err := ChangeState(user, stateTrial); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChangeState(user, StateExpired); err == nil || user.state != stateTrial {
+		t.Error("Vetoed transition was performed")
+	}
+	if err := ChangeState(user, StateVerified); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChangeState(user, 55); err == nil {
+		t.Error("Unknown state was allowed")
+	}
+	assertString("pending>trial;trial>verified", strings.Join(transitions, ";"), t)
+
+	// Names.
+	if state, ok := parseStateName("trial"); !ok || state != stateTrial {
+		t.Errorf("Wrong state for name: %d", state)
+	}
+	assertString("unknown", stateName(55), t)
+}
+
+func TestCustomStateLogIn(t *testing.T) {
+	defer registerTestStates()()
+	user := &MyUser{
+		email:        "u@x",
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+	}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	logIn := map[string]string{"email": "u@x", "password": "12345"}
+	protected := RequireVerified(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	})).ServeHTTP
+
+	user.state = statePending
+	computed, _ := runRequest(nil, nil, logIn, LogIn)
+	assertString("HOL!SNLpending!F", computed, t)
+	computed, _ = runRequest(user, nil, nil, protected)
+	assertString("redirect", computed, t)
+
+	user.state = stateTrial
+	computed, _ = runRequest(nil, nil, logIn, LogIn)
+	assertString("redirect", computed, t)
+	computed, _ = runRequest(user, nil, nil, protected)
+	assertString("OK", computed, t)
+
+	user.state = 55
+	computed, _ = runRequest(nil, nil, logIn, LogIn)
+	if computed == "redirect" {
+		t.Error("User with unknown state was logged in")
+	}
+}
@@ -0,0 +1,158 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// SuspensionUser is an optional extension of the User interface. Users
+// implementing it remember why they were suspended (see Suspend()), until
+// when, and their state before the suspension. Other users can still be
+// suspended but only indefinitely and without a reason, and they return to
+// StateVerified when they are reinstated.
+type SuspensionUser interface {
+	// The reason for the suspension (which is shown to the user) and the time
+	// at which it ends (the zero time for an indefinite suspension).
+	SetSuspension(reason string, until time.Time)
+	GetSuspension() (string, time.Time)
+
+	// The user's state before they were suspended, to which they return when
+	// they are reinstated.
+	SetStateBeforeSuspension(state int)
+	GetStateBeforeSuspension() int
+}
+
+// Suspend puts the given user into StateSuspended, logs them out of all
+// sessions, forgets their remembered devices, and notifies them by email (using
+// the "suspended.tmpl" mail template). Suspended users cannot log in. They
+// are shown the "suspended.gohtml" template instead. If "until" is not the
+// zero time, the suspension ends at that time, i.e. the user is reinstated the
+// next time they log in. The reason and end of the suspension are only stored
+// for users implementing the SuspensionUser interface.
+func Suspend(user User, reason string, until time.Time) error {
+	previous := user.GetState()
+	if err := ChangeState(user, StateSuspended); err != nil {
+		return err
+	}
+	if suspensionUser, ok := user.(SuspensionUser); ok {
+		suspensionUser.SetSuspension(reason, until)
+		if previous != StateSuspended {
+			suspensionUser.SetStateBeforeSuspension(previous)
+		}
+	}
+	forgetAllDevices(user)
+	if err := Config.UpdateUser(user); err != nil {
+		return err
+	}
+	if err := sessions.LogOut(user.GetID()); err != nil {
+		return err
+	}
+	Config.Log.Printf("User %s (%s) was suspended: %s", user.GetID(), user.GetEmail(), reason)
+
+	// Notify the user.
+	data := map[string]interface{}{
+		"email":  user.GetEmail(),
+		"reason": reason,
+		"config": Config,
+		"user":   user,
+	}
+	if !until.IsZero() {
+		data["until"] = until.Format("Monday, Jan 2, 2006, 15:04:05")
+	}
+	return SendMail(nil, user.GetEmail(), "suspended.tmpl", data)
+}
+
+// Reinstate ends the suspension of the given user, who must be in
+// StateSuspended (see Suspend()), putting them back into the state they were in
+// before (StateVerified for users not implementing the SuspensionUser
+// interface), and notifies them by email (using the "reinstated.tmpl" mail
+// template).
+func Reinstate(user User) error {
+	if user.GetState() != StateSuspended {
+		return errors.New("User is not suspended")
+	}
+	state := StateVerified
+	suspensionUser, ok := user.(SuspensionUser)
+	if ok {
+		previous := suspensionUser.GetStateBeforeSuspension()
+		if _, registered := Config.States[previous]; registered && previous != StateSuspended {
+			state = previous
+		}
+	}
+	if err := ChangeState(user, state); err != nil {
+		return err
+	}
+	if ok {
+		suspensionUser.SetSuspension("", time.Time{})
+	}
+	if err := saveAndRefreshUser(user); err != nil {
+		return err
+	}
+	Config.Log.Printf("User %s (%s) was reinstated", user.GetID(), user.GetEmail())
+
+	// Notify the user.
+	return SendMail(nil, user.GetEmail(), "reinstated.tmpl", map[string]interface{}{
+		"email":  user.GetEmail(),
+		"config": Config,
+		"user":   user,
+	})
+}
+
+// suspended returns whether the given user is suspended. Users whose
+// suspension has ended are reinstated here.
+func suspended(user User) (bool, error) {
+	if user.GetState() != StateSuspended {
+		return false, nil
+	}
+	suspensionUser, ok := user.(SuspensionUser)
+	if !ok {
+		return true, nil
+	}
+	_, until := suspensionUser.GetSuspension()
+	if until.IsZero() || until.After(time.Now()) {
+		return true, nil
+	}
+	if err := Reinstate(user); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// renderSuspended renders the "suspended.gohtml" template for the given
+// suspended user with a 403 Forbidden status. The template receives the
+// reason and the end of the suspension (if known) under the "infos" key.
+func renderSuspended(response http.ResponseWriter, request *http.Request, user User) {
+	infos := map[string]string{}
+	if suspensionUser, ok := user.(SuspensionUser); ok {
+		reason, until := suspensionUser.GetSuspension()
+		infos["reason"] = reason
+		if !until.IsZero() {
+			infos["until"] = until.Format("Monday, Jan 2, 2006, 15:04:05")
+		}
+	}
+	Config.Log.Printf("Login attempted by suspended user %s (%s)", user.GetID(), user.GetEmail())
+	data := map[string]interface{}{"config": Config, "infos": infos}
+	addCSRFToken(response, request, data) // Before any headers are written.
+	response.WriteHeader(http.StatusForbidden)
+	RenderPage(response, request, "suspended.gohtml", data)
+}
+
+// checkSuspension checks whether the given user, who is about to be logged in,
+// is suspended. If so, or if the check fails, an according page is rendered
+// and false is returned.
+func checkSuspension(response http.ResponseWriter, request *http.Request, user User) bool {
+	isSuspended, err := suspended(user)
+	if err != nil {
+		RenderProgramError(response, request, fmt.Sprintf("Could not reinstate user %s (%s)", user.GetID(), user.GetEmail()), "Could not update user", err)
+		return false
+	}
+	if isSuspended {
+		renderSuspended(response, request, user)
+		return false
+	}
+	return true
+}
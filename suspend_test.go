@@ -0,0 +1,107 @@
+package users
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuspend(t *testing.T) {
+	user := &MyUser{
+		id:           "u",
+		email:        "u@x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		devices:      []RememberedDevice{{ID: "d"}},
+	}
+	admin, restore := setUpAdmin([]*MyUser{user})
+	defer restore()
+	logIn := map[string]string{"email": "u@x", "password": "12345"}
+
+	// Suspend.
+	computed, _ := runRequest(admin, nil, map[string]string{"email": "u@x", "action": "suspend", "until": "tomorrow"}, Admin)
+	assertString("HIAUverified!IVD!F", computed, t)
+	computed, mail := runRequest(admin, nil, map[string]string{"email": "u@x", "action": "suspend", "reason": "Spam"}, Admin)
+	assertString("redirect", computed, t)
+	assertString("SUSSpam", strings.TrimSpace(mail), t)
+	if user.state != StateSuspended || user.suspension != "Spam" || !user.suspendedUntil.IsZero() {
+		t.Errorf("User was not suspended: %d %q %s", user.state, user.suspension, user.suspendedUntil)
+	}
+	if len(user.devices) != 0 {
+		t.Error("Remembered devices were not forgotten")
+	}
+	computed, _ = runRequest(admin, map[string]string{"email": "u@x"}, nil, Admin)
+	assertString("HIAUsuspendedF", computed, t)
+
+	// Suspended users cannot log in.
+	computed, _ = runRequest(nil, nil, logIn, LogIn)
+	assertString("HOSUSpamF", computed, t)
+	computed, _ = runRequest(user, nil, nil, RequireLogin(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {})).ServeHTTP)
+	assertString("redirect", computed, t)
+
+	// Reinstate.
+	computed, mail = runRequest(admin, nil, map[string]string{"email": "u@x", "action": "reinstate"}, Admin)
+	assertString("redirect", computed, t)
+	assertString("REI", strings.TrimSpace(mail), t)
+	if user.state != StateVerified || user.suspension != "" {
+		t.Errorf("User was not reinstated: %d %q", user.state, user.suspension)
+	}
+	computed, _ = runRequest(nil, nil, logIn, LogIn)
+	assertString("redirect", computed, t)
+
+	// Administrators cannot suspend themselves.
+	computed, _ = runRequest(admin, nil, map[string]string{"email": "admin@z", "action": "suspend"}, Admin)
+	assertString("HIAUverified!ASF!F", computed, t)
+}
+
+func TestSuspensionEnds(t *testing.T) {
+	user := &MyUser{
+		email:          "u@x",
+		state:          StateSuspended,
+		passwordHash:   []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		suspension:     "Spam",
+		suspendedUntil: time.Now().Add(time.Hour),
+		stateBefore:    StateVerified,
+	}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	logIn := map[string]string{"email": "u@x", "password": "12345"}
+	computed, _ := runRequest(nil, nil, logIn, LogIn)
+	assertString("HOSUSpamF", computed, t)
+
+	// After the suspension has ended, the user is reinstated.
+	user.suspendedUntil = time.Now().Add(-time.Hour)
+	computed, mail := runRequest(nil, nil, logIn, LogIn)
+	assertString("redirect", computed, t)
+	assertString("REI", strings.TrimSpace(mail), t)
+	if user.state != StateVerified {
+		t.Errorf("User was not reinstated, state is %d", user.state)
+	}
+}
+
+func TestReinstatePreviousState(t *testing.T) {
+	user := &MyUser{id: "u", email: "u@x", state: StateExpired}
+	_, restore := setUpAdmin([]*MyUser{user})
+	defer restore()
+
+	// Only suspended users can be reinstated.
+	if err := Reinstate(user); err == nil {
+		t.Error("Expired user was reinstated")
+	}
+
+	// Suspending twice keeps the original state.
+	if err := Suspend(user, "Spam", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Suspend(user, "Abuse", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reinstate(user); err != nil {
+		t.Fatal(err)
+	}
+	if user.state != StateExpired || user.suspension != "" {
+		t.Errorf("User was not returned to their previous state: %d %q", user.state, user.suspension)
+	}
+}
@@ -0,0 +1,431 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rivo/sessions"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters. These are the defaults of most authenticator apps.
+const (
+	totpPeriod        = 30 // The length of one time step, in seconds.
+	totpDigits        = 6  // The number of digits of a TOTP code.
+	totpSkew          = 1  // The number of time steps before and after the current one which are also accepted.
+	recoveryCodeCount = 10 // The number of recovery codes generated during enrollment.
+)
+
+// totpEncoding is the base32 encoding used for TOTP secrets.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPUser is an optional extension of the User interface. Users implementing
+// it may enable two-factor authentication using time-based one-time passwords
+// (TOTP, RFC 6238) as generated by common authenticator apps.
+type TOTPUser interface {
+	// The base32-encoded TOTP secret. An empty string means that two-factor
+	// authentication is disabled.
+	SetTOTPSecret(secret string)
+	GetTOTPSecret() string
+
+	// Hashes of the remaining one-time recovery codes which may be used
+	// instead of a TOTP code, e.g. when the user lost their device.
+	SetRecoveryCodes(hashes [][]byte)
+	GetRecoveryCodes() [][]byte
+
+	// The time step (the Unix time divided by 30 seconds) of the last TOTP code
+	// which was accepted. Codes of this or earlier time steps are rejected so
+	// that an observed code cannot be used again (RFC 6238, section 5.2).
+	SetTOTPLastStep(step int64)
+	GetTOTPLastStep() int64
+}
+
+// TOTPEnroll lets a logged-in user enable two-factor authentication. Upon a
+// GET request, a new TOTP secret is generated, stored in the session, and the
+// "totpenroll.gohtml" template is rendered with the secret and its provisioning
+// URI (to be shown as a QR code). Upon a POST request, the TOTP code entered by
+// the user is checked against the secret. If it is correct, two-factor
+// authentication is enabled and the "totpenabled.gohtml" template is rendered
+// with a list of one-time recovery codes. These are only shown once.
+//
+// The user must implement the TOTPUser interface.
+func TOTPEnroll(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	if blockImpersonation(response, request) {
+		return
+	}
+
+	// This page only works if the user is logged in.
+	user, session, _ := IsLoggedIn(response, request)
+	if user == nil {
+		RenderProgramError(response, request, "This page may only be accessed when you are logged in", "", nil)
+		return
+	}
+	totpUser, ok := user.(TOTPUser)
+	if !ok {
+		RenderProgramError(response, request, "User does not implement the TOTPUser interface", "Two-factor authentication is not available", nil)
+		return
+	}
+	if totpUser.GetTOTPSecret() != "" {
+		Config.Log.Printf("User %s (%s) visited TOTP enrollment but TOTP is already enabled", user.GetID(), user.GetEmail())
+		http.Redirect(response, request, Config.RouteChange, 302)
+		return
+	}
+
+	if request.Method == "GET" {
+		// Generate a new secret.
+		secret, err := newTOTPSecret()
+		if err != nil {
+			RenderProgramError(response, request, "Could not generate TOTP secret", "", err)
+			return
+		}
+		if err := session.Set(sessionKeyTOTPSecret, secret); err != nil {
+			RenderProgramError(response, request, "Could not save TOTP secret in session", "", err)
+			return
+		}
+		RenderPage(response, request, "totpenroll.gohtml", map[string]interface{}{
+			"config": Config,
+			"user":   user,
+			"infos":  map[string]string{"secret": secret, "uri": totpURI(secret, user.GetEmail())},
+		})
+		return
+	}
+
+	// Check the code against the secret in the session.
+	secret, _ := session.Get(sessionKeyTOTPSecret, "").(string)
+	if secret == "" {
+		Config.Log.Printf("User %s (%s) confirmed TOTP enrollment without secret", user.GetID(), user.GetEmail())
+		http.Redirect(response, request, Config.RouteTOTPEnroll, 302)
+		return
+	}
+	step, valid := validTOTP(secret, request.PostFormValue("code"), time.Now(), 0)
+	if !valid {
+		Config.Log.Printf("User %s (%s) entered wrong code during TOTP enrollment", user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "totpenroll.gohtml", "totpinvalid", map[string]string{"secret": secret, "uri": totpURI(secret, user.GetEmail())}, user)
+		return
+	}
+
+	// Enable two-factor authentication.
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		RenderProgramError(response, request, "Could not generate recovery codes", "", err)
+		return
+	}
+	totpUser.SetTOTPSecret(secret)
+	totpUser.SetRecoveryCodes(hashes)
+	totpUser.SetTOTPLastStep(step)
+	if err := Config.UpdateUser(user); err != nil {
+		RenderProgramError(response, request, "Could not save user with TOTP secret", "", err)
+		return
+	}
+	if err := sessions.RefreshUser(user); err != nil {
+		RenderProgramError(response, request, "Could not refresh user with TOTP secret", "", err)
+		return
+	}
+	if err := session.Delete(sessionKeyTOTPSecret); err != nil {
+		RenderProgramError(response, request, "Could not remove TOTP secret from session", "", err)
+		return
+	}
+	Config.Log.Printf("User %s (%s) enabled two-factor authentication", user.GetID(), user.GetEmail())
+
+	RenderPage(response, request, "totpenabled.gohtml", map[string]interface{}{"config": Config, "user": user, "codes": codes})
+}
+
+// TOTPChallenge is the page to which LogIn() redirects users who entered their
+// correct password but also need to provide a second factor. Until they do,
+// they are not logged in. Upon a GET request, the "totpchallenge.gohtml"
+// template is rendered. Upon a POST request, the entered code is checked. It
+// may be a TOTP code or one of the user's recovery codes (which are then
+// invalidated). If it is correct, the user is logged in.
+func TOTPChallenge(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	// Find out who is logging in.
+	session, err := sessions.Start(response, request, false)
+	if err != nil {
+		RenderProgramError(response, request, "Error starting session during second factor check", "Could not start user session", err)
+		return
+	}
+	var email string
+	if session != nil {
+		email, _ = session.Get(sessionKeySecondFactor, "").(string)
+	}
+	if email == "" {
+		Config.Log.Print("Second factor page visited without pending login")
+		http.Redirect(response, request, Config.RouteLogIn, 302)
+		return
+	}
+
+	if request.Method == "GET" {
+		RenderPageBasic(response, request, "totpchallenge.gohtml", nil)
+		return
+	}
+
+	// Throttle attempts.
+	if Config.ThrottleLogin != nil {
+		Config.ThrottleLogin(email)
+	}
+
+	// Load user.
+	user, err := Config.LoadUserByEmail(lookupEmail(email))
+	if err != nil {
+		RenderProgramError(response, request, "Could not load user for second factor check: "+email, "Could not load user", err)
+		return
+	}
+	totpUser, ok := user.(TOTPUser)
+	if user == nil || !ok || totpUser.GetTOTPSecret() == "" {
+		Config.Log.Printf("User for second factor check not found or TOTP not enabled: %s", email)
+		session.Delete(sessionKeySecondFactor)
+		http.Redirect(response, request, Config.RouteLogIn, 302)
+		return
+	}
+
+	// Check the code.
+	valid, err := useTOTPCode(user, request.PostFormValue("code"))
+	if err != nil {
+		RenderProgramError(response, request, "Could not save user after second factor check", "", err)
+		return
+	}
+	if !valid {
+		Config.Log.Printf("Wrong second factor entered for %s (%s)", user.GetID(), email)
+		RenderPageError(response, request, "totpchallenge.gohtml", "totpinvalid", nil, nil)
+		return
+	}
+
+	// The second factor was provided.
+	if err := session.Delete(sessionKeySecondFactor); err != nil {
+		RenderProgramError(response, request, "Could not remove pending second factor from session", "", err)
+		return
+	}
+	remember, err := takeRememberChoice(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not remove remember-me choice from session", "", err)
+		return
+	}
+	next, err := takeNext(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not remove next page from session", "", err)
+		return
+	}
+	proceedLogIn(response, request, user, remember, next)
+}
+
+// TOTPDisable lets a logged-in user disable two-factor authentication. Upon a
+// GET request, the "totpdisable.gohtml" template is rendered. Upon a POST
+// request, the user's current password ("currentpassword" field) or, for users
+// without a password, e.g. those who log in with magic links or passkeys, a
+// current TOTP code or recovery code ("code" field) is checked. If correct, the
+// TOTP secret and all recovery codes are removed. The "totpdisabled.gohtml"
+// template is then rendered.
+func TOTPDisable(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	if blockImpersonation(response, request) {
+		return
+	}
+
+	// This page only works if the user is logged in.
+	user, _, _ := IsLoggedIn(response, request)
+	if user == nil {
+		RenderProgramError(response, request, "This page may only be accessed when you are logged in", "", nil)
+		return
+	}
+	totpUser, ok := user.(TOTPUser)
+	if !ok {
+		RenderProgramError(response, request, "User does not implement the TOTPUser interface", "Two-factor authentication is not available", nil)
+		return
+	}
+
+	if request.Method == "GET" {
+		RenderPageBasic(response, request, "totpdisable.gohtml", user)
+		return
+	}
+
+	// Validate the current password or, for users without one, a second factor
+	// code.
+	currentPassword := request.PostFormValue("currentpassword")
+	if code := request.PostFormValue("code"); len(user.GetPasswordHash()) == 0 && code != "" {
+		valid, err := useTOTPCode(user, code)
+		if err != nil {
+			RenderProgramError(response, request, "Could not save user after second factor check", "", err)
+			return
+		}
+		if !valid {
+			Config.Log.Printf("User %s (%s) tried to disable TOTP, code wrong", user.GetID(), user.GetEmail())
+			RenderPageError(response, request, "totpdisable.gohtml", "totpinvalid", nil, user)
+			return
+		}
+	} else if currentPassword == "" {
+		Config.Log.Printf("User %s (%s) tried to disable TOTP, current password not provided", user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "totpdisable.gohtml", "currentpasswordnotprovided", nil, user)
+		return
+	} else if err := bcrypt.CompareHashAndPassword(user.GetPasswordHash(), []byte(currentPassword)); err != nil {
+		Config.Log.Printf("User %s (%s) tried to disable TOTP, current password wrong", user.GetID(), user.GetEmail())
+		RenderPageError(response, request, "totpdisable.gohtml", "currentpasswordwrong", nil, user)
+		return
+	}
+
+	// Disable two-factor authentication.
+	totpUser.SetTOTPSecret("")
+	totpUser.SetRecoveryCodes(nil)
+	if err := Config.UpdateUser(user); err != nil {
+		RenderProgramError(response, request, "Could not save user without TOTP secret", "", err)
+		return
+	}
+	if err := sessions.RefreshUser(user); err != nil {
+		RenderProgramError(response, request, "Could not refresh user without TOTP secret", "", err)
+		return
+	}
+	Config.Log.Printf("User %s (%s) disabled two-factor authentication", user.GetID(), user.GetEmail())
+
+	RenderPageBasic(response, request, "totpdisabled.gohtml", user)
+}
+
+// totpEnabled returns whether the given user has enabled two-factor
+// authentication.
+func totpEnabled(user User) bool {
+	totpUser, ok := user.(TOTPUser)
+	return ok && totpUser.GetTOTPSecret() != ""
+}
+
+// newTOTPSecret returns a new random, base32-encoded TOTP secret.
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpURI returns the provisioning URI for the given secret, as defined by
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func totpURI(secret, email string) string {
+	label := url.PathEscape(Config.TOTPIssuer + ":" + email)
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", Config.TOTPIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprintf("%d", totpDigits))
+	values.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// totpCode returns the TOTP code for the given raw secret and time step, as
+// defined in RFC 4226 and RFC 6238.
+func totpCode(secret []byte, step int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for index := 0; index < totpDigits; index++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// validTOTP returns whether the given code is a valid TOTP code for the
+// base32-encoded secret at the given time. Codes of time steps up to and
+// including lastStep are not accepted. If the code is valid, its time step is
+// returned.
+func validTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	step := now.Unix() / totpPeriod
+	for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+		if step+offset <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step+offset)), []byte(code)) == 1 {
+			return step + offset, true
+		}
+	}
+	return 0, false
+}
+
+// useTOTPCode checks the given TOTP code or recovery code of the given user,
+// who must implement the TOTPUser interface. A valid code is consumed: The
+// time step of a TOTP code is remembered so that it cannot be replayed, and a
+// recovery code is removed. The user is then saved.
+func useTOTPCode(user User, code string) (bool, error) {
+	totpUser := user.(TOTPUser)
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if step, valid := validTOTP(totpUser.GetTOTPSecret(), code, time.Now(), totpUser.GetTOTPLastStep()); valid {
+		totpUser.SetTOTPLastStep(step)
+		return true, Config.UpdateUser(user)
+	}
+
+	// Maybe it's a recovery code.
+	hashes := totpUser.GetRecoveryCodes()
+	index := recoveryCodeIndex(hashes, code)
+	if index < 0 {
+		return false, nil
+	}
+	totpUser.SetRecoveryCodes(append(append([][]byte{}, hashes[:index]...), hashes[index+1:]...))
+	if err := Config.UpdateUser(user); err != nil {
+		return false, err
+	}
+	Config.Log.Printf("User %s (%s) used a recovery code, %d remaining", user.GetID(), user.GetEmail(), len(hashes)-1)
+	return true, nil
+}
+
+// newRecoveryCodes generates a new set of recovery codes. The codes are
+// returned as well as their hashes.
+func newRecoveryCodes() (codes []string, hashes [][]byte, err error) {
+	for index := 0; index < recoveryCodeCount; index++ {
+		random := make([]byte, 10)
+		if _, err = rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(random))
+		code = code[:8] + "-" + code[8:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return
+}
+
+// hashRecoveryCode returns the hash of a recovery code. Recovery codes have
+// enough entropy that a fast hash function is sufficient.
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(strings.Replace(strings.ToLower(code), "-", "", -1)))
+	return hash[:]
+}
+
+// recoveryCodeIndex returns the index of the hash of the given recovery code
+// in the given list of hashes, or -1 if it is not in the list.
+func recoveryCodeIndex(hashes [][]byte, code string) int {
+	if code == "" {
+		return -1
+	}
+	hash := hashRecoveryCode(code)
+	for index, h := range hashes {
+		if subtle.ConstantTimeCompare(h, hash) == 1 {
+			return index
+		}
+	}
+	return -1
+}
@@ -0,0 +1,234 @@
+package users
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The secret from RFC 6238, Appendix B, base32-encoded.
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, Appendix B (last six digits).
+	for timestamp, expected := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		assertString(expected, totpCode([]byte("12345678901234567890"), timestamp/totpPeriod), t)
+	}
+}
+
+func TestValidTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step, valid := validTOTP(testTOTPSecret, "050471", now, 0)
+	if !valid || step != 1111111111/totpPeriod {
+		t.Errorf("Current code was rejected or has wrong step %d", step)
+	}
+	if _, valid := validTOTP(testTOTPSecret, "050471", now.Add(totpPeriod*time.Second), 0); !valid {
+		t.Error("Previous code was rejected")
+	}
+	if _, valid := validTOTP(testTOTPSecret, "050471", now.Add(5*totpPeriod*time.Second), 0); valid {
+		t.Error("Old code was accepted")
+	}
+	if _, valid := validTOTP(testTOTPSecret, "050471", now, step); valid {
+		t.Error("Used code was accepted")
+	}
+	_, valid1 := validTOTP(testTOTPSecret, "", now, 0)
+	_, valid2 := validTOTP(testTOTPSecret, "05047", now, 0)
+	if valid1 || valid2 {
+		t.Error("Invalid code was accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+	if index := recoveryCodeIndex(hashes, codes[3]); index != 3 {
+		t.Errorf("Expected recovery code at index 3, got %d", index)
+	}
+	if index := recoveryCodeIndex(hashes, "abcdefgh-ijklmnop"); index != -1 {
+		t.Errorf("Unknown recovery code was found at index %d", index)
+	}
+}
+
+func TestTOTPEnrollPage(t *testing.T) {
+	computed, _ := runRequest(&MyUser{email: "x", state: StateVerified}, nil, nil, TOTPEnroll)
+	assertString("HITESF", computed, t)
+}
+
+func TestTOTPEnrollWrongCode(t *testing.T) {
+	computed, _ := runSessionRequest(&MyUser{email: "x", state: StateVerified}, map[string]interface{}{
+		sessionKeyTOTPSecret: testTOTPSecret,
+	}, nil, map[string]string{"code": "000000"}, TOTPEnroll)
+	assertString("HITE!TI!SF", computed, t)
+}
+
+func TestTOTPEnroll(t *testing.T) {
+	user := &MyUser{email: "x", state: StateVerified}
+	computed, _ := runSessionRequest(user, map[string]interface{}{
+		sessionKeyTOTPSecret: testTOTPSecret,
+	}, nil, map[string]string{"code": totpCode([]byte("12345678901234567890"), time.Now().Unix()/totpPeriod)}, TOTPEnroll)
+	assertString("HITN10F", computed, t)
+	assertString(testTOTPSecret, user.totpSecret, t)
+	if len(user.recoveryCodes) != recoveryCodeCount {
+		t.Error("Recovery codes were not saved")
+	}
+}
+
+func TestLogInTOTP(t *testing.T) {
+	var event string
+	user := &MyUser{
+		email:        "X",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		totpSecret:   testTOTPSecret,
+	}
+	Config.LoadUserByEmail = func(id string) (User, error) {
+		return user, nil
+	}
+	Config.LoggedIn = func(user User, ipAddress string) {
+		event = "logged in"
+	}
+	defer func() { Config.LoggedIn = nil }()
+	computed, _ := runRequest(nil, nil, map[string]string{
+		"email":    "@",
+		"password": "12345",
+	}, LogIn)
+	assertString("redirect", computed, t)
+	assertString("", event, t)
+}
+
+func TestTOTPChallengePending(t *testing.T) {
+	// A pending second factor is not a login.
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeySecondFactor: "a@b"}, nil, nil, func(response http.ResponseWriter, request *http.Request) {
+		if user, _, _ := IsLoggedIn(response, request); user != nil {
+			t.Error("User is logged in with pending second factor")
+		}
+		TOTPChallenge(response, request)
+	})
+	assertString("HOTCF", computed, t)
+}
+
+func TestTOTPChallengeWrongCode(t *testing.T) {
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return &MyUser{email: email, state: StateVerified, totpSecret: testTOTPSecret}, nil
+	}
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeySecondFactor: "a@b"}, nil, map[string]string{"code": "000000"}, TOTPChallenge)
+	assertString("HOTC!TI!F", computed, t)
+}
+
+func TestTOTPChallenge(t *testing.T) {
+	var event string
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return &MyUser{email: email, state: StateVerified, totpSecret: testTOTPSecret}, nil
+	}
+	Config.LoggedIn = func(user User, ipAddress string) {
+		event = "logged in"
+	}
+	defer func() { Config.LoggedIn = nil }()
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeySecondFactor: "a@b"}, nil, map[string]string{
+		"code": totpCode([]byte("12345678901234567890"), time.Now().Unix()/totpPeriod),
+	}, TOTPChallenge)
+	assertString("redirect", computed, t)
+	assertString("logged in", event, t)
+}
+
+func TestTOTPChallengeRecoveryCode(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &MyUser{email: "a@b", state: StateVerified, totpSecret: testTOTPSecret, recoveryCodes: hashes}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeySecondFactor: "a@b"}, nil, map[string]string{"code": codes[0]}, TOTPChallenge)
+	assertString("redirect", computed, t)
+	if len(user.recoveryCodes) != recoveryCodeCount-1 {
+		t.Error("Recovery code was not invalidated")
+	}
+}
+
+func TestTOTPDisableWrongPassword(t *testing.T) {
+	computed, _ := runRequest(&MyUser{
+		email:        "x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		totpSecret:   testTOTPSecret,
+	}, nil, map[string]string{"currentpassword": "54321"}, TOTPDisable)
+	assertString("HITD!WCP!F", computed, t)
+}
+
+func TestTOTPDisable(t *testing.T) {
+	user := &MyUser{
+		email:         "x",
+		state:         StateVerified,
+		passwordHash:  []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		totpSecret:    testTOTPSecret,
+		recoveryCodes: [][]byte{[]byte("x")},
+	}
+	computed, _ := runRequest(user, nil, map[string]string{"currentpassword": "12345"}, TOTPDisable)
+	assertString("HITDDF", computed, t)
+	if user.totpSecret != "" || user.recoveryCodes != nil {
+		t.Error("Two-factor authentication was not disabled")
+	}
+}
+
+func TestTOTPChallengeReplay(t *testing.T) {
+	user := &MyUser{email: "a@b", state: StateVerified, totpSecret: testTOTPSecret}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	step := time.Now().Unix() / totpPeriod
+	code := totpCode([]byte("12345678901234567890"), step)
+	computed, _ := runSessionRequest(nil, map[string]interface{}{sessionKeySecondFactor: "a@b"}, nil, map[string]string{"code": code}, TOTPChallenge)
+	assertString("redirect", computed, t)
+	if user.totpLastStep != step {
+		t.Errorf("Unexpected last step %d", user.totpLastStep)
+	}
+	computed, _ = runSessionRequest(nil, map[string]interface{}{sessionKeySecondFactor: "a@b"}, nil, map[string]string{"code": code}, TOTPChallenge)
+	assertString("HOTC!TI!F", computed, t)
+}
+
+func TestTOTPDisableCode(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &MyUser{email: "x", state: StateVerified, totpSecret: testTOTPSecret, recoveryCodes: hashes}
+	computed, _ := runRequest(user, nil, map[string]string{"code": "abcdefgh-ijklmnop"}, TOTPDisable)
+	assertString("HITD!TI!F", computed, t)
+	computed, _ = runRequest(user, nil, map[string]string{"code": codes[0]}, TOTPDisable)
+	assertString("HITDDF", computed, t)
+	if user.totpSecret != "" {
+		t.Error("Two-factor authentication was not disabled")
+	}
+
+	user = &MyUser{email: "x", state: StateVerified, totpSecret: testTOTPSecret}
+	computed, _ = runRequest(user, nil, map[string]string{"code": totpCode([]byte("12345678901234567890"), time.Now().Unix()/totpPeriod)}, TOTPDisable)
+	assertString("HITDDF", computed, t)
+
+	// Users with a password must provide it.
+	user = &MyUser{
+		email:         "x",
+		state:         StateVerified,
+		passwordHash:  []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		totpSecret:    testTOTPSecret,
+		recoveryCodes: hashes,
+	}
+	computed, _ = runRequest(user, nil, map[string]string{"code": codes[1]}, TOTPDisable)
+	assertString("HITD!NCP!F", computed, t)
+	if user.totpSecret == "" {
+		t.Error("Two-factor authentication was disabled without the password")
+	}
+}
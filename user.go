@@ -8,9 +8,11 @@ import (
 
 // The states a user account is in at any given time.
 const (
-	StateCreated  = iota // User account has been created but not yet verified.
-	StateVerified        // User account has been verified and can be used.
-	StateExpired         // User account has expired. User can log in but don't have access to functionality anymore.
+	StateCreated         = iota // User account has been created but not yet verified.
+	StateVerified               // User account has been verified and can be used.
+	StateExpired                // User account has expired. User can log in but don't have access to functionality anymore.
+	StateSuspended              // User account has been suspended by an administrator. User cannot log in.
+	StatePendingApproval        // User account has been verified but must be approved by an administrator (see Config.SignUpApproval).
 )
 
 // User represents one user account. This is an extension of the sessions.User
@@ -24,13 +26,14 @@ type User interface {
 	// We need to be able to copy user IDs.
 	SetID(id interface{})
 
-	// At any time, a user is in exactly one state: StateCreated, StateVerified,
-	// or StateExpired.
+	// At any time, a user is in exactly one of the states registered in
+	// Config.States, e.g. StateCreated, StateVerified, or StateExpired.
 	SetState(state int)
 	GetState() int
 
-	// The users email address. This package will always change email addresses to
-	// lowercase before setting or comparing them.
+	// The user's email address. This package sets it in the form returned by
+	// NormalizeEmail(), i.e. as entered, and compares addresses by their
+	// canonical form (see CanonicalEmail()).
 	SetEmail(email string)
 	GetEmail() string
 
@@ -49,3 +52,21 @@ type User interface {
 	SetPasswordToken(id string, created time.Time)
 	GetPasswordToken() (string, time.Time)
 }
+
+// PasswordChangeUser is an optional extension of the User interface. Users
+// implementing it can be flagged to change their password, e.g. because their
+// password was found in a corpus of breached passwords (see
+// Config.BreachedPasswords). The flag is cleared when the user chooses a new
+// password.
+type PasswordChangeUser interface {
+	SetPasswordChangeRequired(required bool)
+	GetPasswordChangeRequired() bool
+}
+
+// PasswordAgeUser is an optional extension of the User interface. Users
+// implementing it remember when their password was last changed, allowing
+// passwords to expire (see Config.PasswordMaxAge).
+type PasswordAgeUser interface {
+	SetPasswordChanged(changed time.Time)
+	GetPasswordChanged() time.Time
+}
@@ -14,6 +14,12 @@ var (
 	usersMutex sync.RWMutex
 )
 
+// The pending invitations in our system (see Invite()).
+var (
+	invitations      = make(map[string]*Invitation) // Maps tokens to invitations.
+	invitationsMutex sync.RWMutex
+)
+
 // Variables that help pausing access to some functions.
 var (
 	userMutexes      = make(map[string]*sync.Mutex) // Maps user email addresses to mutexes.
@@ -43,6 +49,15 @@ func init() {
 	}
 }
 
+// saveAndRefreshUser saves a changed user and refreshes the cached user object
+// in their sessions.
+func saveAndRefreshUser(user User) error {
+	if err := Config.UpdateUser(user); err != nil {
+		return err
+	}
+	return sessions.RefreshUser(user)
+}
+
 // Main makes your life simple by starting an HTTP server for you with the
 // routes found in the Config variable. If you use this, for all remaining
 // pages of your application, you only need to add your own handlers to the
@@ -58,6 +73,22 @@ func Main() error {
 	http.HandleFunc(Config.RouteForgottenPassword, ForgottenPassword)
 	http.HandleFunc(Config.RouteResetPassword, ResetPassword)
 	http.HandleFunc(Config.RouteChange, Change)
+	http.HandleFunc(Config.RoutePasswordChange, ChangePassword)
+	http.HandleFunc(Config.RouteTOTPEnroll, TOTPEnroll)
+	http.HandleFunc(Config.RouteTOTPChallenge, TOTPChallenge)
+	http.HandleFunc(Config.RouteTOTPDisable, TOTPDisable)
+	http.HandleFunc(Config.RouteWebAuthnRegister, WebAuthnRegister)
+	http.HandleFunc(Config.RouteWebAuthnLogIn, WebAuthnLogIn)
+	http.HandleFunc(Config.RouteRememberedDevices, RememberedDevices)
+	http.HandleFunc(Config.RouteMagicLink, MagicLink)
+	http.HandleFunc(Config.RouteMagicLogIn, MagicLogIn)
+	http.HandleFunc(Config.RouteAdmin, Admin)
+	http.HandleFunc(Config.RouteStopImpersonation, StopImpersonation)
+	http.HandleFunc(Config.RouteDeleteAccount, DeleteAccount)
+	http.HandleFunc(Config.RouteCancelDeletion, CancelDeletion)
+	http.HandleFunc(Config.RouteExportAccount, ExportAccount)
+	http.HandleFunc(Config.RouteInvite, Invite)
+	http.HandleFunc(Config.RouteAcceptInvitation, AcceptInvitation)
 
 	return http.ListenAndServe(Config.ServerAddr, nil)
 }
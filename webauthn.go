@@ -0,0 +1,869 @@
+package users
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rivo/sessions"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Flags found in WebAuthn authenticator data.
+const (
+	webAuthnFlagUserPresent  = 0x01 // The user was present (e.g. touched the authenticator).
+	webAuthnFlagUserVerified = 0x04 // The user was verified (e.g. by PIN or biometrics).
+	webAuthnFlagAttested     = 0x40 // Attested credential data is included.
+)
+
+// COSE algorithm identifiers of the supported WebAuthn public keys.
+const (
+	coseAlgES256 = -7   // ECDSA with P-256 and SHA-256.
+	coseAlgEdDSA = -8   // Ed25519.
+	coseAlgRS256 = -257 // RSASSA-PKCS1-v1_5 with SHA-256.
+)
+
+// webAuthnTimeout is the time, in milliseconds, browsers give users to
+// interact with their authenticator.
+const webAuthnTimeout = 5 * 60 * 1000
+
+// WebAuthnCredential is a public key credential ("passkey") registered by a
+// user with the Web Authentication API (https://www.w3.org/TR/webauthn-2/).
+type WebAuthnCredential struct {
+	// The credential ID generated by the authenticator.
+	ID []byte
+
+	// The credential's public key, in COSE_Key format.
+	PublicKey []byte
+
+	// The last signature counter reported by the authenticator. It is used to
+	// detect cloned authenticators.
+	SignCount uint32
+
+	// The AAGUID identifying the authenticator model. All zeros if the
+	// authenticator did not provide it.
+	AAGUID []byte
+
+	// The attestation statement format provided during registration, e.g.
+	// "none" or "packed".
+	Format string
+
+	// A name chosen by the user to tell their credentials apart.
+	Name string
+
+	// The time the credential was registered and last used to log in.
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// EncodedID returns the credential ID, base64url-encoded without padding, as
+// it is used in WebAuthn's JSON structures and in the forms of this package.
+func (c WebAuthnCredential) EncodedID() string {
+	return base64.RawURLEncoding.EncodeToString(c.ID)
+}
+
+// WebAuthnUser is an optional extension of the User interface. Users
+// implementing it may register WebAuthn credentials ("passkeys") and use them
+// to log in, either as a second factor or, if Config.WebAuthnPasswordless is
+// true, instead of their password.
+type WebAuthnUser interface {
+	SetWebAuthnCredentials(credentials []WebAuthnCredential)
+	GetWebAuthnCredentials() []WebAuthnCredential
+}
+
+// WebAuthnRegister lets a logged-in user manage their WebAuthn credentials.
+// Upon a GET request, a new challenge is stored in the session and the
+// "webauthnregister.gohtml" template is rendered with the user's credentials
+// and the options to be passed to navigator.credentials.create() (a JSON
+// string). The page then posts the resulting credential (JSON-encoded, all
+// binary values base64url-encoded) in the "credential" field, along with a
+// "name" for it. If the credential is valid, it is added to the user and the
+// "webauthnregistered.gohtml" template is rendered.
+//
+// A credential may be removed by posting its base64url-encoded ID in the
+// "remove" field. The removal must be confirmed with the user's current
+// password in the "currentpassword" field or, for users without a password, a
+// TOTP or recovery code in the "code" field or an assertion of one of their
+// passkeys (for the challenge of the page) in the "assertion" field. The user
+// is then redirected to Config.RouteWebAuthnRegister.
+//
+// The user must implement the WebAuthnUser interface.
+func WebAuthnRegister(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+	if blockImpersonation(response, request) {
+		return
+	}
+
+	// This page only works if the user is logged in.
+	user, session, _ := IsLoggedIn(response, request)
+	if user == nil {
+		RenderProgramError(response, request, "This page may only be accessed when you are logged in", "", nil)
+		return
+	}
+	webAuthnUser, ok := user.(WebAuthnUser)
+	if !ok {
+		RenderProgramError(response, request, "User does not implement the WebAuthnUser interface", "Passkeys are not available", nil)
+		return
+	}
+
+	if request.Method == "GET" {
+		renderWebAuthnRegister(response, request, session, user, "")
+		return
+	}
+
+	// Remove a credential.
+	if remove := request.PostFormValue("remove"); remove != "" {
+		errorName, err := confirmWebAuthnRemoval(request, session, user)
+		if err != nil {
+			RenderProgramError(response, request, "Could not confirm passkey removal", "", err)
+			return
+		}
+		if errorName != "" {
+			Config.Log.Printf("User %s (%s) tried to remove a passkey, confirmation failed (%s)", user.GetID(), user.GetEmail(), errorName)
+			renderWebAuthnRegister(response, request, session, user, errorName)
+			return
+		}
+		var credentials []WebAuthnCredential
+		for _, credential := range webAuthnUser.GetWebAuthnCredentials() {
+			if credential.EncodedID() != remove {
+				credentials = append(credentials, credential)
+			}
+		}
+		webAuthnUser.SetWebAuthnCredentials(credentials)
+		if err := Config.UpdateUser(user); err != nil {
+			RenderProgramError(response, request, "Could not save user after removing passkey", "", err)
+			return
+		}
+		if err := sessions.RefreshUser(user); err != nil {
+			RenderProgramError(response, request, "Could not refresh user after removing passkey", "", err)
+			return
+		}
+		Config.Log.Printf("User %s (%s) removed passkey %s", user.GetID(), user.GetEmail(), remove)
+		http.Redirect(response, request, Config.RouteWebAuthnRegister, 302)
+		return
+	}
+
+	// Verify the new credential.
+	challenge, err := takeWebAuthnChallenge(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not remove WebAuthn challenge from session", "", err)
+		return
+	}
+	credential, err := verifyWebAuthnRegistration(request.PostFormValue("credential"), challenge)
+	if err != nil {
+		Config.Log.Printf("User %s (%s) failed to register a passkey: %s", user.GetID(), user.GetEmail(), err)
+		renderWebAuthnRegister(response, request, session, user, "webauthninvalid")
+		return
+	}
+	existingUser, err := Config.LoadUserByWebAuthnCredential(credential.ID)
+	if err != nil {
+		RenderProgramError(response, request, "Could not check for existing passkey", "", err)
+		return
+	}
+	if existingUser != nil {
+		Config.Log.Printf("User %s (%s) tried to register passkey %s which is already registered to %s", user.GetID(), user.GetEmail(), credential.EncodedID(), existingUser.GetID())
+		renderWebAuthnRegister(response, request, session, user, "webauthninvalid")
+		return
+	}
+
+	// Add it to the user.
+	credential.Name = strings.TrimSpace(request.PostFormValue("name"))
+	if credential.Name == "" {
+		credential.Name = "Passkey"
+	}
+	credential.Created = time.Now()
+	webAuthnUser.SetWebAuthnCredentials(append(webAuthnUser.GetWebAuthnCredentials(), *credential))
+	if err := Config.UpdateUser(user); err != nil {
+		RenderProgramError(response, request, "Could not save user with new passkey", "", err)
+		return
+	}
+	if err := sessions.RefreshUser(user); err != nil {
+		RenderProgramError(response, request, "Could not refresh user with new passkey", "", err)
+		return
+	}
+	Config.Log.Printf("User %s (%s) registered passkey %s (format %s)", user.GetID(), user.GetEmail(), credential.EncodedID(), credential.Format)
+
+	RenderPageBasic(response, request, "webauthnregistered.gohtml", user)
+}
+
+// WebAuthnLogIn lets users log in with a WebAuthn credential. LogIn()
+// redirects users here who entered their correct password, registered
+// WebAuthn credentials, and did not enable TOTP. In this case, the credential
+// serves as the second factor. If Config.WebAuthnPasswordless is true, users
+// may also come here directly and log in with a credential only. Such
+// credentials must verify the user (e.g. by PIN or biometrics).
+//
+// Upon a GET request, a new challenge is stored in the session and the
+// "webauthnlogin.gohtml" template is rendered with the options to be passed to
+// navigator.credentials.get() (a JSON string). The page then posts the
+// resulting assertion (JSON-encoded, all binary values base64url-encoded) in
+// the "credential" field. If it is valid, the user is logged in.
+func WebAuthnLogIn(response http.ResponseWriter, request *http.Request) {
+	if !checkCSRF(response, request) {
+		return
+	}
+
+	// Find out who is logging in.
+	session, err := sessions.Start(response, request, Config.WebAuthnPasswordless)
+	if err != nil {
+		RenderProgramError(response, request, "Error starting session during passkey login", "Could not start user session", err)
+		return
+	}
+	var email string
+	if session != nil {
+		email, _ = session.Get(sessionKeySecondFactor, "").(string)
+	}
+	if email == "" && !Config.WebAuthnPasswordless {
+		Config.Log.Print("Passkey login page visited without pending login")
+		http.Redirect(response, request, Config.RouteLogIn, 302)
+		return
+	}
+	var user User
+	if email != "" {
+		user, err = Config.LoadUserByEmail(lookupEmail(email))
+		if err != nil {
+			RenderProgramError(response, request, "Could not load user for passkey login: "+email, "Could not load user", err)
+			return
+		}
+		if user == nil || !webAuthnEnabled(user) {
+			Config.Log.Printf("User for passkey login not found or without passkeys: %s", email)
+			session.Delete(sessionKeySecondFactor)
+			http.Redirect(response, request, Config.RouteLogIn, 302)
+			return
+		}
+	}
+
+	if request.Method == "GET" {
+		renderWebAuthnLogIn(response, request, session, user, "")
+		return
+	}
+
+	// Throttle attempts.
+	if email != "" && Config.ThrottleLogin != nil {
+		Config.ThrottleLogin(email)
+	}
+
+	// Parse the assertion.
+	challenge, err := takeWebAuthnChallenge(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not remove WebAuthn challenge from session", "", err)
+		return
+	}
+	var assertion webAuthnResponse
+	if err := json.Unmarshal([]byte(request.PostFormValue("credential")), &assertion); err != nil {
+		Config.Log.Printf("Invalid passkey assertion received: %s", err)
+		renderWebAuthnLogIn(response, request, session, user, "webauthninvalid")
+		return
+	}
+
+	// Without a pending login, the credential determines the user.
+	pendingUser := user
+	if user == nil {
+		user, err = Config.LoadUserByWebAuthnCredential(assertion.RawID)
+		if err != nil {
+			RenderProgramError(response, request, "Could not load user for passkey login", "Could not load user", err)
+			return
+		}
+		if user == nil {
+			Config.Log.Printf("Unknown passkey used for login: %s", base64.RawURLEncoding.EncodeToString(assertion.RawID))
+			renderWebAuthnLogIn(response, request, session, nil, "webauthninvalid")
+			return
+		}
+		if !checkLogInState(response, request, user) {
+			return
+		}
+	}
+
+	// Verify the assertion.
+	webAuthnUser, ok := user.(WebAuthnUser)
+	if !ok {
+		RenderProgramError(response, request, "User does not implement the WebAuthnUser interface", "Passkeys are not available", nil)
+		return
+	}
+	credentials := webAuthnUser.GetWebAuthnCredentials()
+	index := -1
+	for i, credential := range credentials {
+		if bytes.Equal(credential.ID, assertion.RawID) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		Config.Log.Printf("Passkey not registered to user %s (%s): %s", user.GetID(), user.GetEmail(), base64.RawURLEncoding.EncodeToString(assertion.RawID))
+		renderWebAuthnLogIn(response, request, session, pendingUser, "webauthninvalid")
+		return
+	}
+	signCount, err := verifyWebAuthnAssertion(&assertion, challenge, &credentials[index], email == "")
+	if err != nil {
+		Config.Log.Printf("Passkey login failed for %s (%s): %s", user.GetID(), user.GetEmail(), err)
+		renderWebAuthnLogIn(response, request, session, pendingUser, "webauthninvalid")
+		return
+	}
+	credentials[index].SignCount = signCount
+	credentials[index].LastUsed = time.Now()
+	webAuthnUser.SetWebAuthnCredentials(credentials)
+	if err := Config.UpdateUser(user); err != nil {
+		RenderProgramError(response, request, "Could not save user after passkey login", "", err)
+		return
+	}
+
+	// The user was authenticated.
+	if email != "" {
+		if err := session.Delete(sessionKeySecondFactor); err != nil {
+			RenderProgramError(response, request, "Could not remove pending second factor from session", "", err)
+			return
+		}
+	}
+	remember, err := takeRememberChoice(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not remove remember-me choice from session", "", err)
+		return
+	}
+	next, err := takeNext(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not remove next page from session", "", err)
+		return
+	}
+	Config.Log.Printf("User %s (%s) authenticated with passkey %s", user.GetID(), user.GetEmail(), credentials[index].EncodedID())
+	proceedLogIn(response, request, user, remember, next)
+}
+
+// confirmWebAuthnRemoval checks the confirmation posted along with the removal
+// of a passkey: the user's current password ("currentpassword" field) or, for
+// users without a password, a TOTP or recovery code ("code" field) or an
+// assertion of one of the user's passkeys for the challenge stored in the
+// session ("assertion" field). If the confirmation is missing or wrong, the
+// name of the error template is returned.
+func confirmWebAuthnRemoval(request *http.Request, session *sessions.Session, user User) (string, error) {
+	if currentPassword := request.PostFormValue("currentpassword"); currentPassword != "" {
+		if err := bcrypt.CompareHashAndPassword(user.GetPasswordHash(), []byte(currentPassword)); err != nil {
+			return "currentpasswordwrong", nil
+		}
+		return "", nil
+	}
+	if len(user.GetPasswordHash()) > 0 {
+		return "currentpasswordnotprovided", nil
+	}
+
+	// A second factor code.
+	if code := request.PostFormValue("code"); code != "" && totpEnabled(user) {
+		valid, err := useTOTPCode(user, code)
+		if err != nil || !valid {
+			return "totpinvalid", err
+		}
+		return "", nil
+	}
+
+	// A passkey assertion.
+	if credential := request.PostFormValue("assertion"); credential != "" {
+		challenge, err := takeWebAuthnChallenge(session)
+		if err != nil {
+			return "", err
+		}
+		var assertion webAuthnResponse
+		if err := json.Unmarshal([]byte(credential), &assertion); err != nil {
+			return "webauthninvalid", nil
+		}
+		webAuthnUser := user.(WebAuthnUser)
+		credentials := webAuthnUser.GetWebAuthnCredentials()
+		for index := range credentials {
+			if !bytes.Equal(credentials[index].ID, assertion.RawID) {
+				continue
+			}
+			signCount, err := verifyWebAuthnAssertion(&assertion, challenge, &credentials[index], false)
+			if err != nil {
+				return "webauthninvalid", nil
+			}
+			credentials[index].SignCount = signCount
+			credentials[index].LastUsed = time.Now()
+			webAuthnUser.SetWebAuthnCredentials(credentials)
+			return "", nil
+		}
+		return "webauthninvalid", nil
+	}
+
+	return "currentpasswordnotprovided", nil
+}
+
+// renderWebAuthnRegister renders the "webauthnregister.gohtml" template with
+// a new challenge. If errorName is not empty, the page is rendered with the
+// corresponding error message.
+func renderWebAuthnRegister(response http.ResponseWriter, request *http.Request, session *sessions.Session, user User, errorName string) {
+	challenge, err := newWebAuthnChallenge(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not create WebAuthn challenge", "", err)
+		return
+	}
+	credentials := user.(WebAuthnUser).GetWebAuthnCredentials()
+	exclude := make([]map[string]interface{}, 0, len(credentials))
+	for _, credential := range credentials {
+		exclude = append(exclude, map[string]interface{}{"type": "public-key", "id": base64URLBytes(credential.ID)})
+	}
+	residentKey := "preferred"
+	if Config.WebAuthnPasswordless {
+		residentKey = "required"
+	}
+	options, err := json.Marshal(map[string]interface{}{
+		"challenge": challenge,
+		"rp": map[string]interface{}{
+			"id":   Config.WebAuthnRPID,
+			"name": Config.WebAuthnRPName,
+		},
+		"user": map[string]interface{}{
+			"id":          base64URLBytes(fmt.Sprint(user.GetID())),
+			"name":        user.GetEmail(),
+			"displayName": user.GetEmail(),
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgEdDSA},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"timeout":            webAuthnTimeout,
+		"attestation":        Config.WebAuthnAttestation,
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]interface{}{
+			"residentKey":        residentKey,
+			"requireResidentKey": Config.WebAuthnPasswordless,
+			"userVerification":   Config.WebAuthnUserVerification,
+		},
+	})
+	if err != nil {
+		RenderProgramError(response, request, "Could not encode WebAuthn options", "", err)
+		return
+	}
+
+	infos := map[string]interface{}{"options": string(options), "credentials": credentials, "totp": totpEnabled(user)}
+	if errorName != "" {
+		RenderPageError(response, request, "webauthnregister.gohtml", errorName, infos, user)
+		return
+	}
+	RenderPage(response, request, "webauthnregister.gohtml", map[string]interface{}{"config": Config, "user": user, "infos": infos})
+}
+
+// renderWebAuthnLogIn renders the "webauthnlogin.gohtml" template with a new
+// challenge. If a user is provided, only their credentials are allowed. If
+// errorName is not empty, the page is rendered with the corresponding error
+// message.
+func renderWebAuthnLogIn(response http.ResponseWriter, request *http.Request, session *sessions.Session, user User, errorName string) {
+	challenge, err := newWebAuthnChallenge(session)
+	if err != nil {
+		RenderProgramError(response, request, "Could not create WebAuthn challenge", "", err)
+		return
+	}
+	allow := []map[string]interface{}{}
+	userVerification := "required"
+	if user != nil {
+		for _, credential := range user.(WebAuthnUser).GetWebAuthnCredentials() {
+			allow = append(allow, map[string]interface{}{"type": "public-key", "id": base64URLBytes(credential.ID)})
+		}
+		userVerification = Config.WebAuthnUserVerification
+	}
+	options, err := json.Marshal(map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             Config.WebAuthnRPID,
+		"timeout":          webAuthnTimeout,
+		"allowCredentials": allow,
+		"userVerification": userVerification,
+	})
+	if err != nil {
+		RenderProgramError(response, request, "Could not encode WebAuthn options", "", err)
+		return
+	}
+
+	infos := map[string]interface{}{"options": string(options)}
+	if errorName != "" {
+		RenderPageError(response, request, "webauthnlogin.gohtml", errorName, infos, nil)
+		return
+	}
+	RenderPage(response, request, "webauthnlogin.gohtml", map[string]interface{}{"config": Config, "infos": infos})
+}
+
+// webAuthnEnabled returns whether the given user has registered at least one
+// WebAuthn credential.
+func webAuthnEnabled(user User) bool {
+	webAuthnUser, ok := user.(WebAuthnUser)
+	return ok && len(webAuthnUser.GetWebAuthnCredentials()) > 0
+}
+
+// newWebAuthnChallenge generates a new random challenge, stores it in the
+// session, and returns it.
+func newWebAuthnChallenge(session *sessions.Session) (base64URLBytes, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	if err := session.Set(sessionKeyWebAuthnChallenge, base64.RawURLEncoding.EncodeToString(challenge)); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// takeWebAuthnChallenge returns the base64url-encoded challenge stored in the
+// session and removes it so it cannot be used again. If there is no challenge,
+// an empty string is returned.
+func takeWebAuthnChallenge(session *sessions.Session) (string, error) {
+	challenge, _ := session.Get(sessionKeyWebAuthnChallenge, "").(string)
+	if challenge == "" {
+		return "", nil
+	}
+	return challenge, session.Delete(sessionKeyWebAuthnChallenge)
+}
+
+// base64URLBytes is a byte slice which is encoded as an unpadded base64url
+// string in JSON, as is customary for WebAuthn.
+type base64URLBytes []byte
+
+// MarshalJSON implements the json.Marshaler interface.
+func (b base64URLBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. Padding is
+// accepted.
+func (b *base64URLBytes) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// webAuthnResponse is a PublicKeyCredential returned by the browser's
+// navigator.credentials.create() or navigator.credentials.get(), as posted by
+// our templates. Attestation responses (registration) contain an attestation
+// object, assertion responses (login) contain authenticator data and a
+// signature.
+type webAuthnResponse struct {
+	RawID    base64URLBytes `json:"rawId"`
+	Type     string         `json:"type"`
+	Response struct {
+		ClientDataJSON    base64URLBytes `json:"clientDataJSON"`
+		AttestationObject base64URLBytes `json:"attestationObject"`
+		AuthenticatorData base64URLBytes `json:"authenticatorData"`
+		Signature         base64URLBytes `json:"signature"`
+	} `json:"response"`
+}
+
+// webAuthnAuthenticatorData is the parsed authenticator data of a WebAuthn
+// response. The credential fields are only set if attested credential data
+// was included.
+type webAuthnAuthenticatorData struct {
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte // In COSE_Key format.
+}
+
+// verifyWebAuthnClientData checks the client data of a WebAuthn response
+// against the expected type ("webauthn.create" or "webauthn.get"), the
+// base64url-encoded challenge, and Config.WebAuthnOrigins.
+func verifyWebAuthnClientData(clientDataJSON []byte, expectedType, challenge string) error {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return fmt.Errorf("Invalid client data: %s", err)
+	}
+	if clientData.Type != expectedType {
+		return fmt.Errorf("Unexpected client data type %q", clientData.Type)
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(challenge)) != 1 {
+		return errors.New("Challenge does not match")
+	}
+	for _, origin := range Config.WebAuthnOrigins {
+		if clientData.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("Origin %q not allowed", clientData.Origin)
+}
+
+// parseWebAuthnAuthenticatorData parses authenticator data and checks its
+// relying party ID hash against Config.WebAuthnRPID, as well as the user
+// presence flag and, if requested, the user verification flag.
+func parseWebAuthnAuthenticatorData(data []byte, requireUserVerification bool) (*webAuthnAuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("Authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(Config.WebAuthnRPID))
+	if subtle.ConstantTimeCompare(data[:32], rpIDHash[:]) != 1 {
+		return nil, errors.New("Relying party ID does not match")
+	}
+	authData := &webAuthnAuthenticatorData{
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.flags&webAuthnFlagUserPresent == 0 {
+		return nil, errors.New("User not present")
+	}
+	if requireUserVerification && authData.flags&webAuthnFlagUserVerified == 0 {
+		return nil, errors.New("User not verified")
+	}
+
+	// Attested credential data.
+	if authData.flags&webAuthnFlagAttested != 0 {
+		data = data[37:]
+		if len(data) < 18 {
+			return nil, errors.New("Attested credential data too short")
+		}
+		authData.aaguid = append([]byte{}, data[:16]...)
+		length := int(binary.BigEndian.Uint16(data[16:18]))
+		data = data[18:]
+		if length == 0 || len(data) < length {
+			return nil, errors.New("Invalid credential ID length")
+		}
+		authData.credentialID = append([]byte{}, data[:length]...)
+		data = data[length:]
+		_, rest, err := cborDecode(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid credential public key: %s", err)
+		}
+		authData.publicKey = append([]byte{}, data[:len(data)-len(rest)]...)
+	}
+
+	return authData, nil
+}
+
+// verifyWebAuthnRegistration verifies the given JSON-encoded attestation
+// response against the base64url-encoded challenge and returns the new
+// credential.
+func verifyWebAuthnRegistration(credentialJSON, challenge string) (*WebAuthnCredential, error) {
+	var attestation webAuthnResponse
+	if err := json.Unmarshal([]byte(credentialJSON), &attestation); err != nil {
+		return nil, fmt.Errorf("Invalid credential: %s", err)
+	}
+	if attestation.Type != "public-key" {
+		return nil, fmt.Errorf("Unexpected credential type %q", attestation.Type)
+	}
+	if err := verifyWebAuthnClientData(attestation.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	// Decode the attestation object.
+	decoded, _, err := cborDecode(attestation.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid attestation object: %s", err)
+	}
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("Attestation object is not a map")
+	}
+	format, _ := object["fmt"].(string)
+	statement, _ := object["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := object["authData"].([]byte)
+	authData, err := parseWebAuthnAuthenticatorData(rawAuthData, Config.WebAuthnUserVerification == "required" || Config.WebAuthnPasswordless)
+	if err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, errors.New("No attested credential data")
+	}
+	if !bytes.Equal(authData.credentialID, attestation.RawID) {
+		return nil, errors.New("Credential ID does not match")
+	}
+	algorithm, _, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the attestation statement.
+	var allowed bool
+	for _, f := range Config.WebAuthnAttestationFormats {
+		if f == format {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("Attestation format %q not allowed", format)
+	}
+	var certificates []*x509.Certificate
+	switch format {
+	case "none":
+	case "packed":
+		alg, _ := statement["alg"].(int64)
+		signature, _ := statement["sig"].([]byte)
+		clientDataHash := sha256.Sum256(attestation.Response.ClientDataJSON)
+		signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+		if x5c, ok := statement["x5c"].([]interface{}); ok {
+			// Full attestation.
+			for _, der := range x5c {
+				raw, _ := der.([]byte)
+				certificate, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid attestation certificate: %s", err)
+				}
+				certificates = append(certificates, certificate)
+			}
+			if len(certificates) == 0 {
+				return nil, errors.New("Empty attestation certificate chain")
+			}
+			var signatureAlgorithm x509.SignatureAlgorithm
+			switch alg {
+			case coseAlgES256:
+				signatureAlgorithm = x509.ECDSAWithSHA256
+			case coseAlgEdDSA:
+				signatureAlgorithm = x509.PureEd25519
+			case coseAlgRS256:
+				signatureAlgorithm = x509.SHA256WithRSA
+			default:
+				return nil, fmt.Errorf("Unsupported attestation algorithm %d", alg)
+			}
+			if err := certificates[0].CheckSignature(signatureAlgorithm, signed, signature); err != nil {
+				return nil, fmt.Errorf("Invalid attestation signature: %s", err)
+			}
+		} else {
+			// Self attestation.
+			if alg != algorithm {
+				return nil, errors.New("Self attestation algorithm does not match credential")
+			}
+			if err := verifyCOSESignature(authData.publicKey, signed, signature); err != nil {
+				return nil, fmt.Errorf("Invalid attestation signature: %s", err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported attestation format %q", format)
+	}
+	if Config.WebAuthnAttestationPolicy != nil {
+		if err := Config.WebAuthnAttestationPolicy(format, authData.aaguid, certificates); err != nil {
+			return nil, fmt.Errorf("Attestation rejected: %s", err)
+		}
+	}
+
+	return &WebAuthnCredential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+		AAGUID:    authData.aaguid,
+		Format:    format,
+	}, nil
+}
+
+// verifyWebAuthnAssertion verifies the given assertion response for the given
+// credential against the base64url-encoded challenge. The new signature
+// counter is returned.
+func verifyWebAuthnAssertion(assertion *webAuthnResponse, challenge string, credential *WebAuthnCredential, requireUserVerification bool) (uint32, error) {
+	if assertion.Type != "public-key" {
+		return 0, fmt.Errorf("Unexpected credential type %q", assertion.Type)
+	}
+	if err := verifyWebAuthnClientData(assertion.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	authData, err := parseWebAuthnAuthenticatorData(assertion.Response.AuthenticatorData, requireUserVerification || Config.WebAuthnUserVerification == "required")
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(assertion.Response.ClientDataJSON)
+	signed := append(append([]byte{}, assertion.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(credential.PublicKey, signed, assertion.Response.Signature); err != nil {
+		return 0, err
+	}
+
+	// Authenticators which support signature counters must increase them.
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return 0, fmt.Errorf("Signature counter %d not greater than %d, authenticator may be cloned", authData.signCount, credential.SignCount)
+	}
+
+	return authData.signCount, nil
+}
+
+// parseCOSEKey parses a public key in COSE_Key format (RFC 8152) and returns
+// its algorithm and the key. Only ES256, EdDSA (Ed25519), and RS256 keys are
+// supported.
+func parseCOSEKey(data []byte) (int64, crypto.PublicKey, error) {
+	decoded, _, err := cborDecode(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Invalid COSE key: %s", err)
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, errors.New("COSE key is not a map")
+	}
+	keyType, _ := key[int64(1)].(int64)
+	algorithm, _ := key[int64(3)].(int64)
+	switch {
+	case algorithm == coseAlgES256 && keyType == 2:
+		curve, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if curve != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("Invalid ES256 COSE key")
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return 0, nil, errors.New("ES256 COSE key is not on curve")
+		}
+		return algorithm, publicKey, nil
+	case algorithm == coseAlgEdDSA && keyType == 1:
+		curve, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if curve != 6 || len(x) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("Invalid EdDSA COSE key")
+		}
+		return algorithm, ed25519.PublicKey(x), nil
+	case algorithm == coseAlgRS256 && keyType == 3:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, errors.New("Invalid RS256 COSE key")
+		}
+		var exponent int
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return algorithm, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	}
+	return 0, nil, fmt.Errorf("Unsupported COSE key type %d with algorithm %d", keyType, algorithm)
+}
+
+// verifyCOSESignature verifies a signature over the given data with a public
+// key in COSE_Key format.
+func verifyCOSESignature(coseKey, data, signature []byte) error {
+	_, publicKey, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], signature) {
+			return errors.New("Invalid ES256 signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, signature) {
+			return errors.New("Invalid EdDSA signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+			return errors.New("Invalid RS256 signature")
+		}
+	}
+	return nil
+}
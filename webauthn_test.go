@@ -0,0 +1,449 @@
+package users
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+// cborEncode encodes the given value as CBOR. It supports the types returned
+// by cborDecode() as well as int.
+func cborEncode(value interface{}) []byte {
+	header := func(major byte, argument uint64) []byte {
+		switch {
+		case argument < 24:
+			return []byte{major<<5 | byte(argument)}
+		case argument < 1<<8:
+			return []byte{major<<5 | 24, byte(argument)}
+		case argument < 1<<16:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(argument))
+			return b
+		case argument < 1<<32:
+			b := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(b[1:], uint32(argument))
+			return b
+		}
+		b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[1:], argument)
+		return b
+	}
+	switch v := value.(type) {
+	case int:
+		return cborEncode(int64(v))
+	case int64:
+		if v < 0 {
+			return header(1, uint64(-1-v))
+		}
+		return header(0, uint64(v))
+	case []byte:
+		return append(header(2, uint64(len(v))), v...)
+	case string:
+		return append(header(3, uint64(len(v))), v...)
+	case []interface{}:
+		data := header(4, uint64(len(v)))
+		for _, element := range v {
+			data = append(data, cborEncode(element)...)
+		}
+		return data
+	case map[interface{}]interface{}:
+		data := header(5, uint64(len(v)))
+		for key, element := range v {
+			data = append(data, cborEncode(key)...)
+			data = append(data, cborEncode(element)...)
+		}
+		return data
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	}
+	return []byte{0xf6}
+}
+
+// testAuthenticator is a software WebAuthn authenticator with an ES256 key.
+type testAuthenticator struct {
+	key     *ecdsa.PrivateKey
+	cose    []byte // The public key in COSE_Key format.
+	id      []byte
+	counter uint32
+	flags   byte   // Flags in addition to "user present".
+	origin  string // The origin reported in the client data.
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	cose := cborEncode(map[interface{}]interface{}{
+		int64(1):  int64(2),
+		int64(3):  int64(coseAlgES256),
+		int64(-1): int64(1),
+		int64(-2): x,
+		int64(-3): y,
+	})
+	return &testAuthenticator{key: key, cose: cose, id: id, flags: webAuthnFlagUserVerified, origin: Config.WebAuthnOrigins[0]}
+}
+
+// authenticatorData returns authenticator data, including attested credential
+// data if requested. The counter is increased.
+func (a *testAuthenticator) authenticatorData(attested bool) []byte {
+	a.counter++
+	rpIDHash := sha256.Sum256([]byte(Config.WebAuthnRPID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := webAuthnFlagUserPresent | a.flags
+	if attested {
+		flags |= webAuthnFlagAttested
+	}
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.counter)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID.
+		data = append(data, byte(len(a.id)>>8), byte(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.cose...)
+	}
+	return data
+}
+
+// clientData returns client data JSON for the given type and challenge.
+func (a *testAuthenticator) clientData(typ, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": a.origin})
+	return data
+}
+
+// sign signs the authenticator data and the hash of the client data.
+func (a *testAuthenticator) sign(t *testing.T, authData, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// register returns the JSON-encoded response to navigator.credentials.create()
+// with the given attestation format ("none" or "packed" self attestation).
+func (a *testAuthenticator) register(t *testing.T, challenge, format string) string {
+	authData := a.authenticatorData(true)
+	clientData := a.clientData("webauthn.create", challenge)
+	statement := map[interface{}]interface{}{}
+	if format == "packed" {
+		statement["alg"] = int64(coseAlgES256)
+		statement["sig"] = a.sign(t, authData, clientData)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	response, _ := json.Marshal(map[string]interface{}{
+		"id":    encode(a.id),
+		"rawId": encode(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON": encode(clientData),
+			"attestationObject": encode(cborEncode(map[interface{}]interface{}{
+				"fmt":      format,
+				"attStmt":  statement,
+				"authData": authData,
+			})),
+		},
+	})
+	return string(response)
+}
+
+// assert returns the JSON-encoded response to navigator.credentials.get().
+func (a *testAuthenticator) assert(t *testing.T, challenge string) string {
+	authData := a.authenticatorData(false)
+	clientData := a.clientData("webauthn.get", challenge)
+	encode := base64.RawURLEncoding.EncodeToString
+	response, _ := json.Marshal(map[string]interface{}{
+		"id":    encode(a.id),
+		"rawId": encode(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData),
+			"authenticatorData": encode(authData),
+			"signature":         encode(a.sign(t, authData, clientData)),
+		},
+	})
+	return string(response)
+}
+
+// credential returns the authenticator's credential as it would be stored
+// after registration.
+func (a *testAuthenticator) credential() WebAuthnCredential {
+	return WebAuthnCredential{ID: a.id, PublicKey: a.cose, SignCount: a.counter, Format: "none", Name: "Test"}
+}
+
+const testWebAuthnChallenge = "dGVzdGNoYWxsZW5nZXRlc3RjaGFsbGVuZ2V0ZXN0Y2g"
+
+func TestWebAuthnRegisterPage(t *testing.T) {
+	computed, _ := runRequest(&MyUser{email: "x", state: StateVerified}, nil, nil, WebAuthnRegister)
+	assertString("HIPKR0F", computed, t)
+}
+
+func TestWebAuthnRegister(t *testing.T) {
+	for _, format := range []string{"none", "packed"} {
+		authenticator := newTestAuthenticator(t)
+		user := &MyUser{email: "x", state: StateVerified}
+		computed, _ := runSessionRequest(user, map[string]interface{}{sessionKeyWebAuthnChallenge: testWebAuthnChallenge}, nil, map[string]string{
+			"credential": authenticator.register(t, testWebAuthnChallenge, format),
+			"name":       "Laptop",
+		}, WebAuthnRegister)
+		assertString("HIPKDF", computed, t)
+		if len(user.credentials) != 1 {
+			t.Fatalf("Credential with format %s was not registered", format)
+		}
+		credential := user.credentials[0]
+		if !bytes.Equal(credential.ID, authenticator.id) || !bytes.Equal(credential.PublicKey, authenticator.cose) || credential.SignCount != 1 || credential.Format != format || credential.Name != "Laptop" {
+			t.Errorf("Wrong credential registered: %+v", credential)
+		}
+	}
+}
+
+func TestWebAuthnRegisterInvalid(t *testing.T) {
+	Config.WebAuthnAttestationFormats = []string{"packed"}
+	defer func() { Config.WebAuthnAttestationFormats = []string{"none", "packed"} }()
+	for name, modify := range map[string]func(a *testAuthenticator) string{
+		"wrong challenge": func(a *testAuthenticator) string {
+			return a.register(t, "d3JvbmdjaGFsbGVuZ2U", "packed")
+		},
+		"wrong origin": func(a *testAuthenticator) string {
+			a.origin = "https://evil.com"
+			return a.register(t, testWebAuthnChallenge, "packed")
+		},
+		"format not allowed": func(a *testAuthenticator) string {
+			return a.register(t, testWebAuthnChallenge, "none")
+		},
+		"not a credential": func(a *testAuthenticator) string {
+			return "{}"
+		},
+	} {
+		user := &MyUser{email: "x", state: StateVerified}
+		computed, _ := runSessionRequest(user, map[string]interface{}{sessionKeyWebAuthnChallenge: testWebAuthnChallenge}, nil, map[string]string{
+			"credential": modify(newTestAuthenticator(t)),
+		}, WebAuthnRegister)
+		if computed != "HIPKR0!PKI!F" || len(user.credentials) != 0 {
+			t.Errorf("Invalid registration (%s) was accepted: %s", name, computed)
+		}
+	}
+}
+
+func TestWebAuthnRemove(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	user := &MyUser{
+		email:        "x",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		credentials:  []WebAuthnCredential{authenticator.credential()},
+	}
+	remove := map[string]string{"remove": authenticator.credential().EncodedID(), "currentpassword": "54321"}
+	computed, _ := runRequest(user, nil, remove, WebAuthnRegister)
+	assertString("HIPKR1!WCP!F", computed, t)
+	remove["currentpassword"] = "12345"
+	computed, _ = runRequest(user, nil, remove, WebAuthnRegister)
+	assertString("redirect", computed, t)
+	if len(user.credentials) != 0 {
+		t.Error("Credential was not removed")
+	}
+}
+
+func TestWebAuthnLogInSecondFactor(t *testing.T) {
+	var event string
+	authenticator := newTestAuthenticator(t)
+	user := &MyUser{
+		email:        "a@b",
+		state:        StateVerified,
+		passwordHash: []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC"),
+		credentials:  []WebAuthnCredential{authenticator.credential()},
+	}
+	Config.LoadUserByEmail = func(email string) (User, error) {
+		return user, nil
+	}
+	Config.LoggedIn = func(user User, ipAddress string) {
+		event = "logged in"
+	}
+	defer func() { Config.LoggedIn = nil }()
+
+	// The password alone is not enough.
+	computed, _ := runRequest(nil, nil, map[string]string{"email": "a@b", "password": "12345"}, LogIn)
+	assertString("redirect", computed, t)
+	assertString("", event, t)
+
+	// Log in with the passkey.
+	pending := map[string]interface{}{sessionKeySecondFactor: "a@b", sessionKeyWebAuthnChallenge: testWebAuthnChallenge}
+	computed, _ = runSessionRequest(nil, pending, nil, nil, WebAuthnLogIn)
+	assertString("HOPKF", computed, t)
+	computed, _ = runSessionRequest(nil, pending, nil, map[string]string{"credential": authenticator.assert(t, testWebAuthnChallenge)}, WebAuthnLogIn)
+	assertString("redirect", computed, t)
+	assertString("logged in", event, t)
+	if user.credentials[0].SignCount != 1 || user.credentials[0].LastUsed.IsZero() {
+		t.Errorf("Credential was not updated: %+v", user.credentials[0])
+	}
+
+	// A cloned authenticator does not increase the counter.
+	event = ""
+	authenticator.counter--
+	computed, _ = runSessionRequest(nil, pending, nil, map[string]string{"credential": authenticator.assert(t, testWebAuthnChallenge)}, WebAuthnLogIn)
+	assertString("HOPK!PKI!F", computed, t)
+	assertString("", event, t)
+
+	// Without a pending login, passkeys are not accepted.
+	computed, _ = runSessionRequest(nil, map[string]interface{}{sessionKeyWebAuthnChallenge: testWebAuthnChallenge}, nil, map[string]string{"credential": authenticator.assert(t, testWebAuthnChallenge)}, WebAuthnLogIn)
+	assertString("redirect", computed, t)
+	assertString("", event, t)
+}
+
+func TestWebAuthnLogInPasswordless(t *testing.T) {
+	var event string
+	authenticator := newTestAuthenticator(t)
+	user := &MyUser{email: "a@b", state: StateVerified, credentials: []WebAuthnCredential{authenticator.credential()}}
+	Config.WebAuthnPasswordless = true
+	loadUser := Config.LoadUserByWebAuthnCredential
+	Config.LoadUserByWebAuthnCredential = func(id []byte) (User, error) {
+		if bytes.Equal(id, authenticator.id) {
+			return user, nil
+		}
+		return nil, nil
+	}
+	Config.LoggedIn = func(user User, ipAddress string) {
+		event = "logged in"
+	}
+	defer func() {
+		Config.WebAuthnPasswordless = false
+		Config.LoadUserByWebAuthnCredential = loadUser
+		Config.LoggedIn = nil
+	}()
+	data := map[string]interface{}{sessionKeyWebAuthnChallenge: testWebAuthnChallenge}
+
+	// User verification is required.
+	authenticator.flags = 0
+	computed, _ := runSessionRequest(nil, data, nil, map[string]string{"credential": authenticator.assert(t, testWebAuthnChallenge)}, WebAuthnLogIn)
+	assertString("HOPK!PKI!F", computed, t)
+	assertString("", event, t)
+
+	// Unknown credentials are rejected.
+	computed, _ = runSessionRequest(nil, data, nil, map[string]string{"credential": newTestAuthenticator(t).assert(t, testWebAuthnChallenge)}, WebAuthnLogIn)
+	assertString("HOPK!PKI!F", computed, t)
+	assertString("", event, t)
+
+	authenticator.flags = webAuthnFlagUserVerified
+	computed, _ = runSessionRequest(nil, data, nil, map[string]string{"credential": authenticator.assert(t, testWebAuthnChallenge)}, WebAuthnLogIn)
+	assertString("redirect", computed, t)
+	assertString("logged in", event, t)
+}
+
+func TestVerifyCOSESignature(t *testing.T) {
+	data := []byte("signed data")
+	hash := sha256.Sum256(data)
+
+	// EdDSA.
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := cborEncode(map[interface{}]interface{}{int64(1): int64(1), int64(3): int64(coseAlgEdDSA), int64(-1): int64(6), int64(-2): []byte(edPublic)})
+	if err := verifyCOSESignature(edKey, data, ed25519.Sign(edPrivate, data)); err != nil {
+		t.Errorf("EdDSA signature not accepted: %s", err)
+	}
+	if err := verifyCOSESignature(edKey, []byte("other data"), ed25519.Sign(edPrivate, data)); err == nil {
+		t.Error("Wrong EdDSA signature accepted")
+	}
+
+	// RS256.
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey := cborEncode(map[interface{}]interface{}{int64(1): int64(3), int64(3): int64(coseAlgRS256), int64(-1): rsaPrivate.N.Bytes(), int64(-2): big.NewInt(int64(rsaPrivate.E)).Bytes()})
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaPrivate, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCOSESignature(rsaKey, data, signature); err != nil {
+		t.Errorf("RS256 signature not accepted: %s", err)
+	}
+	signature[0] ^= 1
+	if err := verifyCOSESignature(rsaKey, data, signature); err == nil {
+		t.Error("Wrong RS256 signature accepted")
+	}
+
+	// Algorithm and key type must match.
+	mismatched := cborEncode(map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(coseAlgEdDSA), int64(-1): int64(6), int64(-2): []byte(edPublic)})
+	if _, _, err := parseCOSEKey(mismatched); err == nil {
+		t.Error("Mismatched COSE key accepted")
+	}
+}
+
+func TestWebAuthnRemoveWithoutPassword(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &MyUser{
+		email:         "x",
+		state:         StateVerified,
+		totpSecret:    testTOTPSecret,
+		recoveryCodes: hashes,
+		credentials:   []WebAuthnCredential{authenticator.credential()},
+	}
+	remove := map[string]string{"remove": authenticator.credential().EncodedID()}
+	computed, _ := runRequest(user, nil, remove, WebAuthnRegister)
+	assertString("HIPKR1!NCP!F", computed, t)
+
+	// With a passkey assertion.
+	remove["assertion"] = authenticator.assert(t, "d3JvbmdjaGFsbGVuZ2U")
+	computed, _ = runSessionRequest(user, map[string]interface{}{sessionKeyWebAuthnChallenge: testWebAuthnChallenge}, nil, remove, WebAuthnRegister)
+	assertString("HIPKR1!PKI!F", computed, t)
+	remove["assertion"] = authenticator.assert(t, testWebAuthnChallenge)
+	computed, _ = runSessionRequest(user, map[string]interface{}{sessionKeyWebAuthnChallenge: testWebAuthnChallenge}, nil, remove, WebAuthnRegister)
+	assertString("redirect", computed, t)
+	if len(user.credentials) != 0 {
+		t.Error("Credential was not removed")
+	}
+
+	// With a recovery code.
+	user.credentials = []WebAuthnCredential{authenticator.credential()}
+	delete(remove, "assertion")
+	remove["code"] = "abcdefgh-ijklmnop"
+	computed, _ = runRequest(user, nil, remove, WebAuthnRegister)
+	assertString("HIPKR1!TI!F", computed, t)
+	remove["code"] = codes[0]
+	computed, _ = runRequest(user, nil, remove, WebAuthnRegister)
+	assertString("redirect", computed, t)
+	if len(user.credentials) != 0 {
+		t.Error("Credential was not removed")
+	}
+
+	// Users with a password must provide it.
+	user.passwordHash = []byte("$2a$10$bRkkfyQZRP3eQkgkRvoktuvt6.ebieDKr/hZY4zWHg98HHEhbTHCC")
+	user.credentials = []WebAuthnCredential{authenticator.credential(), authenticator.credential()}
+	user.credentials[1].ID = []byte("other")
+	remove["code"] = codes[1]
+	computed, _ = runRequest(user, nil, remove, WebAuthnRegister)
+	assertString("HIPKR2!NCP!F", computed, t)
+	delete(remove, "code")
+	remove["assertion"] = authenticator.assert(t, testWebAuthnChallenge)
+	computed, _ = runSessionRequest(user, map[string]interface{}{sessionKeyWebAuthnChallenge: testWebAuthnChallenge}, nil, remove, WebAuthnRegister)
+	assertString("HIPKR2!NCP!F", computed, t)
+	if len(user.credentials) != 2 {
+		t.Error("Credential was removed without the password")
+	}
+}